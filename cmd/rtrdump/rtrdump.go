@@ -36,11 +36,17 @@ var (
 	Serial     = flag.Int("serial.value", 0, "Serial number")
 	Session    = flag.Int("session.id", 0, "Session ID")
 
-	FlagVersion = flag.Int("rtr.version", 1, "What RTR version you want to use, Version 1 is RFC8210")
+	FlagVersion = flag.Int("rtr.version", 1, "What RTR version you want to use, Version 1 is RFC8210, Version 2 adds ASPA")
+	Strict      = flag.Bool("strict", false, "Validate PDUs against the specification and exit with an error if the cache sent non-conformant ones")
 
 	ConnType     = flag.String("type", "plain", "Type of connection: plain, tls or ssh")
 	ValidateCert = flag.Bool("tls.validate", true, "Validate TLS")
 
+	TCPMD5Key   = flag.String("tcp.md5", "", "TCP-MD5 key of the plain connection (Linux only)")
+	TCPAOKey    = flag.String("tcp.ao", "", "TCP-AO key of the plain connection (Linux only)")
+	TCPAOSendID = flag.Uint("tcp.ao.sendid", 0, "TCP-AO identifier of the key used by rtrdump")
+	TCPAORecvID = flag.Uint("tcp.ao.recvid", 0, "TCP-AO identifier of the key used by the cache")
+
 	ValidateSSH     = flag.Bool("ssh.validate", false, "Validate SSH key")
 	SSHServerKey    = flag.String("ssh.validate.key", "", "SSH server key SHA256 to validate")
 	SSHAuth         = flag.String("ssh.method", "none", "Select SSH method (none, password or key)")
@@ -72,6 +78,8 @@ type Client struct {
 	InitSerial bool
 	Serial     uint32
 	SessionID  uint16
+
+	NonConformant int
 }
 
 func (c *Client) HandlePDU(cs *rtr.ClientSession, pdu rtr.PDU) {
@@ -109,6 +117,17 @@ func (c *Client) HandlePDU(cs *rtr.ClientSession, pdu rtr.PDU) {
 		}
 		c.Data.BgpSecKeys = append(c.Data.BgpSecKeys, rj)
 
+		if *LogDataPDU {
+			log.Debugf("Received: %v", pdu)
+		}
+	case *rtr.PDUASPA:
+		rj := prefixfile.VAPJson{
+			CustomerAsid: pdu.CustomerASNumber,
+			Providers:    pdu.ProviderASNumbers,
+		}
+		c.Data.ASPA = append(c.Data.ASPA, rj)
+		c.Data.Metadata.CountASPAs++
+
 		if *LogDataPDU {
 			log.Debugf("Received: %v", pdu)
 		}
@@ -125,6 +144,11 @@ func (c *Client) HandlePDU(cs *rtr.ClientSession, pdu rtr.PDU) {
 	}
 }
 
+func (c *Client) HandleNonConformantPDU(cs *rtr.ClientSession, err *rtr.DecodeError) {
+	c.NonConformant++
+	log.Warnf("Received non-conformant PDU (%v): %x", err, err.PDU)
+}
+
 func (c *Client) ClientConnected(cs *rtr.ClientSession) {
 	if c.InitSerial {
 		cs.SendSerialQuery(c.SessionID, c.Serial)
@@ -148,21 +172,27 @@ func main() {
 		os.Exit(0)
 	}
 
-	targetVersion := rtr.PROTOCOL_VERSION_0
-	if *FlagVersion > 1 {
-		log.Fatalf("Invalid RTR Version provided, the highest version this release supports is 1")
-	}
-	if *FlagVersion == 1 {
-		targetVersion = rtr.PROTOCOL_VERSION_1
+	if *FlagVersion < 0 || *FlagVersion > rtr.PROTOCOL_VERSION_2 {
+		log.Fatalf("Invalid RTR Version provided, the highest version this release supports is %d", rtr.PROTOCOL_VERSION_2)
 	}
+	targetVersion := *FlagVersion
 
 	lvl, _ := log.ParseLevel(*LogLevel)
 	log.SetLevel(lvl)
 
 	cc := rtr.ClientConfiguration{
 		ProtocolVersion: uint8(targetVersion),
+		StrictDecoding:  *Strict,
 		Log:             log.StandardLogger(),
 	}
+	if *TCPMD5Key != "" {
+		cc.TCPSignatures = rtr.TCPSignatures{{Key: []byte(*TCPMD5Key)}}
+	} else if *TCPAOKey != "" {
+		if *TCPAOSendID > 255 || *TCPAORecvID > 255 {
+			log.Fatal("The TCP-AO key identifiers must be between 0 and 255")
+		}
+		cc.TCPSignatures = rtr.TCPSignatures{{Key: []byte(*TCPAOKey), AO: true, SendID: uint8(*TCPAOSendID), RecvID: uint8(*TCPAORecvID)}}
+	}
 
 	client := &Client{
 		Data: prefixfile.RPKIList{
@@ -245,4 +275,8 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	if client.NonConformant > 0 {
+		log.Fatalf("Cache sent %d non-conformant PDUs", client.NonConformant)
+	}
 }
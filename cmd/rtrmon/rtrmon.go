@@ -65,6 +65,10 @@ var (
 	PrimarySSHAuthKey      = flag.String("primary.ssh.auth.key", "id_rsa", fmt.Sprintf("SSH key file (if blank, will use envvar %s_1)", ENV_SSH_KEY))
 	PrimaryRefresh         = flag.Duration("primary.refresh", time.Second*600, "Refresh interval")
 	PrimaryRTRBreak        = flag.Bool("primary.rtr.break", false, "Break RTR session at each interval")
+	PrimaryTCPMD5Key       = flag.String("primary.tcp.md5", "", "TCP-MD5 key of the tcp:// connection (Linux only)")
+	PrimaryTCPAOKey        = flag.String("primary.tcp.ao", "", "TCP-AO key of the tcp:// connection (Linux only)")
+	PrimaryTCPAOSendID     = flag.Uint("primary.tcp.ao.sendid", 0, "TCP-AO identifier of the key used by rtrmon")
+	PrimaryTCPAORecvID     = flag.Uint("primary.tcp.ao.recvid", 0, "TCP-AO identifier of the key used by the cache")
 
 	SecondaryHost            = flag.String("secondary.host", "https://rpki.cloudflare.com/rpki.json", "secondary server")
 	SecondaryValidateCert    = flag.Bool("secondary.tls.validate", true, "Validate TLS")
@@ -76,6 +80,10 @@ var (
 	SecondarySSHAuthKey      = flag.String("secondary.ssh.auth.key", "id_rsa", fmt.Sprintf("SSH key file (if blank, will use envvar %s_2)", ENV_SSH_KEY))
 	SecondaryRefresh         = flag.Duration("secondary.refresh", time.Second*600, "Refresh interval")
 	SecondaryRTRBreak        = flag.Bool("secondary.rtr.break", false, "Break RTR session at each interval")
+	SecondaryTCPMD5Key       = flag.String("secondary.tcp.md5", "", "TCP-MD5 key of the tcp:// connection (Linux only)")
+	SecondaryTCPAOKey        = flag.String("secondary.tcp.ao", "", "TCP-AO key of the tcp:// connection (Linux only)")
+	SecondaryTCPAOSendID     = flag.Uint("secondary.tcp.ao.sendid", 0, "TCP-AO identifier of the key used by rtrmon")
+	SecondaryTCPAORecvID     = flag.Uint("secondary.tcp.ao.recvid", 0, "TCP-AO identifier of the key used by the cache")
 
 	LogLevel = flag.String("loglevel", "info", "Log level")
 	Version  = flag.Bool("version", false, "Print version")
@@ -133,6 +141,13 @@ var (
 		},
 		[]string{"server", "url"},
 	)
+	RTRNonConformantPDUs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rtr_nonconformant_pdus",
+			Help: "Number of PDUs received that do not conform to the specification.",
+		},
+		[]string{"server", "url", "type"},
+	)
 	LastUpdate = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "update",
@@ -157,6 +172,7 @@ func init() {
 	prometheus.MustRegister(RTRState)
 	prometheus.MustRegister(RTRSerial)
 	prometheus.MustRegister(RTRSession)
+	prometheus.MustRegister(RTRNonConformantPDUs)
 	prometheus.MustRegister(LastUpdate)
 
 	flag.Var(&visibilityThresholds, "visibility.thresholds", "comma-separated list of visibility thresholds to override the default")
@@ -215,10 +231,15 @@ type Client struct {
 	BreakRTR        bool
 	authType        int
 	keyBytes        []byte
+	TCPSignatures   rtr.TCPSignatures
 
 	serial    uint32
 	sessionID uint16
 
+	// Session of the last End of Data received, protected by compRtrLock
+	hasSerial       bool
+	serialSessionID uint16
+
 	FetchConfig *utils.FetchConfig
 
 	Path            string
@@ -275,6 +296,8 @@ func (c *Client) Start(id int, ch chan int) {
 
 			cc := rtr.ClientConfiguration{
 				ProtocolVersion: rtr.PROTOCOL_VERSION_1,
+				StrictDecoding:  true,
+				TCPSignatures:   c.TCPSignatures,
 				Log:             log.StandardLogger(),
 			}
 
@@ -530,7 +553,13 @@ func (c *Client) HandlePDU(cs *rtr.ClientSession, pdu rtr.PDU) {
 		log.Infof("%d: Received: %v", c.id, pdu)
 
 		c.compRtrLock.Lock()
+		// Within a session, serials only move forward (RFC 1982 arithmetic)
+		if c.hasSerial && c.serialSessionID == pdu.SessionId && pdu.SerialNumber != c.serial && !rtr.SerialLess(c.serial, pdu.SerialNumber) {
+			log.Warnf("%d: Serial went backwards from %d to %d (session %d)", c.id, c.serial, pdu.SerialNumber, pdu.SessionId)
+		}
 		c.serial = pdu.SerialNumber
+		c.hasSerial = true
+		c.serialSessionID = pdu.SessionId
 		tmpVrpMap := make(VRPMap, len(c.vrpsRtr))
 		for key, vrp := range c.vrpsRtr {
 			tmpVrpMap[key] = vrp
@@ -560,12 +589,31 @@ func (c *Client) HandlePDU(cs *rtr.ClientSession, pdu rtr.PDU) {
 		log.Infof("%d: Received: %v", c.id, pdu)
 	case *rtr.PDUSerialNotify:
 		log.Infof("%d: Received: %v", c.id, pdu)
+
+		c.compRtrLock.RLock()
+		serial := c.serial
+		newer := c.hasSerial && c.serialSessionID == pdu.SessionId && rtr.SerialLess(serial, pdu.SerialNumber)
+		c.compRtrLock.RUnlock()
+		if newer {
+			cs.SendSerialQuery(pdu.SessionId, serial)
+		}
 	default:
 		log.Infof("%d: Received: %v", c.id, pdu)
 		cs.Disconnect()
 	}
 }
 
+func (c *Client) HandleNonConformantPDU(cs *rtr.ClientSession, err *rtr.DecodeError) {
+	log.Warnf("%d: Received non-conformant PDU (%v): %x", c.id, err, err.PDU)
+
+	RTRNonConformantPDUs.With(
+		prometheus.Labels{
+			"server": idToInfo[c.id],
+			"url":    c.Path,
+			"type":   rtr.TypeToString(err.PDU[1]),
+		}).Inc()
+}
+
 func (c *Client) ClientConnected(cs *rtr.ClientSession) {
 	close(c.unlock)
 	cs.SendResetQuery()
@@ -911,6 +959,21 @@ func (c *Comparator) Start() error {
 	return nil
 }
 
+// tcpSignatures returns the TCP-MD5 or TCP-AO key of the connection to a
+// cache, if any.
+func tcpSignatures(md5Key, aoKey string, sendID, recvID uint) rtr.TCPSignatures {
+	if md5Key != "" {
+		return rtr.TCPSignatures{{Key: []byte(md5Key)}}
+	}
+	if aoKey == "" {
+		return nil
+	}
+	if sendID > 255 || recvID > 255 {
+		log.Fatal("The TCP-AO key identifiers must be between 0 and 255")
+	}
+	return rtr.TCPSignatures{{Key: []byte(aoKey), AO: true, SendID: uint8(sendID), RecvID: uint8(recvID)}}
+}
+
 func main() {
 	flag.Parse()
 	if flag.NArg() > 0 {
@@ -949,6 +1012,7 @@ func main() {
 	c1.RefreshInterval = *PrimaryRefresh
 	c1.FetchConfig = fc
 	c1.BreakRTR = *PrimaryRTRBreak
+	c1.TCPSignatures = tcpSignatures(*PrimaryTCPMD5Key, *PrimaryTCPAOKey, *PrimaryTCPAOSendID, *PrimaryTCPAORecvID)
 
 	if c1.SSHAuthPassword == "" {
 		c1.SSHAuthPassword = os.Getenv(fmt.Sprintf("%s_1", ENV_SSH_PASSWORD))
@@ -981,6 +1045,7 @@ func main() {
 	c2.RefreshInterval = *SecondaryRefresh
 	c2.FetchConfig = fc
 	c2.BreakRTR = *SecondaryRTRBreak
+	c2.TCPSignatures = tcpSignatures(*SecondaryTCPMD5Key, *SecondaryTCPAOKey, *SecondaryTCPAOSendID, *SecondaryTCPAORecvID)
 
 	if method, ok := authToId[*SecondarySSHAuth]; ok && method == METHOD_KEY {
 		c2.SSHAuthPassword = os.Getenv(fmt.Sprintf("%s_2", ENV_SSH_PASSWORD))
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// apiToken is the bearer token required by the /api endpoints. The file is
+// reloaded on SIGHUP.
+type apiToken struct {
+	path  string
+	token atomic.Pointer[[]byte]
+}
+
+func newAPIToken(path string) (*apiToken, error) {
+	a := &apiToken{path: path}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// load reads the token. The previous one is kept on error.
+func (a *apiToken) load() error {
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	token := bytes.TrimSpace(data)
+	if len(token) == 0 {
+		return errors.New("empty API token")
+	}
+	a.token.Store(&token)
+	return nil
+}
+
+// require wraps a handler so that it is only called with the token in the
+// Authorization header.
+func (a *apiToken) require(h http.HandlerFunc) http.HandlerFunc {
+	return func(wr http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), *a.token.Load()) != 1 {
+			log.Warnf("Unauthorized API request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			wr.Header().Set("WWW-Authenticate", "Bearer")
+			apiResponse(wr, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		h(wr, r)
+	}
+}
+
+func apiResponse(wr http.ResponseWriter, code int, message string) {
+	status := "success"
+	if code != http.StatusOK {
+		status = "error"
+	}
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(code)
+	json.NewEncoder(wr).Encode(map[string]interface{}{
+		"status":  status,
+		"message": message,
+	})
+}
+
+// clientAction disconnects a router, or sends it a Cache Reset or a Serial
+// Notify. The router is given by its ID in /clients.
+func (s *state) clientAction(wr http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		apiResponse(wr, http.StatusBadRequest, "Invalid client ID")
+		return
+	}
+	c := s.server.GetClient(id)
+	if c == nil {
+		apiResponse(wr, http.StatusNotFound, "No client with this ID")
+		return
+	}
+
+	action := r.PathValue("action")
+	switch action {
+	case "disconnect":
+		c.Disconnect()
+		apiResponse(wr, http.StatusOK, "Client disconnected")
+	case "reset":
+		s.server.ResetClient(c)
+		apiResponse(wr, http.StatusOK, "Serial Notify sent, the next Serial Query will get a Cache Reset")
+	case "notify":
+		s.server.NotifyClient(c)
+		apiResponse(wr, http.StatusOK, "Serial Notify sent")
+	default:
+		apiResponse(wr, http.StatusNotFound, "Unknown action")
+		return
+	}
+	log.Infof("API: %s client %v", action, c)
+}
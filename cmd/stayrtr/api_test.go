@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	rtr "github.com/bgp/stayrtr/lib"
+)
+
+func TestAPIToken(t *testing.T) {
+	token, err := newAPIToken(writeFile(t, "token", "s3cret\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := token.require(func(wr http.ResponseWriter, r *http.Request) {})
+
+	for _, tc := range []struct {
+		header string
+		code   int
+	}{
+		{"Bearer s3cret", http.StatusOK},
+		{"Bearer s3cret2", http.StatusUnauthorized},
+		{"s3cret", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest("POST", "/api/update", nil)
+		if tc.header != "" {
+			r.Header.Set("Authorization", tc.header)
+		}
+		rec := httptest.NewRecorder()
+		h(rec, r)
+		if rec.Code != tc.code {
+			t.Errorf("Wanted %d for %q, but got %d", tc.code, tc.header, rec.Code)
+		}
+	}
+
+	if _, err := newAPIToken(writeFile(t, "empty", "\n")); err == nil {
+		t.Error("Wanted an error for an empty token")
+	}
+}
+
+func TestClientAction(t *testing.T) {
+	s := &state{
+		server: rtr.NewServer(rtr.ServerConfiguration{ProtocolVersion: rtr.PROTOCOL_VERSION_1}, nil, nil),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/clients/{id}/{action}", s.clientAction)
+
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	client := rtr.ClientFromConn(srv, s.server, s.server)
+	client.SetVersion(rtr.PROTOCOL_VERSION_1)
+	go client.Start()
+	for deadline := time.Now().Add(5 * time.Second); s.server.GetClient(client.GetID()) == nil && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	do := func(path string) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("POST", path, nil))
+		return rec.Code
+	}
+	expect := func(pduType uint8) {
+		t.Helper()
+		cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+		pdu, err := rtr.Decode(cli)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pdu.GetType() != pduType {
+			t.Errorf("Wanted a %s, but got %v", rtr.TypeToString(pduType), pdu)
+		}
+	}
+
+	// The router is notified and its Serial Query gets a Cache Reset
+	if code := do(fmt.Sprintf("/api/clients/%d/reset", client.GetID())); code != http.StatusOK {
+		t.Errorf("Wanted 200 for a Cache Reset, but got %d", code)
+	}
+	expect(rtr.PDU_ID_SERIAL_NOTIFY)
+	cli.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := cli.Write((&rtr.PDUSerialQuery{Version: rtr.PROTOCOL_VERSION_1}).Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	expect(rtr.PDU_ID_CACHE_RESET)
+	if code := do(fmt.Sprintf("/api/clients/%d/notify", client.GetID())); code != http.StatusOK {
+		t.Errorf("Wanted 200 for a Serial Notify, but got %d", code)
+	}
+	expect(rtr.PDU_ID_SERIAL_NOTIFY)
+
+	for path, want := range map[string]int{
+		"/api/clients/router/reset":                            http.StatusBadRequest,
+		"/api/clients/0/reset":                                 http.StatusNotFound,
+		fmt.Sprintf("/api/clients/%d/restart", client.GetID()): http.StatusNotFound,
+	} {
+		if code := do(path); code != want {
+			t.Errorf("Wanted %d for %s, but got %d", want, path, code)
+		}
+	}
+
+	if code := do(fmt.Sprintf("/api/clients/%d/disconnect", client.GetID())); code != http.StatusOK {
+		t.Errorf("Wanted 200 for a disconnect, but got %d", code)
+	}
+	if _, err := rtr.Decode(cli); err == nil {
+		t.Error("Wanted the connection to be closed")
+	}
+}
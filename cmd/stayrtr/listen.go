@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	rtr "github.com/bgp/stayrtr/lib"
+)
+
+const (
+	unixBindPrefix = "unix:"
+
+	// First file descriptor passed by systemd socket activation
+	listenFdsStart = 3
+)
+
+// listen creates the listener for a bind address: either host:port for TCP
+// or unix:/path/to/socket for a Unix socket. The TCP-MD5 and TCP-AO keys of
+// the peers are set on TCP listeners.
+func listen(bind string, unixMode os.FileMode, sigs rtr.TCPSignatures) (net.Listener, error) {
+	path, ok := strings.CutPrefix(bind, unixBindPrefix)
+	if !ok {
+		if len(sigs) == 0 {
+			return net.Listen("tcp", bind)
+		}
+		// Multipath TCP does not support the keys
+		lc := net.ListenConfig{Control: sigs.Control}
+		lc.SetMultipathTCP(false)
+		return lc.Listen(context.Background(), "tcp", bind)
+	}
+	if len(sigs) > 0 {
+		return nil, errors.New("TCP-MD5 and TCP-AO keys can not be set on a Unix socket")
+	}
+
+	// Remove the socket left behind by a previous instance
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, unixMode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// transportFromName maps the FileDescriptorName of an activated socket to
+// the transport served on it. Unnamed sockets serve plain RTR.
+func transportFromName(name string) rtr.Transport {
+	switch name {
+	case "tls":
+		return rtr.TransportTLS
+	case "ssh":
+		return rtr.TransportSSH
+	default:
+		return rtr.TransportTCP
+	}
+}
+
+// activationListeners returns the sockets passed by systemd socket
+// activation (see sd_listen_fds(3)), grouped by transport.
+func activationListeners() (map[rtr.Transport][]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// Do not pass the sockets on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make(map[rtr.Transport][]net.Listener)
+	for i := 0; i < nfds; i++ {
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("activated socket %d (%s): %w", listenFdsStart+i, name, err)
+		}
+		transport := transportFromName(name)
+		listeners[transport] = append(listeners[transport], l)
+	}
+	return listeners, nil
+}
+
+// sdNotify sends a state change to the service manager (see sd_notify(3)).
+// Nothing is sent when not running under systemd.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns how often the service manager expects a
+// WATCHDOG=1 notification, or 0 if the watchdog is not enabled.
+func sdWatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	// Notify twice per interval so that a late tick does not trigger a restart
+	return time.Duration(usec) * time.Microsecond / 2
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	rtr "github.com/bgp/stayrtr/lib"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rtr.sock")
+
+	l, err := listen(unixBindPrefix+path, 0660, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Addr().Network() != "unix" {
+		t.Errorf("Wanted a unix listener, but got %v", l.Addr().Network())
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0660 {
+		t.Errorf("Wanted mode 0660, but got %v", fi.Mode().Perm())
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// A socket left behind by a crashed instance is replaced
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = listen(unixBindPrefix+path, 0660, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	// Other files are not
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen(unixBindPrefix+path, 0660, nil); err == nil {
+		t.Error("Wanted an error when the path is a regular file")
+	}
+}
+
+func TestTransportFromName(t *testing.T) {
+	tests := []struct {
+		name string
+		want rtr.Transport
+	}{
+		{"", rtr.TransportTCP},
+		{"stayrtr.socket", rtr.TransportTCP},
+		{"tls", rtr.TransportTLS},
+		{"ssh", rtr.TransportSSH},
+	}
+	for _, tc := range tests {
+		if got := transportFromName(tc.name); got != tc.want {
+			t.Errorf("transportFromName(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram not supported: %v", err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("Wanted no error without NOTIFY_SOCKET, but got %v", err)
+	}
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "READY=1" {
+		t.Errorf("Wanted READY=1, but got %q", buf[:n])
+	}
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "")
+	if got := sdWatchdogInterval(); got != 0 {
+		t.Errorf("Wanted the watchdog to be disabled, but got %v", got)
+	}
+	t.Setenv("WATCHDOG_USEC", "60000000")
+	if got := sdWatchdogInterval(); got != 30*time.Second {
+		t.Errorf("Wanted 30s, but got %v", got)
+	}
+	t.Setenv("WATCHDOG_PID", "1")
+	if os.Getpid() != 1 {
+		if got := sdWatchdogInterval(); got != 0 {
+			t.Errorf("Wanted the watchdog of another process to be ignored, but got %v", got)
+		}
+	}
+}
+
+func TestUpdateAlive(t *testing.T) {
+	s := &state{}
+	if !s.alive(time.Minute) {
+		t.Error("Wanted the update routine to be alive while waiting")
+	}
+	s.updateStarted.Store(time.Now().Add(-30 * time.Second).UnixNano())
+	if !s.alive(time.Minute) {
+		t.Error("Wanted the update routine to be alive during an update")
+	}
+	s.updateStarted.Store(time.Now().Add(-2 * time.Minute).UnixNano())
+	if s.alive(time.Minute) {
+		t.Error("Wanted a stuck update to be detected")
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// loadHostKeys reads the host keys from a comma-separated list of files, so
+// that a server can offer several key types (eg: ed25519 and RSA).
+func loadHostKeys(paths string) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	for _, path := range strings.Split(paths, ",") {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SSH host key %s: %w", path, err)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// sshAuthorizedKey is a key of an authorized_keys file, with the options
+// that apply to RTR.
+type sshAuthorizedKey struct {
+	key     ssh.PublicKey
+	comment string
+	// Source addresses allowed to use the key (any if empty)
+	from []sshFromPattern
+	// The key signs user certificates, valid for the principals if set
+	// and for the user otherwise
+	certAuthority bool
+	principals    []string
+}
+
+// allowedFrom tells whether the pattern-list of the from option accepts the
+// address: a negated pattern matching it refuses the key, otherwise another
+// pattern must match it, as done by OpenSSH.
+func (ak *sshAuthorizedKey) allowedFrom(addr netip.Addr) bool {
+	if len(ak.from) == 0 {
+		return true
+	}
+	if !addr.IsValid() {
+		return false
+	}
+	var allowed bool
+	for _, p := range ak.from {
+		if p.match(addr) {
+			if p.negated {
+				return false
+			}
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+// sshFromPattern is an entry of the pattern-list of the from option: an
+// address, a prefix, or a pattern with the * and ? wildcards. Hostnames are
+// not resolved, a pattern only matches the text of the address, like OpenSSH
+// with UseDNS disabled (its default).
+type sshFromPattern struct {
+	negated bool
+	// Valid for an address or a prefix
+	prefix  netip.Prefix
+	pattern string
+}
+
+func parseFromPatterns(list string) ([]sshFromPattern, error) {
+	var patterns []sshFromPattern
+	for _, entry := range strings.Split(list, ",") {
+		var p sshFromPattern
+		entry, p.negated = strings.CutPrefix(entry, "!")
+		if entry == "" {
+			return nil, errors.New("empty pattern")
+		}
+		if prefix, err := parsePrefixOrAddr(entry); err == nil {
+			p.prefix = prefix
+		} else if strings.Contains(entry, "/") {
+			return nil, err
+		} else {
+			p.pattern = strings.ToLower(entry)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+func (p sshFromPattern) match(addr netip.Addr) bool {
+	if p.prefix.IsValid() {
+		return p.prefix.Contains(addr)
+	}
+	return matchWildcard(p.pattern, addr.String())
+}
+
+// matchWildcard matches a string against a pattern in which * matches any
+// sequence of characters and ? any single character.
+func matchWildcard(pattern, s string) bool {
+	p, i := 0, 0
+	// Positions after the last * and in the string when it was reached
+	starP, starI := -1, 0
+	for p < len(pattern) || i < len(s) {
+		if p < len(pattern) {
+			switch c := pattern[p]; {
+			case c == '*':
+				starP, starI = p+1, i
+				p++
+				continue
+			case i < len(s) && (c == '?' || c == s[i]):
+				p++
+				i++
+				continue
+			}
+		}
+		// The last * matches one more character
+		if starP >= 0 && starI < len(s) {
+			starI++
+			p, i = starP, starI
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// parseAuthorizedKeys reads an authorized_keys file. The options restricting
+// features RTR does not use (eg: no-pty) are ignored. A key with a from option
+// that cannot be parsed is skipped, the other keys of the file still apply.
+func parseAuthorizedKeys(data []byte) ([]sshAuthorizedKey, error) {
+	var keys []sshAuthorizedKey
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+lines:
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, comment, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		ak := sshAuthorizedKey{key: key, comment: comment}
+		for _, option := range options {
+			name, value, _ := strings.Cut(option, "=")
+			value = strings.Trim(value, `"`)
+			switch strings.ToLower(name) {
+			case "from":
+				if ak.from, err = parseFromPatterns(value); err != nil {
+					log.Warnf("Skipping the key of line %d (%s): from: %v", n, comment, err)
+					continue lines
+				}
+			case "cert-authority":
+				ak.certAuthority = true
+			case "principals":
+				ak.principals = strings.Split(value, ",")
+			}
+		}
+		keys = append(keys, ak)
+	}
+	return keys, scanner.Err()
+}
+
+func parsePrefixOrAddr(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// sshCredentials are the keys and passwords accepted from the routers
+type sshCredentials struct {
+	// Keys of each user, and keys accepted for any user under ""
+	keys map[string][]sshAuthorizedKey
+	// Trusted CAs of user certificates
+	cas []ssh.PublicKey
+	// bcrypt hashes of the passwords of each user
+	passwords map[string][]byte
+}
+
+func (c *sshCredentials) userKeys(user string) []sshAuthorizedKey {
+	if user == "" {
+		return c.keys[""]
+	}
+	return append(slices.Clip(c.keys[user]), c.keys[""]...)
+}
+
+// sshAuth authenticates the routers connecting over SSH. The credentials
+// can be reloaded, the routers already connected are kept.
+type sshAuth struct {
+	// authorized_keys accepted for any user, or its content when empty
+	keyFile string
+	keys    string
+	// Directory of authorized_keys files named after the users
+	keyDir string
+	// authorized_keys file of the CAs signing the certificates of the users
+	caFile string
+	// File of user:hash lines, replacing user and password
+	passwordFile   string
+	user, password string
+	// Any key is accepted
+	bypassKeys bool
+
+	creds atomic.Pointer[sshCredentials]
+}
+
+// load reads the credentials. The previous ones are kept on error.
+func (a *sshAuth) load() error {
+	creds := &sshCredentials{
+		keys:      make(map[string][]sshAuthorizedKey),
+		passwords: make(map[string][]byte),
+	}
+
+	data := []byte(a.keys)
+	if a.keyFile != "" {
+		var err error
+		if data, err = os.ReadFile(a.keyFile); err != nil {
+			return err
+		}
+	}
+	keys, err := parseAuthorizedKeys(data)
+	if err != nil {
+		return fmt.Errorf("authorized keys: %w", err)
+	}
+	creds.keys[""] = keys
+
+	if a.keyDir != "" {
+		entries, err := os.ReadDir(a.keyDir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			path := filepath.Join(a.keyDir, entry.Name())
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if creds.keys[entry.Name()], err = parseAuthorizedKeys(data); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+
+	if a.caFile != "" {
+		data, err := os.ReadFile(a.caFile)
+		if err != nil {
+			return err
+		}
+		cas, err := parseAuthorizedKeys(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", a.caFile, err)
+		}
+		for _, ca := range cas {
+			creds.cas = append(creds.cas, ca.key)
+		}
+	}
+
+	if a.passwordFile != "" {
+		data, err := os.ReadFile(a.passwordFile)
+		if err != nil {
+			return err
+		}
+		for n, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			user, hash, ok := strings.Cut(line, ":")
+			if !ok {
+				return fmt.Errorf("%s: line %d: wanted user:hash", a.passwordFile, n+1)
+			}
+			if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+				return fmt.Errorf("%s: line %d: %w", a.passwordFile, n+1, err)
+			}
+			creds.passwords[user] = []byte(hash)
+		}
+	}
+
+	a.creds.Store(creds)
+	return nil
+}
+
+var errSSHAuth = errors.New("authentication failed")
+
+func (a *sshAuth) passwordCallback(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	var ok bool
+	if a.passwordFile != "" {
+		hash, exists := a.creds.Load().passwords[conn.User()]
+		ok = exists && bcrypt.CompareHashAndPassword(hash, password) == nil
+	} else {
+		userOk := subtle.ConstantTimeCompare([]byte(conn.User()), []byte(a.user)) == 1
+		ok = subtle.ConstantTimeCompare(password, []byte(a.password)) == 1 && userOk
+	}
+	if !ok {
+		log.Warnf("Wrong user or password for %v/%v. Disconnecting.", conn.User(), conn.RemoteAddr())
+		return nil, errSSHAuth
+	}
+	log.Infof("Connected (ssh-password): %v/%v", conn.User(), conn.RemoteAddr())
+	return &ssh.Permissions{}, nil
+}
+
+func (a *sshAuth) publicKeyCallback(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		return a.checkCertificate(conn, cert)
+	}
+	fingerprint := ssh.FingerprintSHA256(key)
+	if a.bypassKeys {
+		log.Infof("Connected (ssh-key): %v/%v with key %v %v", conn.User(), conn.RemoteAddr(), key.Type(), fingerprint)
+		return &ssh.Permissions{}, nil
+	}
+
+	addr := remoteAddr(conn.RemoteAddr())
+	for _, ak := range a.creds.Load().userKeys(conn.User()) {
+		if !ak.certAuthority && keysEqual(ak.key, key) && ak.allowedFrom(addr) {
+			log.Infof("Connected (ssh-key): %v/%v with key %v %v (%s)", conn.User(), conn.RemoteAddr(), key.Type(), fingerprint, ak.comment)
+			return &ssh.Permissions{}, nil
+		}
+	}
+	log.Warnf("No key for %v/%v %v %v. Disconnecting.", conn.User(), conn.RemoteAddr(), key.Type(), fingerprint)
+	return nil, errSSHAuth
+}
+
+// checkCertificate accepts the user certificates signed by a trusted CA, or
+// by a key with the cert-authority option, for one of their principals.
+func (a *sshAuth) checkCertificate(conn ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, error) {
+	if cert.CertType != ssh.UserCert {
+		return nil, errors.New("not a user certificate")
+	}
+	creds := a.creds.Load()
+	var principals []string
+	if slices.ContainsFunc(creds.cas, func(ca ssh.PublicKey) bool { return keysEqual(ca, cert.SignatureKey) }) {
+		principals = []string{conn.User()}
+	} else {
+		addr := remoteAddr(conn.RemoteAddr())
+		for _, ak := range creds.userKeys(conn.User()) {
+			if ak.certAuthority && keysEqual(ak.key, cert.SignatureKey) && ak.allowedFrom(addr) {
+				principals = ak.principals
+				if len(principals) == 0 {
+					principals = []string{conn.User()}
+				}
+				break
+			}
+		}
+	}
+	if principals == nil {
+		log.Warnf("Certificate %q of %v/%v not signed by a trusted CA. Disconnecting.", cert.KeyId, conn.User(), conn.RemoteAddr())
+		return nil, errSSHAuth
+	}
+
+	// Unlike OpenSSH, CertChecker accepts a certificate without principals
+	// for any user
+	i := slices.IndexFunc(principals, func(p string) bool { return slices.Contains(cert.ValidPrincipals, p) })
+	if i < 0 {
+		log.Warnf("Certificate %q of %v/%v not valid for the user (principals %q). Disconnecting.", cert.KeyId, conn.User(), conn.RemoteAddr(), cert.ValidPrincipals)
+		return nil, errSSHAuth
+	}
+	checker := &ssh.CertChecker{}
+	if err := checker.CheckCert(principals[i], cert); err != nil {
+		log.Warnf("Invalid certificate %q of %v/%v: %v. Disconnecting.", cert.KeyId, conn.User(), conn.RemoteAddr(), err)
+		return nil, errSSHAuth
+	}
+	log.Infof("Connected (ssh-cert): %v/%v with certificate %q (serial %d) signed by %v", conn.User(), conn.RemoteAddr(),
+		cert.KeyId, cert.Serial, ssh.FingerprintSHA256(cert.SignatureKey))
+	// The source-address option of the certificate is checked by the server
+	return &ssh.Permissions{CriticalOptions: cert.CriticalOptions}, nil
+}
+
+func keysEqual(a, b ssh.PublicKey) bool {
+	return subtle.ConstantTimeCompare(a.Marshal(), b.Marshal()) == 1
+}
+
+func remoteAddr(addr net.Addr) netip.Addr {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.AddrPort().Addr().Unmap()
+	}
+	return netip.Addr{}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// testConnMetadata is the metadata of an SSH connection being authenticated
+type testConnMetadata struct {
+	user string
+	addr net.Addr
+}
+
+func (m *testConnMetadata) User() string          { return m.user }
+func (m *testConnMetadata) SessionID() []byte     { return nil }
+func (m *testConnMetadata) ClientVersion() []byte { return nil }
+func (m *testConnMetadata) ServerVersion() []byte { return nil }
+func (m *testConnMetadata) RemoteAddr() net.Addr  { return m.addr }
+func (m *testConnMetadata) LocalAddr() net.Addr   { return m.addr }
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func newTestUserCertificate(t *testing.T, ca ssh.Signer, key ssh.PublicKey, principals []string, validBefore time.Time) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             key,
+		KeyId:           "router",
+		CertType:        ssh.UserCert,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func authorizedKey(options string, key ssh.PublicKey) string {
+	line := string(ssh.MarshalAuthorizedKey(key))
+	if options != "" {
+		line = options + " " + line
+	}
+	return line
+}
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	key := newTestSigner(t).PublicKey()
+	keys, err := parseAuthorizedKeys([]byte("# routers\n\n" +
+		`from="192.0.2.0/24,2001:db8::1",no-pty ` + strings.TrimSpace(authorizedKey("", key)) + " router1\n" +
+		authorizedKey(`cert-authority,principals="rtr,rpki"`, key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("Wanted 2 keys, but got %d", len(keys))
+	}
+	if keys[0].comment != "router1" || len(keys[0].from) != 2 || keys[0].certAuthority {
+		t.Errorf("Unexpected first key %+v", keys[0])
+	}
+	if !keys[1].certAuthority || len(keys[1].principals) != 2 || keys[1].principals[1] != "rpki" {
+		t.Errorf("Unexpected second key %+v", keys[1])
+	}
+
+	if _, err := parseAuthorizedKeys([]byte("ssh-ed25519 notbase64")); err == nil {
+		t.Error("Wanted an error for an invalid key")
+	}
+
+	// Only the key with an invalid from option is skipped
+	keys, err = parseAuthorizedKeys([]byte(`from="192.0.2.0/33" ` + authorizedKey("", key) +
+		`from="*.example.net,!192.0.2.1" ` + authorizedKey("", key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || len(keys[0].from) != 2 {
+		t.Errorf("Wanted only the second key, but got %+v", keys)
+	}
+}
+
+func TestSSHFromPatterns(t *testing.T) {
+	tests := []struct {
+		from string
+		addr string
+		ok   bool
+	}{
+		{"192.0.2.0/24", "192.0.2.1", true},
+		{"192.0.2.0/24", "198.51.100.1", false},
+		{"192.0.2.*", "192.0.2.1", true},
+		{"192.0.2.?", "192.0.2.10", false},
+		{"2001:DB8::*", "2001:db8::1", true},
+		{"192.0.2.0/24,!192.0.2.1", "192.0.2.1", false},
+		{"192.0.2.0/24,!192.0.2.1", "192.0.2.2", true},
+		{"!192.0.2.1", "192.0.2.2", false},
+		{"*,!10.*", "10.0.0.1", false},
+		{"*,!10.*", "192.0.2.1", true},
+		{"router.example.net", "192.0.2.1", false},
+		{"*.example.net,192.0.2.1", "192.0.2.1", true},
+	}
+	for _, tc := range tests {
+		from, err := parseFromPatterns(tc.from)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.from, err)
+		}
+		ak := &sshAuthorizedKey{from: from}
+		if ok := ak.allowedFrom(netip.MustParseAddr(tc.addr)); ok != tc.ok {
+			t.Errorf("Wanted %v for %s from %q, but got %v", tc.ok, tc.addr, tc.from, ok)
+		}
+	}
+
+	for _, from := range []string{"192.0.2.0/33", "192.0.2.1,", "!"} {
+		if _, err := parseFromPatterns(from); err == nil {
+			t.Errorf("Wanted an error for %q", from)
+		}
+	}
+}
+
+func TestMatchWildcard(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		ok         bool
+	}{
+		{"*", "", true},
+		{"", "", true},
+		{"", "a", false},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbbd", false},
+		{"a*b*c", "axbxbxc", true},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"**a", "bba", true},
+		{"*a", "ab", false},
+	}
+	for _, tc := range tests {
+		if ok := matchWildcard(tc.pattern, tc.s); ok != tc.ok {
+			t.Errorf("Wanted %v for %q against %q, but got %v", tc.ok, tc.s, tc.pattern, ok)
+		}
+	}
+}
+
+func TestSSHAuthKeys(t *testing.T) {
+	anyUser, router1, restricted := newTestSigner(t), newTestSigner(t), newTestSigner(t)
+	ca, userCA, unknownCA := newTestSigner(t), newTestSigner(t), newTestSigner(t)
+
+	dir := t.TempDir()
+	keyDir := filepath.Join(dir, "users")
+	if err := os.Mkdir(keyDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		filepath.Join(dir, "authorized_keys"): authorizedKey("", anyUser.PublicKey()),
+		filepath.Join(keyDir, "router1"): authorizedKey("", router1.PublicKey()) +
+			authorizedKey(`from="192.0.2.0/24"`, restricted.PublicKey()) +
+			authorizedKey(`cert-authority,principals="edge"`, userCA.PublicKey()),
+		filepath.Join(dir, "ca.pub"): authorizedKey("", ca.PublicKey()),
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := &sshAuth{
+		keyFile: filepath.Join(dir, "authorized_keys"),
+		keyDir:  keyDir,
+		caFile:  filepath.Join(dir, "ca.pub"),
+	}
+	if err := a.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	inside := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	outside := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 1234}
+	valid := time.Now().Add(time.Hour)
+	tests := []struct {
+		desc string
+		user string
+		addr net.Addr
+		key  ssh.PublicKey
+		ok   bool
+	}{
+		{"Key of any user", "router2", outside, anyUser.PublicKey(), true},
+		{"Key of the user", "router1", outside, router1.PublicKey(), true},
+		{"Key of another user", "router2", outside, router1.PublicKey(), false},
+		{"Key from an allowed address", "router1", inside, restricted.PublicKey(), true},
+		{"Key from another address", "router1", outside, restricted.PublicKey(), false},
+		{"Unknown key", "router1", outside, ca.PublicKey(), false},
+		{"Certificate", "router3", outside, newTestUserCertificate(t, ca, router1.PublicKey(), []string{"router3"}, valid), true},
+		{"Certificate of another user", "router2", outside, newTestUserCertificate(t, ca, router1.PublicKey(), []string{"router3"}, valid), false},
+		{"Certificate without principals", "router3", outside, newTestUserCertificate(t, ca, router1.PublicKey(), nil, valid), false},
+		{"Expired certificate", "router3", outside, newTestUserCertificate(t, ca, router1.PublicKey(), []string{"router3"}, time.Now().Add(-time.Minute)), false},
+		{"Certificate of an unknown CA", "router3", outside, newTestUserCertificate(t, unknownCA, router1.PublicKey(), []string{"router3"}, valid), false},
+		{"Certificate of a user CA", "router1", outside, newTestUserCertificate(t, userCA, router1.PublicKey(), []string{"edge"}, valid), true},
+		{"Certificate of a user CA for another principal", "router1", outside, newTestUserCertificate(t, userCA, router1.PublicKey(), []string{"router1"}, valid), false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			perms, err := a.publicKeyCallback(&testConnMetadata{user: tc.user, addr: tc.addr}, tc.key)
+			if (err == nil) != tc.ok {
+				t.Errorf("Wanted accepted %v, but got (%v)", tc.ok, err)
+			}
+			if err == nil && perms == nil {
+				t.Error("Wanted permissions for an accepted key")
+			}
+		})
+	}
+
+	// The credentials are reloaded
+	if err := os.WriteFile(filepath.Join(keyDir, "router1"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.publicKeyCallback(&testConnMetadata{user: "router1", addr: outside}, router1.PublicKey()); err == nil {
+		t.Error("Wanted the removed key to be refused")
+	}
+}
+
+func TestSSHAuthPasswords(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret1"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "passwords")
+	if err := os.WriteFile(path, []byte("# users\nrouter1:"+string(hash)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	file := &sshAuth{passwordFile: path}
+	if err := file.load(); err != nil {
+		t.Fatal(err)
+	}
+	single := &sshAuth{user: "rpki", password: "rpki"}
+	if err := single.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc     string
+		auth     *sshAuth
+		user     string
+		password string
+		ok       bool
+	}{
+		{"File", file, "router1", "secret1", true},
+		{"File wrong password", file, "router1", "secret2", false},
+		{"File unknown user", file, "rpki", "rpki", false},
+		{"Single user", single, "rpki", "rpki", true},
+		{"Single user wrong user", single, "router1", "rpki", false},
+		{"Single user wrong password", single, "rpki", "", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := tc.auth.passwordCallback(&testConnMetadata{user: tc.user}, []byte(tc.password))
+			if (err == nil) != tc.ok {
+				t.Errorf("Wanted accepted %v, but got (%v)", tc.ok, err)
+			}
+		})
+	}
+
+	if err := os.WriteFile(path, []byte("router1:plaintext\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.load(); err == nil {
+		t.Error("Wanted an error for a password that is not hashed")
+	}
+}
+
+func TestLoadHostKeys(t *testing.T) {
+	dir := t.TempDir()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for i, key := range []any{edKey, rsaKey} {
+		block, err := ssh.MarshalPrivateKey(key, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, []string{"ed25519.pem", "rsa.pem"}[i])
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	signers, err := loadHostKeys(paths[0] + "," + paths[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 2 || signers[0].PublicKey().Type() != ssh.KeyAlgoED25519 || signers[1].PublicKey().Type() != ssh.KeyAlgoRSA {
+		t.Errorf("Wanted an ed25519 and an RSA key, but got %v", signers)
+	}
+	if _, err := loadHostKeys(paths[0] + "," + filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("Wanted an error for a missing key")
+	}
+}
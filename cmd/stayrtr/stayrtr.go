@@ -2,21 +2,27 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
-	"crypto/tls"
-	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -46,6 +52,19 @@ const (
 	USE_SERIAL_FULL
 )
 
+// File in -state.dir where the state of the server is saved
+const stateFileName = "stayrtr.state"
+
+// Time after which an update in progress is considered stuck: the systemd
+// watchdog is no longer notified so that the service is restarted
+const updateStuckTimeout = 15 * time.Minute
+
+// Values of -rtr.serial
+const (
+	serialIncrement = "increment"
+	serialGenerated = "generated"
+)
+
 var (
 	AppVersion = "StayRTR " + rtr.APP_VERSION
 
@@ -53,33 +72,70 @@ var (
 	MetricsPath = flag.String("metrics.path", "/metrics", "Metrics path")
 
 	ExportPath           = flag.String("export.path", "/rpki.json", "Export path")
-	EnableUpdateEndpoint = flag.Bool("update.endpoint", false, "Enable HTTP endpoint that expedites the next fetch")
+	EnableUpdateEndpoint = flag.Bool("update.endpoint", false, "Enable HTTP endpoint that expedites the next fetch (protected by -api.token.file if set)")
+	EnableRotateEndpoint = flag.Bool("rotate.endpoint", false, "Enable HTTP endpoint that rotates the RTR session (requires -api.token.file)")
+	EnableClientsAPI     = flag.Bool("clients.endpoint", false, "Enable HTTP endpoints that disconnect a router, or send it a Cache Reset or a Serial Notify (requires -api.token.file)")
+	APITokenFile         = flag.String("api.token.file", "", "File of the bearer token required by the /api endpoints (reloaded on SIGHUP)")
 
-	RTRVersion     = flag.Int("protocol", 1, "RTR protocol version. Default is version 1 (RFC 8210)")
+	RTRVersion     = flag.Int("protocol", 1, "RTR protocol version. Default is version 1 (RFC 8210), version 2 adds ASPA (draft-ietf-sidrops-8210bis)")
 	RefreshRTR     = flag.Int("rtr.refresh", 3600, "Refresh interval")
 	RetryRTR       = flag.Int("rtr.retry", 600, "Retry interval")
 	ExpireRTR      = flag.Int("rtr.expire", 7200, "Expire interval")
+	SerialMode     = flag.String("rtr.serial", serialIncrement, fmt.Sprintf("How the serial is set: %s (by one for each update) or %s (generation time of the data, identical across caches serving the same data; a SLURM change is then only applied with the next generation of the data)", serialIncrement, serialGenerated))
+	SessionID      = flag.Int("rtr.sessionid", -1, "RTR session ID of all the protocol versions (-1 for a random one, ignored when a state is restored)")
+	SessionIDs     = flag.String("rtr.sessionids", "", "RTR session IDs of each protocol version starting from version 0, separated by commas (overrides -rtr.sessionid)")
+	DiffCount      = flag.Int("rtr.diff.count", 256, "Number of serials for which routers can get a diff instead of a cache reset (0 for no limit)")
+	DiffAge        = flag.Duration("rtr.diff.age", 24*time.Hour, "Time for which routers can get a diff from a serial instead of a cache reset (0 for no limit)")
 	SendNotifs     = flag.Bool("notifications", true, "Send notifications to clients (disable with -notifications=false)")
 	EnforceVersion = flag.Bool("enforce.version", false, "Disable version negotiation")
 	DisableBGPSec  = flag.Bool("disable.bgpsec", false, "Disable sending out BGPSEC Router Keys")
 	EnableNODELAY  = flag.Bool("enable.nodelay", false, "Force enable TCP NODELAY (Likely increases CPU)")
 
-	Bind = flag.String("bind", ":8282", "Bind address")
+	StateDir = flag.String("state.dir", "", "Directory where the session, serial and data are saved to be restored after a restart")
+
+	WriteTimeout = flag.Duration("client.write.timeout", time.Minute, "Time allowed for a write to a client before disconnecting it (0 for no limit)")
+	QueueSize    = flag.Int("client.queue.size", 4<<20, "Size in bytes of the PDUs queued for a client")
+	SlowPolicy   = flag.String("client.slow.policy", rtr.SlowClientDisconnect.String(), fmt.Sprintf("What happens to a Serial Notify sent to a client whose queue is full: %v or %v", rtr.SlowClientDisconnect, rtr.SlowClientDropNotify))
+
+	IdleTimeout       = flag.Duration("client.idle.timeout", 0, "Time without a query after which a router is disconnected (0 for the expire interval, negative for no limit)")
+	KeepAlive         = flag.Bool("tcp.keepalive", true, "Send TCP keepalive probes to detect dead routers (disable with -tcp.keepalive=false)")
+	KeepAliveIdle     = flag.Duration("tcp.keepalive.idle", time.Minute, "Time a connection is idle before sending TCP keepalive probes")
+	KeepAliveInterval = flag.Duration("tcp.keepalive.interval", 15*time.Second, "Interval between TCP keepalive probes")
+	KeepAliveCount    = flag.Int("tcp.keepalive.count", 4, "Number of unanswered TCP keepalive probes before closing the connection")
+
+	ShutdownTimeout = flag.Duration("shutdown.timeout", 10*time.Second, "Maximum time to wait for clients to disconnect on shutdown")
+	ShutdownNotify  = flag.Bool("shutdown.notify", false, "Send an Error Report to clients before disconnecting them on shutdown")
 
-	BindTLS = flag.String("tls.bind", "", "Bind address for TLS")
-	TLSCert = flag.String("tls.cert", "", "Certificate path")
-	TLSKey  = flag.String("tls.key", "", "Private key path")
+	ErrorReset = flag.Bool("error.reset", false, "Answer with a Cache Reset the next Serial Query of a router that reported a withdrawal of an unknown record or a duplicate announcement")
 
-	BindSSH = flag.String("ssh.bind", "", "Bind address for SSH")
-	SSHKey  = flag.String("ssh.key", "private.pem", "SSH host key")
+	Bind     = flag.String("bind", ":8282", "Bind address (host:port, or unix:/path for a Unix socket)")
+	UnixMode = flag.Uint("unix.mode", 0666, "Permissions of the Unix sockets")
+	ACLFile  = flag.String("acl", "", "File of allow and deny rules for the source addresses of the plain connections (reloaded on SIGHUP)")
+	TCPKeys  = flag.String("tcp.keys", "", "File of the TCP-MD5 and TCP-AO keys of the routers connecting to the plain listener (Linux only)")
+	Proxy    = flag.String("proxy", "", "Comma-separated prefixes of the trusted proxies sending a PROXY protocol header on the plain listener")
+
+	BindTLS    = flag.String("tls.bind", "", "Bind address for TLS")
+	TLSCert    = flag.String("tls.cert", "", "Certificate path")
+	TLSKey     = flag.String("tls.key", "", "Private key path")
+	TLSCA      = flag.String("tls.client.ca", "", "CA bundle verifying the certificates required from the routers")
+	TLSACLFile = flag.String("tls.acl", "", "File of allow and deny rules for the source addresses of the TLS connections (reloaded on SIGHUP)")
+	TLSProxy   = flag.String("tls.proxy", "", "Comma-separated prefixes of the trusted proxies sending a PROXY protocol header on the TLS listener")
+
+	BindSSH    = flag.String("ssh.bind", "", "Bind address for SSH")
+	SSHKey     = flag.String("ssh.key", "private.pem", "SSH host keys (comma-separated, eg: an ed25519 and an RSA key)")
+	SSHACLFile = flag.String("ssh.acl", "", "File of allow and deny rules for the source addresses of the SSH connections (reloaded on SIGHUP)")
+	SSHProxy   = flag.String("ssh.proxy", "", "Comma-separated prefixes of the trusted proxies sending a PROXY protocol header on the SSH listener")
 
 	SSHAuthEnablePassword = flag.Bool("ssh.method.password", false, "Enable password auth")
 	SSHAuthUser           = flag.String("ssh.auth.user", "rpki", "SSH user")
 	SSHAuthPassword       = flag.String("ssh.auth.password", "", fmt.Sprintf("SSH password (if blank, will use envvar %v)", ENV_SSH_PASSWORD))
+	SSHAuthPasswordFile   = flag.String("ssh.auth.password.file", "", "File of user:bcrypt-hash lines, replacing -ssh.auth.user and -ssh.auth.password (reloaded on SIGHUP)")
 
 	SSHAuthEnableKey  = flag.Bool("ssh.method.key", false, "Enable key auth")
 	SSHAuthKeysBypass = flag.Bool("ssh.auth.key.bypass", false, "Accept any SSH key")
-	SSHAuthKeysList   = flag.String("ssh.auth.key.file", "", fmt.Sprintf("Authorized SSH key file (if blank, will use envvar %v", ENV_SSH_KEY))
+	SSHAuthKeysList   = flag.String("ssh.auth.key.file", "", fmt.Sprintf("Authorized SSH key file for any user (if blank, will use envvar %v, reloaded on SIGHUP)", ENV_SSH_KEY))
+	SSHAuthKeysDir    = flag.String("ssh.auth.key.dir", "", "Directory of authorized SSH key files named after the users (reloaded on SIGHUP)")
+	SSHAuthCA         = flag.String("ssh.auth.ca", "", "File of the CA keys trusted to sign user certificates (reloaded on SIGHUP)")
 
 	TimeCheck = flag.Bool("checktime", true, "Check if JSON file isn't stale (disable by passing -checktime=false)")
 
@@ -91,8 +147,11 @@ var (
 	Mime            = flag.String("mime", "application/json", "Accept setting format (some servers may prefer text/json)")
 	RefreshInterval = flag.Int("refresh", 600, "Refresh interval in seconds")
 	MaxConn         = flag.Int("maxconn", 0, "Max simultaneous connections (0 to disable limit)")
+	MaxConnListener = flag.Int("maxconn.listener", 0, "Max simultaneous connections on each listener (0 to disable limit)")
+	MaxConnIP       = flag.Int("maxconn.ip", 0, "Max simultaneous connections from each IP address (0 to disable limit)")
 
 	Slurm        = flag.String("slurm", "", "Slurm configuration file (filters and assertions)")
+	ViewsFile    = flag.String("views", "", "Views configuration file (data served to some routers)")
 	SlurmRefresh = flag.Bool("slurm.refresh", true, "Refresh along the cache (disable with -slurm.refresh=false)")
 
 	LogLevel   = flag.String("loglevel", "info", "Log level")
@@ -104,6 +163,7 @@ var (
 	protoverToLib = map[int]uint8{
 		0: rtr.PROTOCOL_VERSION_0,
 		1: rtr.PROTOCOL_VERSION_1,
+		2: rtr.PROTOCOL_VERSION_2,
 	}
 )
 
@@ -146,9 +206,10 @@ func isValidPrefixLength(prefix netip.Prefix, maxLength uint8) bool {
 // 1 - The prefix is a valid prefix
 // 2 - The ASN is a valid ASN
 // 3 - The MaxLength is valid
-// Will return a deduped slice, as well as total VRPs, IPv4 VRPs, IPv6 VRPs and BGPsec Keys
+// Will return a deduped slice, as well as total VRPs, IPv4 VRPs, IPv6 VRPs, BGPsec Keys and ASPAs
 func processData(vrplistjson []prefixfile.VRPJson,
-	brklistjson []prefixfile.BgpSecKeyJson) /*Export*/ ([]rtr.VRP, []rtr.BgpsecKey, int, int) {
+	brklistjson []prefixfile.BgpSecKeyJson,
+	vaplistjson []prefixfile.VAPJson) /*Export*/ ([]rtr.VRP, []rtr.BgpsecKey, []rtr.VAP, int, int) {
 	filterDuplicates := make(map[string]struct{})
 
 	// It may be tempting to change this to a simple time.Since() but that will
@@ -159,6 +220,7 @@ func processData(vrplistjson []prefixfile.VRPJson,
 
 	var vrplist []rtr.VRP
 	var brklist = make([]rtr.BgpsecKey, 0)
+	var vaplist = make([]rtr.VAP, 0)
 	var countv4 int
 	var countv6 int
 
@@ -259,7 +321,33 @@ func processData(vrplistjson []prefixfile.VRPJson,
 		})
 	}
 
-	return vrplist, brklist, countv4, countv6
+	seenCustomers := make(map[uint32]struct{})
+	for _, v := range vaplistjson {
+		if v.Expires != nil {
+			if NowUnix > *v.Expires {
+				continue
+			}
+		}
+
+		// There can only be one ASPA per customer ASN
+		if _, exists := seenCustomers[v.CustomerAsid]; exists {
+			log.Warnf("Duplicate ASPA for customer AS%d, ignoring", v.CustomerAsid)
+			continue
+		}
+		seenCustomers[v.CustomerAsid] = struct{}{}
+
+		// Providers are sent in ascending order (draft-ietf-sidrops-8210bis)
+		providers := slices.Clone(v.Providers)
+		slices.Sort(providers)
+		providers = slices.Compact(providers)
+
+		vaplist = append(vaplist, rtr.VAP{
+			CustomerASN: v.CustomerAsid,
+			Providers:   providers,
+		})
+	}
+
+	return vrplist, brklist, vaplist, countv4, countv6
 }
 
 type IdenticalFile struct {
@@ -282,6 +370,10 @@ func (s *state) updateFromNewState() error {
 	if bgpsecjson == nil {
 		bgpsecjson = make([]prefixfile.BgpSecKeyJson, 0)
 	}
+	aspajson := s.lastdata.ASPA
+	if aspajson == nil {
+		aspajson = make([]prefixfile.VAPJson, 0)
+	}
 
 	buildtime, err := time.Parse(time.RFC3339, s.lastdata.Metadata.Buildtime)
 	if s.lastdata.Metadata.GeneratedUnix != nil {
@@ -302,11 +394,11 @@ func (s *state) updateFromNewState() error {
 		vrpsjson, bgpsecjson = s.slurm.FilterAssert(vrpsjson, bgpsecjson, log.StandardLogger())
 	}
 
-	vrps, brks, countv4, countv6 := processData(vrpsjson, bgpsecjson)
-	count := len(vrps) + len(brks)
+	vrps, brks, vaps, countv4, countv6 := processData(vrpsjson, bgpsecjson, aspajson)
+	count := len(vrps) + len(brks) + len(vaps)
 
-	log.Infof("New update (%v uniques, %v total prefixes, %v router keys).", len(vrps), count, len(brks))
-	return s.applyUpdateFromNewState(vrps, brks, vrpsjson, bgpsecjson, countv4, countv6)
+	log.Infof("New update (%v uniques, %v total prefixes, %v router keys, %v aspas).", len(vrps), count, len(brks), len(vaps))
+	return s.applyUpdateFromNewState(vrps, brks, vaps, vrpsjson, bgpsecjson, aspajson, countv4, countv6)
 }
 
 // Update the state based on the currently loaded files
@@ -319,6 +411,10 @@ func (s *state) reloadFromCurrentState() error {
 	if bgpsecjson == nil {
 		bgpsecjson = make([]prefixfile.BgpSecKeyJson, 0)
 	}
+	aspajson := s.lastdata.ASPA
+	if aspajson == nil {
+		aspajson = make([]prefixfile.VAPJson, 0)
+	}
 
 	buildtime, err := time.Parse(time.RFC3339, s.lastdata.Metadata.Buildtime)
 	if s.lastdata.Metadata.GeneratedUnix != nil {
@@ -339,31 +435,40 @@ func (s *state) reloadFromCurrentState() error {
 		vrpsjson, bgpsecjson = s.slurm.FilterAssert(vrpsjson, bgpsecjson, log.StandardLogger())
 	}
 
-	vrps, brks, countv4, countv6 := processData(vrpsjson, bgpsecjson)
-	count := len(vrps) + len(brks)
+	vrps, brks, vaps, countv4, countv6 := processData(vrpsjson, bgpsecjson, aspajson)
+	count := len(vrps) + len(brks) + len(vaps)
 	if s.server.CountSDs() != count {
 		log.Infof("New update to old state (%v uniques, %v total prefixes). (old %v - new %v)", len(vrps), count, s.server.CountSDs(), count)
-		return s.applyUpdateFromNewState(vrps, brks, vrpsjson, bgpsecjson, countv4, countv6)
+		return s.applyUpdateFromNewState(vrps, brks, vaps, vrpsjson, bgpsecjson, aspajson, countv4, countv6)
 	}
 	return nil
 }
 
-func (s *state) applyUpdateFromNewState(vrps []rtr.VRP, brks []rtr.BgpsecKey,
-	vrpsjson []prefixfile.VRPJson, brksjson []prefixfile.BgpSecKeyJson,
+func (s *state) applyUpdateFromNewState(vrps []rtr.VRP, brks []rtr.BgpsecKey, vaps []rtr.VAP,
+	vrpsjson []prefixfile.VRPJson, brksjson []prefixfile.BgpSecKeyJson, vapsjson []prefixfile.VAPJson,
 	countv4 int, countv6 int) error {
 
-	SDs := make([]rtr.SendableData, 0, len(vrps)+len(brks))
-	for _, v := range vrps {
-		SDs = append(SDs, v.Copy())
-	}
-	for _, v := range brks {
-		SDs = append(SDs, v.Copy())
+	buildtime, err := time.Parse(time.RFC3339, s.lastdata.Metadata.Buildtime)
+	if s.lastdata.Metadata.GeneratedUnix != nil {
+		buildtime, err = time.Unix(*s.lastdata.Metadata.GeneratedUnix, 0), nil
 	}
-	if !s.server.AddData(SDs) {
+	updated := s.addData(s.server, sendableData(vrps, brks, vaps), buildtime, err == nil)
+	// The views are updated even without changes to the data of the server,
+	// to fill them after restoring the state.
+	viewsUpdated := s.updateViews(vrpsjson, brksjson, vapsjson, buildtime, err == nil)
+	if !updated {
 		log.Info("No difference to current cache")
+		if viewsUpdated && s.sendNotifs {
+			s.server.NotifyClientsLatest()
+		}
 		return nil
 	}
 
+	if err == nil {
+		s.setDataBuildTime(buildtime)
+	}
+	s.saveState()
+
 	serial, _ := s.server.GetCurrentSerial()
 	log.Infof("Update added, new serial %v", serial)
 	if s.sendNotifs {
@@ -375,11 +480,13 @@ func (s *state) applyUpdateFromNewState(vrps []rtr.VRP, brks []rtr.BgpsecKey,
 	s.lockJson.Lock()
 	s.exported = prefixfile.RPKIList{
 		Metadata: prefixfile.MetaData{
-			Counts:    len(vrpsjson),
-			Buildtime: s.lastdata.Metadata.Buildtime,
+			Counts:     len(vrpsjson),
+			CountASPAs: len(vapsjson),
+			Buildtime:  s.lastdata.Metadata.Buildtime,
 		},
 		ROA:        vrpsjson,
 		BgpSecKeys: brksjson,
+		ASPA:       vapsjson,
 	}
 	s.lockJson.Unlock()
 
@@ -393,12 +500,85 @@ func (s *state) applyUpdateFromNewState(vrps []rtr.VRP, brks []rtr.BgpsecKey,
 				countv6_dup++
 			}
 		}
-		s.metricsEvent.UpdateMetrics(countv4, countv6, countv4_dup, countv6_dup, s.lastchange, s.lastts, *CacheBin, len(brks))
+		s.metricsEvent.UpdateMetrics(countv4, countv6, countv4_dup, countv6_dup, s.lastchange, s.lastts, *CacheBin, len(brks), len(vaps))
 	}
 
 	return nil
 }
 
+func sendableData(vrps []rtr.VRP, brks []rtr.BgpsecKey, vaps []rtr.VAP) []rtr.SendableData {
+	SDs := make([]rtr.SendableData, 0, len(vrps)+len(brks)+len(vaps))
+	for _, v := range vrps {
+		SDs = append(SDs, v.Copy())
+	}
+	for _, v := range brks {
+		SDs = append(SDs, v.Copy())
+	}
+	for _, v := range vaps {
+		SDs = append(SDs, v.Copy())
+	}
+	return SDs
+}
+
+// addData replaces the data of the server, or of a view. It returns whether
+// the data changed.
+func (s *state) addData(server *rtr.Server, SDs []rtr.SendableData, buildtime time.Time, hasBuildTime bool) bool {
+	if s.serialFromBuildTime && hasBuildTime {
+		updated, err := server.AddDataSerial(SDs, uint32(buildtime.Unix()))
+		if err != nil {
+			// The change (eg: from the SLURM) is applied with the next
+			// generation of the data
+			log.Warnf("Data changed without a new generation time (%v), not applying it until the next one: %v", buildtime, err)
+		}
+		return updated
+	}
+	return server.AddData(SDs)
+}
+
+// updateViews replaces the data of the views from the data of the server.
+// It returns whether the data of a view changed.
+func (s *state) updateViews(vrpsjson []prefixfile.VRPJson, brksjson []prefixfile.BgpSecKeyJson, vapsjson []prefixfile.VAPJson,
+	buildtime time.Time, hasBuildTime bool) bool {
+
+	var updated bool
+	for _, dv := range s.views {
+		viewvrps, viewbrks, viewvaps := dv.filter(vrpsjson, brksjson, vapsjson)
+		vrps, brks, vaps, _, _ := processData(viewvrps, viewbrks, viewvaps)
+		if s.addData(dv.server, sendableData(vrps, brks, vaps), buildtime, hasBuildTime) {
+			serial, _ := dv.server.GetCurrentSerial()
+			log.Infof("View %s updated (%d objects), new serial %v", dv.view.Name, dv.server.CountSDs(), serial)
+			updated = true
+		}
+	}
+	return updated
+}
+
+// updateViewsSlurm reloads the SLURM files of the views. It returns whether
+// one of them changed.
+func (s *state) updateViewsSlurm() bool {
+	var updated bool
+	for _, dv := range s.views {
+		changed, err := dv.loadSlurm()
+		if err != nil {
+			log.Errorf("Slurm of view %s: %v", dv.view.Name, err)
+			continue
+		}
+		if changed {
+			log.Infof("Slurm of view %s changed", dv.view.Name)
+			updated = true
+		}
+	}
+	return updated
+}
+
+// clearData empties the data of the server and of the views.
+func (s *state) clearData() {
+	s.server.AddData([]rtr.SendableData{})
+	for _, dv := range s.views {
+		dv.server.AddData([]rtr.SendableData{})
+	}
+}
+
 func (s *state) updateFile(file string) (bool, error) {
 	log.Debugf("Refreshing cache from %s", file)
 
@@ -483,15 +663,136 @@ func (s *state) errRPKIJsonFileTooOldHandler() {
 	buildTime := s.exported.Metadata.GetBuildTime()
 	if !buildTime.IsZero() && time.Since(buildTime) > time.Hour*24 {
 		log.Errorf("Data is stale, clearing it all.")
-		s.server.AddData([]rtr.SendableData{}) // empty the store of sendable stuff, triggering a emptying of the RTR server
+		s.clearData() // empty the store of sendable stuff, triggering a emptying of the RTR server
+		s.setDataBuildTime(time.Time{})
+		s.saveState()
+	}
+}
+
+// The data restored from the saved state is cleared when it gets stale
+// before it could be refreshed.
+func (s *state) checkRestoredData() {
+	if !s.checktime || s.lastdata.ROA != nil || s.dataBuildTime.IsZero() {
+		return
+	}
+	if time.Since(s.dataBuildTime) > time.Hour*24 {
+		log.Errorf("Restored data is stale, clearing it all.")
+		s.clearData()
+		s.setDataBuildTime(time.Time{})
+		s.saveState()
+	}
+}
+
+// stateMetadata is saved along with the state of the server
+type stateMetadata struct {
+	BuildTime time.Time `json:"buildtime"`
+}
+
+func (s *state) setDataBuildTime(buildTime time.Time) {
+	s.stateLock.Lock()
+	s.dataBuildTime = buildTime
+	s.stateLock.Unlock()
+}
+
+func (s *state) saveState() {
+	if s.stateFile == "" {
+		return
+	}
+	// Saves are serialized so that an older state never replaces a newer one
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	st := s.server.State()
+	md, err := json.Marshal(stateMetadata{BuildTime: s.dataBuildTime})
+	if err != nil {
+		log.Errorf("Could not save state: %v", err)
+		return
+	}
+	st.Metadata = md
+	if err := st.WriteFile(s.stateFile); err != nil {
+		log.Errorf("Could not save state: %v", err)
+		return
+	}
+	log.Debugf("Saved state to %s (serial %d, %d objects)", s.stateFile, st.Serial(), st.Count())
+
+	for _, dv := range s.views {
+		st := dv.server.State()
+		if err := st.WriteFile(s.viewStateFile(dv)); err != nil {
+			log.Errorf("Could not save state of view %s: %v", dv.view.Name, err)
+			continue
+		}
+		log.Debugf("Saved state of view %s (serial %d, %d objects)", dv.view.Name, st.Serial(), st.Count())
+	}
+}
+
+// viewStateFile is the file of the state of a view, next to the one of the
+// server.
+func (s *state) viewStateFile(dv *dataView) string {
+	return s.stateFile + ".view." + url.PathEscape(dv.view.Name)
+}
+
+// restoreState loads the saved state in the server, unless it is stale.
+func (s *state) restoreState() bool {
+	st, err := rtr.ReadStateFile(s.stateFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warnf("Could not restore state: %v", err)
+		}
+		return false
+	}
+	if st.Count() == 0 {
+		return false
 	}
+	var md stateMetadata
+	if err := json.Unmarshal(st.Metadata, &md); err != nil {
+		log.Warnf("Could not restore state: %v", err)
+		return false
+	}
+	if s.checktime && time.Since(md.BuildTime) > time.Hour*24 {
+		log.Warnf("Not restoring state saved at %v: data is older than 24 hours (%v)", st.Saved, md.BuildTime)
+		return false
+	}
+
+	s.server.RestoreState(st)
+	s.setDataBuildTime(md.BuildTime)
+	log.Infof("Restored state saved at %v (serial %d, %d objects)", st.Saved, st.Serial(), st.Count())
+	server_metrics.CurrentSerial.Set(float64(st.Serial()))
+
+	// A view without a state is filled by the first update
+	for _, dv := range s.views {
+		st, err := rtr.ReadStateFile(s.viewStateFile(dv))
+		if err != nil {
+			log.Warnf("Could not restore state of view %s: %v", dv.view.Name, err)
+			continue
+		}
+		dv.server.RestoreState(st)
+		log.Infof("Restored state of view %s (serial %d, %d objects)", dv.view.Name, st.Serial(), st.Count())
+	}
+	return true
 }
 
-func (s *state) routineUpdate(file string, interval int, slurmFile string) {
+// loadACLs sets the ACLs of the listeners from their files. The ACL of a file
+// that cannot be read is left unchanged.
+func (s *state) loadACLs() error {
+	var errs []error
+	for transport, path := range s.aclFiles {
+		acl, err := rtr.ReadACLFile(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v ACL: %w", transport, err))
+			continue
+		}
+		s.server.SetACL(transport, acl)
+		log.Infof("Loaded %v ACL from %s (%d rules)", transport, path, len(acl.Rules))
+	}
+	return errors.Join(errs...)
+}
+
+func (s *state) routineUpdate(ctx context.Context, file string, interval int, slurmFile string) {
 	log.Debugf("Starting refresh routine (file: %v, interval: %vs, slurm: %v)", file, interval, slurmFile)
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
 	delay := time.NewTicker(time.Duration(interval) * time.Second)
+	defer delay.Stop()
 	initialSyncNotComplete := false
 	for {
 		if s.lastchange.IsZero() {
@@ -504,14 +805,37 @@ func (s *state) routineUpdate(file string, interval int, slurmFile string) {
 			}
 		}
 		select {
+		case <-ctx.Done():
+			return
 		case <-delay.C:
 		case <-signals:
 			log.Debug("Received HUP signal")
+			if err := s.loadACLs(); err != nil {
+				log.Errorf("Could not reload ACLs: %v", err)
+			}
+			if s.sshAuth != nil {
+				if err := s.sshAuth.load(); err != nil {
+					log.Errorf("Could not reload SSH credentials: %v", err)
+				}
+			}
+			if s.tlsFiles != nil {
+				if err := s.tlsFiles.reload(); err != nil {
+					log.Errorf("Could not reload TLS certificates: %v", err)
+				} else {
+					log.Info("Reloaded TLS certificates")
+				}
+			}
+			if s.apiToken != nil {
+				if err := s.apiToken.load(); err != nil {
+					log.Errorf("Could not reload the API token: %v", err)
+				}
+			}
 			s.updateDelay(delay, interval)
 		case <-s.triggerUpdate:
 			log.Debug("Received triggered update")
 			s.updateDelay(delay, interval)
 		}
+		s.updateStarted.Store(time.Now().UnixNano())
 		slurmNotPresentOrUpdated := false
 
 		updateFileWG := sync.WaitGroup{}
@@ -554,6 +878,9 @@ func (s *state) routineUpdate(file string, interval int, slurmFile string) {
 		}()
 
 		updateFileWG.Wait()
+		if s.updateViewsSlurm() {
+			slurmNotPresentOrUpdated = true
+		}
 
 		// Only process the first time after there is either a cache or SLURM
 		// update.
@@ -574,9 +901,18 @@ func (s *state) routineUpdate(file string, interval int, slurmFile string) {
 				}
 			}
 		}
+		s.checkRestoredData()
+		s.updateStarted.Store(0)
 	}
 }
 
+// alive tells whether the update routine is waiting for the next update or
+// has been running the current one for less than maxUpdate.
+func (s *state) alive(maxUpdate time.Duration) bool {
+	started := s.updateStarted.Load()
+	return started == 0 || time.Since(time.Unix(0, started)) < maxUpdate
+}
+
 func (s *state) exporter(wr http.ResponseWriter, r *http.Request) {
 	s.lockJson.RLock()
 	toExport := s.exported
@@ -602,6 +938,20 @@ func (s *state) updateNow(wr http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(wr).Encode(response)
 }
 
+func (s *state) rotateSession(wr http.ResponseWriter, r *http.Request) {
+	for _, dv := range s.views {
+		dv.server.RotateSession()
+	}
+	s.server.RotateSession()
+	s.saveState()
+
+	wr.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(wr).Encode(map[string]interface{}{
+		"status":  "success",
+		"message": "Session rotated",
+	})
+}
+
 func (s *state) TriggerUpdate() bool {
 	select {
 	case s.triggerUpdate <- struct{}{}:
@@ -632,9 +982,33 @@ type state struct {
 
 	slurm *prefixfile.SlurmConfig
 
+	// Data served to some routers instead of the one of the server
+	views []*dataView
+
 	checktime bool
 
+	// The serial is the build time of the data, so that caches fetching the
+	// same data present the same serial
+	serialFromBuildTime bool
+
 	triggerUpdate chan struct{}
+	// Start of the update in progress (Unix nanoseconds), 0 while waiting for
+	// the next one
+	updateStarted atomic.Int64
+
+	// Files of the ACLs of the listeners
+	aclFiles map[rtr.Transport]string
+	// Certificates of the TLS listener
+	tlsFiles *tlsFiles
+	// Credentials of the routers connecting over SSH
+	sshAuth *sshAuth
+	// Token required by the HTTP API
+	apiToken *apiToken
+
+	// Saved state of the server, and the build time of the data served
+	stateFile     string
+	stateLock     *sync.Mutex
+	dataBuildTime time.Time
 }
 
 type metricsEvent struct {
@@ -648,6 +1022,18 @@ func (m *metricsEvent) ClientDisconnected(c *rtr.Client) {
 	server_metrics.ClientsMetric.WithLabelValues(c.GetLocalAddress().String()).Dec()
 }
 
+func (m *metricsEvent) ClientSlow(c *rtr.Client, disconnected bool) {
+	if disconnected {
+		server_metrics.SlowClients.WithLabelValues("disconnect").Inc()
+	} else {
+		server_metrics.SlowClients.WithLabelValues("drop_notify").Inc()
+	}
+}
+
+func (m *metricsEvent) ConnectionRejected(conn net.Conn, transport rtr.Transport, reason rtr.RejectReason) {
+	server_metrics.RejectedConnections.WithLabelValues(transport.String(), string(reason)).Inc()
+}
+
 func (m *metricsEvent) HandlePDU(c *rtr.Client, pdu rtr.PDU) {
 	server_metrics.PDUsRecv.WithLabelValues(
 		strings.ToLower(
@@ -656,10 +1042,24 @@ func (m *metricsEvent) HandlePDU(c *rtr.Client, pdu rtr.PDU) {
 					pdu.GetType()),
 				" ",
 				"_", -1))).Inc()
+	if report, ok := pdu.(*rtr.PDUErrorReport); ok {
+		server_metrics.ErrorReports.WithLabelValues(errorCodeLabel(report.ErrorCode)).Inc()
+	}
 }
 
-func (m *metricsEvent) UpdateMetrics(numIPv4 int, numIPv6 int, numIPv4filtered int, numIPv6filtered int, changed time.Time, refreshed time.Time, file string, brkCount int) {
+// errorCodeLabel returns the label of an error code in the metrics. The
+// undefined codes share one, so that routers cannot create any number of
+// series.
+func errorCodeLabel(code uint16) string {
+	if code > rtr.PDU_ERROR_UNEXPECTEDPROTO {
+		return "unknown"
+	}
+	return strings.ToLower(strings.ReplaceAll(rtr.ErrorCodeToString(code), " ", "_"))
+}
+
+func (m *metricsEvent) UpdateMetrics(numIPv4 int, numIPv6 int, numIPv4filtered int, numIPv6filtered int, changed time.Time, refreshed time.Time, file string, brkCount int, vapCount int) {
 	server_metrics.NumberOfObjects.WithLabelValues("bgpsec_pubkeys").Set(float64(brkCount))
+	server_metrics.NumberOfObjects.WithLabelValues("aspas").Set(float64(vapCount))
 	server_metrics.NumberOfObjects.WithLabelValues("vrps").Set(float64(numIPv4 + numIPv6))
 	server_metrics.NumberOfObjects.WithLabelValues("effective_vrps").Set(float64(numIPv4filtered + numIPv6filtered))
 
@@ -670,8 +1070,24 @@ func (m *metricsEvent) UpdateMetrics(numIPv4 int, numIPv6 int, numIPv4filtered i
 	server_metrics.LastChange.WithLabelValues(file).Set(float64(changed.UnixNano() / 1e9))
 }
 
+// parseSessionIDs parses a list of session IDs separated by commas.
+func parseSessionIDs(list string) ([]uint16, error) {
+	if list == "" {
+		return nil, nil
+	}
+	var ids []uint16
+	for _, id := range strings.Split(list, ",") {
+		n, err := strconv.ParseUint(strings.TrimSpace(id), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid session ID %q: %w", id, err)
+		}
+		ids = append(ids, uint16(n))
+	}
+	return ids, nil
+}
+
 func main() {
-	err := ossec.PledgePromises("dns inet rpath stdio tty")
+	err := ossec.PledgePromises("cpath dns fattr inet rpath stdio tty unix wpath")
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "pledge failed: %v\n", err)
 		os.Exit(1)
@@ -694,6 +1110,29 @@ func run() error {
 		os.Exit(0)
 	}
 
+	if *SerialMode != serialIncrement && *SerialMode != serialGenerated {
+		log.Fatalf("Serial must be %s or %s", serialIncrement, serialGenerated)
+	}
+	var slowPolicy rtr.SlowClientPolicy
+	switch *SlowPolicy {
+	case rtr.SlowClientDisconnect.String():
+		slowPolicy = rtr.SlowClientDisconnect
+	case rtr.SlowClientDropNotify.String():
+		slowPolicy = rtr.SlowClientDropNotify
+	default:
+		log.Fatalf("Slow client policy must be %v or %v", rtr.SlowClientDisconnect, rtr.SlowClientDropNotify)
+	}
+	if *SessionID > math.MaxUint16 || *SessionID < -1 {
+		log.Fatalf("Session ID must be between 0 and %d", math.MaxUint16)
+	}
+	sessIDs, err := parseSessionIDs(*SessionIDs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(sessIDs) > int(protoverToLib[*RTRVersion])+1 {
+		log.Fatalf("%d session IDs given for protocol version %d", len(sessIDs), *RTRVersion)
+	}
+
 	lvl, _ := log.ParseLevel(*LogLevel)
 	log.SetLevel(lvl)
 
@@ -702,10 +1141,13 @@ func run() error {
 	}
 
 	sc := rtr.ServerConfiguration{
-		ProtocolVersion: protoverToLib[*RTRVersion],
-		KeepDifference:  3,
-		Log:             log.StandardLogger(),
-		LogVerbose:      *LogVerbose,
+		ProtocolVersion:   protoverToLib[*RTRVersion],
+		SessId:            *SessionID,
+		SessIds:           sessIDs,
+		KeepDifference:    *DiffCount,
+		KeepDifferenceAge: *DiffAge,
+		Log:               log.StandardLogger(),
+		LogVerbose:        *LogVerbose,
 
 		RefreshInterval: uint32(*RefreshRTR),
 		RetryInterval:   uint32(*RetryRTR),
@@ -714,6 +1156,36 @@ func run() error {
 		EnforceVersion: *EnforceVersion,
 		DisableBGPSec:  *DisableBGPSec,
 		EnableNODELAY:  *EnableNODELAY,
+		NotifyShutdown: *ShutdownNotify,
+
+		ResetOnDataError: *ErrorReset,
+
+		MaxConn:            *MaxConn,
+		MaxConnPerListener: *MaxConnListener,
+		MaxConnPerIP:       *MaxConnIP,
+
+		WriteTimeout:     *WriteTimeout,
+		SendQueueSize:    *QueueSize,
+		SlowClientPolicy: slowPolicy,
+
+		IdleTimeout: *IdleTimeout,
+		KeepAlive: net.KeepAliveConfig{
+			Enable:   *KeepAlive,
+			Idle:     *KeepAliveIdle,
+			Interval: *KeepAliveInterval,
+			Count:    *KeepAliveCount,
+		},
+	}
+
+	var views []*dataView
+	if *ViewsFile != "" {
+		var err error
+		views, err = loadViews(*ViewsFile, sc)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sc.Views = viewSelector(views)
+		log.Infof("Loaded %d views from %s", len(views), *ViewsFile)
 	}
 
 	var me *metricsEvent
@@ -725,14 +1197,28 @@ func run() error {
 
 	server := rtr.NewServer(sc, me, deh)
 	deh.SetSDManager(server)
+	if me != nil {
+		server_metrics.RegisterSendQueues(func() []int {
+			clients := server.GetClientList()
+			sizes := make([]int, len(clients))
+			for i, c := range clients {
+				sizes[i] = c.QueuedBytes()
+			}
+			return sizes
+		})
+	}
 
 	s := state{
 		server:       server,
 		lastdata:     &prefixfile.RPKIList{},
 		metricsEvent: me,
+		views:        views,
 		sendNotifs:   *SendNotifs,
 		checktime:    *TimeCheck,
-		lockJson:     &sync.RWMutex{},
+
+		serialFromBuildTime: *SerialMode == serialGenerated,
+		lockJson:            &sync.RWMutex{},
+		stateLock:           &sync.Mutex{},
 
 		fetchConfig: utils.NewFetchConfig(),
 
@@ -750,27 +1236,100 @@ func run() error {
 	if enableHTTP {
 		mux := http.NewServeMux()
 		mux.Handle(*MetricsPath, promhttp.Handler())
-		mux.HandleFunc("GET /clients", server.GetClientRemoteAddrs)
+
+		mux.HandleFunc("GET /clients", server.GetClientsInfo)
+		mux.HandleFunc("GET /clients/errors", server.GetErrorReports)
+
+		// The /api endpoints require the token when it is set. Only
+		// /api/update, which predates it, can be used without one.
+		api := func(h http.HandlerFunc) http.HandlerFunc { return h }
+		if *APITokenFile != "" {
+			token, err := newAPIToken(*APITokenFile)
+			if err != nil {
+				log.Fatalf("Could not load the API token: %v", err)
+			}
+			s.apiToken = token
+			api = token.require
+		} else if *EnableRotateEndpoint || *EnableClientsAPI {
+			log.Fatal("-rotate.endpoint and -clients.endpoint require -api.token.file")
+		} else if *EnableUpdateEndpoint {
+			log.Warn("-update.endpoint without -api.token.file is deprecated, the endpoint will require a token in a future release")
+		}
 
 		if *ExportPath != "" {
 			mux.HandleFunc(*ExportPath, s.exporter)
 		}
 		if *EnableUpdateEndpoint {
-			mux.HandleFunc("/api/update", s.updateNow)
+			mux.HandleFunc("/api/update", api(s.updateNow))
+		}
+		if *EnableRotateEndpoint {
+			mux.HandleFunc("POST /api/rotate-session", api(s.rotateSession))
+		}
+		if *EnableClientsAPI {
+			mux.HandleFunc("POST /api/clients/{id}/{action}", api(s.clientAction))
 		}
 
 		go serveHTTP(mux)
 	}
 
-	if *Bind == "" && *BindTLS == "" && *BindSSH == "" {
+	s.aclFiles = make(map[rtr.Transport]string)
+	for transport, path := range map[rtr.Transport]string{
+		rtr.TransportTCP: *ACLFile,
+		rtr.TransportTLS: *TLSACLFile,
+		rtr.TransportSSH: *SSHACLFile,
+	} {
+		if path != "" {
+			s.aclFiles[transport] = path
+		}
+	}
+	if err := s.loadACLs(); err != nil {
+		log.Fatal(err)
+	}
+	for transport, trusted := range map[rtr.Transport]string{
+		rtr.TransportTCP: *Proxy,
+		rtr.TransportTLS: *TLSProxy,
+		rtr.TransportSSH: *SSHProxy,
+	} {
+		if trusted == "" {
+			continue
+		}
+		proxy := &rtr.ProxyProtocol{}
+		for _, p := range strings.Split(trusted, ",") {
+			prefix, err := parsePrefixOrAddr(strings.TrimSpace(p))
+			if err != nil {
+				log.Fatalf("Invalid trusted proxy %q: %v", p, err)
+			}
+			proxy.Trusted = append(proxy.Trusted, prefix)
+		}
+		server.SetProxyProtocol(transport, proxy)
+		log.Infof("Enabling the PROXY protocol on the %v listener for %v", transport, proxy.Trusted)
+	}
+
+	// Sockets passed by systemd replace the bind address of their transport
+	listeners, err := activationListeners()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *Bind == "" && *BindTLS == "" && *BindSSH == "" && len(listeners) == 0 {
 		log.Fatalf("Specify at least a bind address using -bind , -tls.bind , or -ssh.bind")
 	}
 
+	// With a restored state, the data is served right away and refreshed
+	// by the update routine.
+	var restored bool
+	if *StateDir != "" {
+		s.stateFile = filepath.Join(*StateDir, stateFileName)
+		restored = s.restoreState()
+	}
+
 	fileFetchWG := sync.WaitGroup{}
 	fileFetchWG.Add(2)
 
 	go func() {
 		defer fileFetchWG.Done()
+		if restored {
+			return
+		}
 		_, err := s.updateFile(*CacheBin)
 		if err != nil {
 			switch err.(type) {
@@ -810,125 +1369,154 @@ func run() error {
 	fileFetchWG.Wait()
 
 	// Initial calculation of state (after fetching cache + slurm)
-	err := s.updateFromNewState()
+	err = s.updateFromNewState()
 	if err != nil {
 		log.Warnf("Error setting up initial state: %s", err)
 	}
 
-	if *Bind != "" {
-		go func() {
-			sessid := server.GetSessionId(protoverToLib[*RTRVersion])
-			log.Infof("StayRTR Server started (sessionID:%d, refresh:%d, retry:%d, expire:%d)", sessid, sc.RefreshInterval, sc.RetryInterval, sc.ExpireInterval)
-			log.Infof("StayRTR Server v%s binding to %s", rtr.APP_VERSION, *Bind)
-			err := server.Start(*Bind)
-			if err != nil {
+	var sigs rtr.TCPSignatures
+	if *TCPKeys != "" {
+		sigs, err = rtr.ReadTCPSignaturesFile(*TCPKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Loaded %d TCP-MD5 and TCP-AO keys from %s", len(sigs), *TCPKeys)
+		// The activated sockets are already listening
+		for _, l := range listeners[rtr.TransportTCP] {
+			if err := sigs.SetListener(l); err != nil {
 				log.Fatal(err)
 			}
-		}()
+		}
+	}
+	if listeners == nil {
+		listeners = make(map[rtr.Transport][]net.Listener)
+	}
+	binds := map[rtr.Transport]string{
+		rtr.TransportTCP: *Bind,
+		rtr.TransportTLS: *BindTLS,
+		rtr.TransportSSH: *BindSSH,
 	}
-	if *BindTLS != "" {
-		cert, err := tls.LoadX509KeyPair(*TLSCert, *TLSKey)
+	for transport, bind := range binds {
+		if bind == "" || len(listeners[transport]) > 0 {
+			continue
+		}
+		var transportSigs rtr.TCPSignatures
+		if transport == rtr.TransportTCP {
+			transportSigs = sigs
+		}
+		l, err := listen(bind, os.FileMode(*UnixMode), transportSigs)
 		if err != nil {
 			log.Fatal(err)
 		}
-		tlsConfig := tls.Config{
-			Certificates: []tls.Certificate{cert},
-		}
-		go func() {
-			err := server.StartTLS(*BindTLS, &tlsConfig)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}()
+		listeners[transport] = []net.Listener{l}
 	}
-	if *BindSSH != "" {
-		sshkey, err := os.ReadFile(*SSHKey)
+
+	if len(listeners[rtr.TransportTLS]) > 0 {
+		// The files are reloaded on SIGHUP and when they change
+		s.tlsFiles, err = newTLSFiles(*TLSCert, *TLSKey, *TLSCA)
 		if err != nil {
 			log.Fatal(err)
 		}
-		private, err := ssh.ParsePrivateKey(sshkey)
+		// The handshake follows the PROXY protocol header, if any
+		server.SetTLSConfig(s.tlsFiles.Config())
+	}
+	if len(listeners[rtr.TransportSSH]) > 0 {
+		hostKeys, err := loadHostKeys(*SSHKey)
 		if err != nil {
-			log.Fatal("Failed to parse SSH private key: ", err)
+			log.Fatal(err)
 		}
 
 		sshConfig := ssh.ServerConfig{}
+		for _, key := range hostKeys {
+			sshConfig.AddHostKey(key)
+		}
 
 		log.Infof("Enabling ssh with the following authentications: password=%v, key=%v", *SSHAuthEnablePassword, *SSHAuthEnableKey)
+		s.sshAuth = &sshAuth{
+			user:         *SSHAuthUser,
+			password:     *SSHAuthPassword,
+			passwordFile: *SSHAuthPasswordFile,
+			keyFile:      *SSHAuthKeysList,
+			keyDir:       *SSHAuthKeysDir,
+			caFile:       *SSHAuthCA,
+			bypassKeys:   *SSHAuthKeysBypass,
+		}
+		if s.sshAuth.password == "" {
+			s.sshAuth.password = os.Getenv(ENV_SSH_PASSWORD)
+		}
+		if s.sshAuth.keyFile == "" {
+			s.sshAuth.keys = os.Getenv(ENV_SSH_KEY)
+		}
+		if err := s.sshAuth.load(); err != nil {
+			log.Fatal(err)
+		}
 		if *SSHAuthEnablePassword {
-			password := *SSHAuthPassword
-			if password == "" {
-				password = os.Getenv(ENV_SSH_PASSWORD)
-			}
-			sshConfig.PasswordCallback = func(conn ssh.ConnMetadata, suppliedPassword []byte) (*ssh.Permissions, error) {
-				log.Infof("Connected (ssh-password): %v/%v", conn.User(), conn.RemoteAddr())
-				if conn.User() != *SSHAuthUser || !bytes.Equal(suppliedPassword, []byte(password)) {
-					log.Warnf("Wrong user or password for %v/%v. Disconnecting.", conn.User(), conn.RemoteAddr())
-					return nil, errors.New("wrong user or password")
-				}
-
-				return &ssh.Permissions{
-					CriticalOptions: make(map[string]string),
-					Extensions:      make(map[string]string),
-				}, nil
-			}
+			sshConfig.PasswordCallback = s.sshAuth.passwordCallback
 		}
 		if *SSHAuthEnableKey {
-			var sshClientKeysToDecode string
-			if *SSHAuthKeysList == "" {
-				sshClientKeysToDecode = os.Getenv(ENV_SSH_KEY)
-			} else {
-				sshClientKeysToDecodeBytes, err := os.ReadFile(*SSHAuthKeysList)
-				if err != nil {
-					log.Fatal(err)
-				}
-				sshClientKeysToDecode = string(sshClientKeysToDecodeBytes)
-			}
-			sshClientKeys := strings.Split(sshClientKeysToDecode, "\n")
-
-			sshConfig.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-				keyBase64 := base64.RawStdEncoding.EncodeToString(key.Marshal())
-				if !*SSHAuthKeysBypass {
-					var noKeys bool
-					for i, k := range sshClientKeys {
-						if k == "" {
-							continue
-						}
-						if strings.HasPrefix(k, fmt.Sprintf("%v %v", key.Type(), keyBase64)) {
-							log.Infof("Connected (ssh-key): %v/%v with key %v %v (matched with line %v)",
-								conn.User(), conn.RemoteAddr(), key.Type(), keyBase64, i+1)
-							noKeys = true
-							break
-						}
-					}
-					if !noKeys {
-						log.Warnf("No key for %v/%v %v %v. Disconnecting.", conn.User(), conn.RemoteAddr(), key.Type(), keyBase64)
-						return nil, errors.New("provided ssh key not found")
-					}
-				} else {
-					log.Infof("Connected (ssh-key): %v/%v with key %v %v", conn.User(), conn.RemoteAddr(), key.Type(), keyBase64)
-				}
-
-				return &ssh.Permissions{
-					CriticalOptions: make(map[string]string),
-					Extensions:      make(map[string]string),
-				}, nil
-			}
+			sshConfig.PublicKeyCallback = s.sshAuth.publicKeyCallback
 		}
-
 		if !(*SSHAuthEnableKey || *SSHAuthEnablePassword) {
 			sshConfig.NoClientAuth = true
 		}
+		server.SetSSHConfig(&sshConfig)
+	}
 
-		sshConfig.AddHostKey(private)
+	sessid := server.GetSessionId(protoverToLib[*RTRVersion])
+	log.Infof("StayRTR Server started (sessionID:%d, refresh:%d, retry:%d, expire:%d)", sessid, sc.RefreshInterval, sc.RetryInterval, sc.ExpireInterval)
+	for transport, ls := range listeners {
+		for _, l := range ls {
+			log.Infof("StayRTR Server v%s serving %v on %s", rtr.APP_VERSION, transport, l.Addr())
+			go func() {
+				err := server.Serve(l, transport)
+				if err != nil && !errors.Is(err, rtr.ErrServerClosed) {
+					log.Fatal(err)
+				}
+			}()
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if s.tlsFiles != nil {
+		go s.tlsFiles.watch(ctx, tlsReloadInterval)
+	}
+
+	if err := sdNotify("READY=1"); err != nil {
+		log.Warnf("Could not notify systemd: %v", err)
+	}
+	if interval := sdWatchdogInterval(); interval > 0 {
 		go func() {
-			err := server.StartSSH(*BindSSH, &sshConfig)
-			if err != nil {
-				log.Fatal(err)
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if s.alive(updateStuckTimeout) {
+						sdNotify("WATCHDOG=1")
+					} else {
+						log.Errorf("Update stuck for more than %v, not notifying the watchdog", updateStuckTimeout)
+					}
+				}
 			}
 		}()
 	}
 
-	s.routineUpdate(*CacheBin, *RefreshInterval, slurmFile)
-
+	if restored {
+		s.TriggerUpdate()
+	}
+	s.routineUpdate(ctx, *CacheBin, *RefreshInterval, slurmFile)
+	sdNotify("STOPPING=1")
+	s.saveState()
+
+	log.Infof("Shutting down, waiting up to %v for clients to disconnect", *ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("shutdown: %w", err)
+	}
 	return nil
 }
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net/netip"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -100,7 +102,7 @@ func TestProcessData(t *testing.T) {
 			Expires: &ExpiredTime,
 		},
 	)
-	got, _, v4count, v6count := processData(stuff, nil)
+	got, _, _, v4count, v6count := processData(stuff, nil, nil)
 	want := []rtr.VRP{
 		{
 			Prefix: netip.MustParsePrefix("2001:db8::/32"),
@@ -133,6 +135,38 @@ func TestProcessData(t *testing.T) {
 	}
 }
 
+func TestProcessDataASPA(t *testing.T) {
+	ExpiredTime := int64(1337)
+	aspas := []prefixfile.VAPJson{
+		{
+			CustomerAsid: 64496,
+			Providers:    []uint32{64499, 64497, 64498, 64497},
+		},
+		// Invalid. Has expired
+		{
+			CustomerAsid: 64500,
+			Providers:    []uint32{64501},
+			Expires:      &ExpiredTime,
+		},
+		// Invalid. Duplicate customer
+		{
+			CustomerAsid: 64496,
+			Providers:    []uint32{64502},
+		},
+	}
+	_, _, got, _, _ := processData(nil, nil, aspas)
+	want := []rtr.VAP{
+		{
+			CustomerASN: 64496,
+			Providers:   []uint32{64497, 64498, 64499},
+		},
+	}
+
+	if !cmp.Equal(got, want) {
+		t.Errorf("Want (%+v), Got (%+v)", want, got)
+	}
+}
+
 func BenchmarkDecodeJSON(b *testing.B) {
 	json, err := os.ReadFile("test.rpki.json")
 	if err != nil {
@@ -191,3 +225,220 @@ func TestNewSHA256(t *testing.T) {
 		t.Errorf("Got (%s), Wanted (%s)", got, want)
 	}
 }
+
+func TestErrorCodeLabel(t *testing.T) {
+	tests := []struct {
+		code uint16
+		want string
+	}{
+		{rtr.PDU_ERROR_NODATA, "no_data_available"},
+		{rtr.PDU_ERROR_UNEXPECTEDPROTO, "unexpected_protocol_version"},
+		{rtr.PDU_ERROR_UNEXPECTEDPROTO + 1, "unknown"},
+		{65535, "unknown"},
+	}
+	for _, tc := range tests {
+		if got := errorCodeLabel(tc.code); got != tc.want {
+			t.Errorf("Wanted label %q for code %d, but got %q", tc.want, tc.code, got)
+		}
+	}
+}
+
+func TestParseSessionIDs(t *testing.T) {
+	for _, tc := range []struct {
+		list string
+		want []uint16
+		err  bool
+	}{
+		{"", nil, false},
+		{"0", []uint16{0}, false},
+		{"10, 20,30", []uint16{10, 20, 30}, false},
+		{"65536", nil, true},
+		{"1,,2", nil, true},
+	} {
+		got, err := parseSessionIDs(tc.list)
+		if (err != nil) != tc.err || !cmp.Equal(got, tc.want) {
+			t.Errorf("Wanted %v (error %v) for %q, but got %v (%v)", tc.want, tc.err, tc.list, got, err)
+		}
+	}
+}
+
+func TestSaveRestoreState(t *testing.T) {
+	newState := func() *state {
+		server := rtr.NewServer(rtr.ServerConfiguration{}, nil, nil)
+		return &state{
+			server:    server,
+			lastdata:  &prefixfile.RPKIList{},
+			checktime: true,
+			stateFile: filepath.Join(t.TempDir(), stateFileName),
+			stateLock: &sync.Mutex{},
+		}
+	}
+
+	tests := []struct {
+		desc      string
+		buildTime time.Time
+		restored  bool
+	}{{
+		desc:      "Recent data",
+		buildTime: time.Now().Add(-time.Hour),
+		restored:  true,
+	}, {
+		desc:      "Stale data",
+		buildTime: time.Now().Add(-25 * time.Hour),
+		restored:  false,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			s := newState()
+			s.server.AddData([]rtr.SendableData{&rtr.VRP{Prefix: netip.MustParsePrefix("192.0.2.0/24"), MaxLen: 24, ASN: 64496}})
+			s.server.AddData([]rtr.SendableData{&rtr.VRP{Prefix: netip.MustParsePrefix("198.51.100.0/24"), MaxLen: 24, ASN: 64496}})
+			s.setDataBuildTime(tc.buildTime)
+			s.saveState()
+
+			r := newState()
+			r.stateFile = s.stateFile
+			if got := r.restoreState(); got != tc.restored {
+				t.Fatalf("Wanted restored %v, but got %v", tc.restored, got)
+			}
+			if !tc.restored {
+				return
+			}
+			if r.server.GetSessionId(rtr.PROTOCOL_VERSION_0) != s.server.GetSessionId(rtr.PROTOCOL_VERSION_0) {
+				t.Error("Session ID not restored")
+			}
+			if serial, valid := r.server.GetCurrentSerial(); serial != 1 || !valid {
+				t.Errorf("Wanted serial 1, but got %d (%v)", serial, valid)
+			}
+			if _, ok := r.server.GetSDsSerialDiff(0); !ok {
+				t.Error("Diff history not restored")
+			}
+			if !r.dataBuildTime.Equal(tc.buildTime) {
+				t.Errorf("Wanted build time %v, but got %v", tc.buildTime, r.dataBuildTime)
+			}
+		})
+	}
+
+	// No state saved yet
+	if newState().restoreState() {
+		t.Error("Wanted nothing to be restored without a state file")
+	}
+
+	// Routers of a rotated session still get a Cache Reset after a restart
+	s := newState()
+	s.server.AddData([]rtr.SendableData{&rtr.VRP{Prefix: netip.MustParsePrefix("192.0.2.0/24"), MaxLen: 24, ASN: 64496}})
+	s.setDataBuildTime(time.Now())
+	prev := s.server.GetSessionId(rtr.PROTOCOL_VERSION_0)
+	s.server.RotateSession()
+	s.saveState()
+	r := newState()
+	r.stateFile = s.stateFile
+	if !r.restoreState() {
+		t.Fatal("Wanted the rotated state to be restored")
+	}
+	if r.server.GetSessionId(rtr.PROTOCOL_VERSION_0) != prev+1 || !r.server.IsPreviousSessionId(rtr.PROTOCOL_VERSION_0, prev) {
+		t.Error("Rotated session not restored")
+	}
+}
+
+func TestSerialFromBuildTime(t *testing.T) {
+	newState := func() *state {
+		server := rtr.NewServer(rtr.ServerConfiguration{ProtocolVersion: rtr.PROTOCOL_VERSION_1, SessId: 1234}, nil, nil)
+		return &state{
+			server:              server,
+			lastdata:            &prefixfile.RPKIList{},
+			lockJson:            &sync.RWMutex{},
+			stateLock:           &sync.Mutex{},
+			serialFromBuildTime: true,
+		}
+	}
+	update := func(s *state, generated int64, vrps []rtr.VRP) {
+		s.lastdata.Metadata.GeneratedUnix = &generated
+		if err := s.applyUpdateFromNewState(vrps, nil, nil, nil, nil, nil, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vrp1 := rtr.VRP{Prefix: netip.MustParsePrefix("192.0.2.0/24"), MaxLen: 24, ASN: 64496}
+	vrp2 := rtr.VRP{Prefix: netip.MustParsePrefix("198.51.100.0/24"), MaxLen: 24, ASN: 64496}
+
+	// The second cache starts later, with the data of the first one
+	a, b := newState(), newState()
+	update(a, 1700000000, []rtr.VRP{vrp1})
+	update(a, 1700000600, []rtr.VRP{vrp1, vrp2})
+	update(b, 1700000600, []rtr.VRP{vrp1, vrp2})
+	update(a, 1700001200, []rtr.VRP{vrp2})
+	update(b, 1700001200, []rtr.VRP{vrp2})
+
+	for _, s := range []*state{a, b} {
+		if serial, _ := s.server.GetCurrentSerial(); serial != 1700001200 {
+			t.Errorf("Wanted serial 1700001200, but got %d", serial)
+		}
+		if id := s.server.GetSessionId(rtr.PROTOCOL_VERSION_1); id != 1234 {
+			t.Errorf("Wanted session ID 1234, but got %d", id)
+		}
+	}
+	// A router of the first cache can query the second one
+	diff, ok := b.server.GetSDsSerialDiff(1700000600)
+	if !ok || len(diff) != 1 {
+		t.Errorf("Wanted a diff with 1 change, but got %v (%v)", diff, ok)
+	}
+
+	// A change without a new generation time waits for the next one, rather
+	// than giving the caches different data with the same serial
+	update(a, 1700001200, []rtr.VRP{vrp1, vrp2})
+	if serial, _ := a.server.GetCurrentSerial(); serial != 1700001200 || a.server.CountSDs() != 1 {
+		t.Errorf("Wanted serial 1700001200 with 1 object, but got %d with %d", serial, a.server.CountSDs())
+	}
+	update(a, 1700001800, []rtr.VRP{vrp1, vrp2})
+	if serial, _ := a.server.GetCurrentSerial(); serial != 1700001800 || a.server.CountSDs() != 2 {
+		t.Errorf("Wanted serial 1700001800 with 2 objects, but got %d with %d", serial, a.server.CountSDs())
+	}
+}
+
+func TestSerialFromBuildTimeSlurm(t *testing.T) {
+	s := &state{
+		server: rtr.NewServer(rtr.ServerConfiguration{ProtocolVersion: rtr.PROTOCOL_VERSION_1, SessId: 1234}, nil, nil),
+		lastdata: &prefixfile.RPKIList{
+			ROA: []prefixfile.VRPJson{
+				{Prefix: "192.0.2.0/24", Length: 24, ASN: 64496},
+				{Prefix: "198.51.100.0/24", Length: 24, ASN: 64496},
+			},
+		},
+		lockJson:            &sync.RWMutex{},
+		stateLock:           &sync.Mutex{},
+		serialFromBuildTime: true,
+	}
+	check := func(serial uint32, count int) {
+		t.Helper()
+		if got, _ := s.server.GetCurrentSerial(); got != serial || s.server.CountSDs() != count {
+			t.Errorf("Wanted serial %d with %d objects, but got %d with %d", serial, count, got, s.server.CountSDs())
+		}
+	}
+	generated := int64(1700000000)
+	s.lastdata.Metadata.GeneratedUnix = &generated
+	if err := s.updateFromNewState(); err != nil {
+		t.Fatal(err)
+	}
+	check(1700000000, 2)
+
+	// The SLURM changes, but the data keeps its generation time
+	s.slurm = &prefixfile.SlurmConfig{
+		ValidationOutputFilters: prefixfile.SlurmValidationOutputFilters{
+			PrefixFilters: []prefixfile.SlurmPrefixFilter{{Prefix: "198.51.100.0/24"}},
+		},
+	}
+	if err := s.updateFromNewState(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.reloadFromCurrentState(); err != nil {
+		t.Fatal(err)
+	}
+	check(1700000000, 2)
+
+	// The change is applied with the next generation of the data
+	generated = 1700000600
+	if err := s.updateFromNewState(); err != nil {
+		t.Fatal(err)
+	}
+	check(1700000600, 1)
+}
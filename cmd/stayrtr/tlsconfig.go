@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Interval at which the TLS files are checked for changes
+const tlsReloadInterval = 30 * time.Second
+
+// tlsFiles serves the certificate of the TLS listener, and verifies the
+// certificates of the routers when a CA bundle is given. The files are
+// reloaded without affecting the connected routers: the configuration is
+// only used by new handshakes.
+type tlsFiles struct {
+	certFile, keyFile, caFile string
+
+	config atomic.Pointer[tls.Config]
+
+	// Modification times of the files at the last load
+	lock     sync.Mutex
+	modTimes []time.Time
+}
+
+func newTLSFiles(certFile, keyFile, caFile string) (*tlsFiles, error) {
+	tf := &tlsFiles{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+	if err := tf.reload(); err != nil {
+		return nil, err
+	}
+	return tf, nil
+}
+
+// Config returns the configuration of the TLS listener.
+func (tf *tlsFiles) Config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return tf.config.Load(), nil
+		},
+	}
+}
+
+func (tf *tlsFiles) paths() []string {
+	if tf.caFile == "" {
+		return []string{tf.certFile, tf.keyFile}
+	}
+	return []string{tf.certFile, tf.keyFile, tf.caFile}
+}
+
+func (tf *tlsFiles) stat() []time.Time {
+	modTimes := make([]time.Time, 0, 3)
+	for _, path := range tf.paths() {
+		var modTime time.Time
+		if fi, err := os.Stat(path); err == nil {
+			modTime = fi.ModTime()
+		}
+		modTimes = append(modTimes, modTime)
+	}
+	return modTimes
+}
+
+// reload loads the files. The previous configuration is kept on error.
+func (tf *tlsFiles) reload() error {
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+	return tf.load(tf.stat())
+}
+
+// reloadIfChanged loads the files when one of them was modified since the
+// last load. It returns whether they were loaded.
+func (tf *tlsFiles) reloadIfChanged() (bool, error) {
+	tf.lock.Lock()
+	defer tf.lock.Unlock()
+	modTimes := tf.stat()
+	changed := false
+	for i := range modTimes {
+		changed = changed || !modTimes[i].Equal(tf.modTimes[i])
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, tf.load(modTimes)
+}
+
+// load must be called with the lock held. The modification times are recorded
+// even on error, so that a file being written is retried when it changes again.
+func (tf *tlsFiles) load(modTimes []time.Time) error {
+	tf.modTimes = modTimes
+	cert, err := tls.LoadX509KeyPair(tf.certFile, tf.keyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if tf.caFile != "" {
+		pem, err := os.ReadFile(tf.caFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no certificates found", tf.caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	tf.config.Store(config)
+	return nil
+}
+
+// watch reloads the files when they change, until the context is done.
+func (tf *tlsFiles) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reloaded, err := tf.reloadIfChanged()
+		if err != nil {
+			log.Errorf("Could not reload TLS certificates: %v", err)
+		} else if reloaded {
+			log.Info("Reloaded TLS certificates")
+		}
+	}
+}
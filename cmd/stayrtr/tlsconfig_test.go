@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate and its key, and
+// returns the certificate.
+func writeTestCertificate(t *testing.T, certFile, keyFile, cn string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// touch moves the modification time of the file forward, as the files can
+// be written within the resolution of the file system.
+func touch(t *testing.T, path string, d time.Duration) {
+	mtime := time.Now().Add(d)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSFilesReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first := writeTestCertificate(t, certFile, keyFile, "first")
+
+	tf, err := newTLSFiles(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := func() *tls.Config {
+		config, err := tf.Config().GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+	if config := served(); string(config.Certificates[0].Certificate[0]) != string(first) || config.ClientAuth != tls.NoClientCert {
+		t.Error("Wanted the first certificate without client authentication")
+	}
+	if reloaded, err := tf.reloadIfChanged(); reloaded || err != nil {
+		t.Errorf("Wanted no reload without changes, but got %v (%v)", reloaded, err)
+	}
+
+	second := writeTestCertificate(t, certFile, keyFile, "second")
+	touch(t, certFile, time.Minute)
+	touch(t, keyFile, time.Minute)
+	if reloaded, err := tf.reloadIfChanged(); !reloaded || err != nil {
+		t.Fatalf("Wanted a reload, but got %v (%v)", reloaded, err)
+	}
+	if config := served(); string(config.Certificates[0].Certificate[0]) != string(second) {
+		t.Error("Wanted the second certificate after reloading")
+	}
+
+	// A broken key keeps the previous certificate
+	if err := os.WriteFile(keyFile, []byte("broken"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, keyFile, 2*time.Minute)
+	if reloaded, err := tf.reloadIfChanged(); !reloaded || err == nil {
+		t.Errorf("Wanted a failed reload, but got %v (%v)", reloaded, err)
+	}
+	if config := served(); string(config.Certificates[0].Certificate[0]) != string(second) {
+		t.Error("Wanted the second certificate to be kept")
+	}
+	if reloaded, _ := tf.reloadIfChanged(); reloaded {
+		t.Error("Wanted no retry until the files change again")
+	}
+}
+
+func TestTLSFilesClientCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	caFile, caKeyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	writeTestCertificate(t, certFile, keyFile, "server")
+	writeTestCertificate(t, caFile, caKeyFile, "CA")
+
+	tf, err := newTLSFiles(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := tf.config.Load()
+	if config.ClientAuth != tls.RequireAndVerifyClientCert || config.ClientCAs == nil {
+		t.Error("Wanted the certificates of the clients to be verified")
+	}
+
+	// An empty bundle is an error
+	if err := os.WriteFile(caFile, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTLSFiles(certFile, keyFile, caFile); err == nil {
+		t.Error("Wanted an error with an empty CA bundle")
+	}
+}
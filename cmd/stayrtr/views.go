@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/netip"
+	"os"
+	"slices"
+
+	rtr "github.com/bgp/stayrtr/lib"
+	"github.com/bgp/stayrtr/prefixfile"
+	log "github.com/sirupsen/logrus"
+)
+
+// viewConfig is an entry of the file of -views
+type viewConfig struct {
+	Name string `json:"name"`
+	// Address families of the VRPs, "ipv4" or "ipv6" (all of them if empty)
+	Families []string `json:"families"`
+	// Trust anchors whose VRPs, router keys and ASPAs are left out
+	ExcludeTAs []string `json:"exclude_tas"`
+	// SLURM file applied after the one of -slurm, reloaded with each refresh
+	Slurm string `json:"slurm"`
+
+	Match struct {
+		Prefixes    []netip.Prefix `json:"prefixes"`
+		TLSSubjects []string       `json:"tls_subjects"`
+		SSHUsers    []string       `json:"ssh_users"`
+	} `json:"match"`
+}
+
+// dataView holds the data served to the routers matching a view, derived
+// from the data of the server.
+type dataView struct {
+	view   *rtr.View
+	server *rtr.Server
+
+	ipv4, ipv6 bool
+	excludeTAs map[string]struct{}
+	slurmFile  string
+	slurmHash  []byte
+	slurm      *prefixfile.SlurmConfig
+}
+
+// loadViews reads the views from a file. Their data keeps the same diff
+// history as the one of the server.
+func loadViews(path string, sc rtr.ServerConfiguration) ([]*dataView, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var configs []viewConfig
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&configs); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	views := make([]*dataView, 0, len(configs))
+	names := make(map[string]struct{})
+	for _, vc := range configs {
+		if vc.Name == "" {
+			return nil, errors.New("view without a name")
+		}
+		if _, ok := names[vc.Name]; ok {
+			return nil, fmt.Errorf("view %s: duplicate name", vc.Name)
+		}
+		names[vc.Name] = struct{}{}
+
+		dv := &dataView{
+			ipv4:       len(vc.Families) == 0,
+			ipv6:       len(vc.Families) == 0,
+			excludeTAs: make(map[string]struct{}),
+			slurmFile:  vc.Slurm,
+		}
+		for _, family := range vc.Families {
+			switch family {
+			case "ipv4":
+				dv.ipv4 = true
+			case "ipv6":
+				dv.ipv6 = true
+			default:
+				return nil, fmt.Errorf("view %s: unknown family %q", vc.Name, family)
+			}
+		}
+		for _, ta := range vc.ExcludeTAs {
+			dv.excludeTAs[ta] = struct{}{}
+		}
+		if _, err := dv.loadSlurm(); err != nil {
+			return nil, fmt.Errorf("view %s: %w", vc.Name, err)
+		}
+
+		sessID, sessIDs := viewSessionIds(sc, vc.Name)
+		dv.server = rtr.NewServer(rtr.ServerConfiguration{
+			ProtocolVersion:   sc.ProtocolVersion,
+			SessId:            sessID,
+			SessIds:           sessIDs,
+			KeepDifference:    sc.KeepDifference,
+			KeepDifferenceAge: sc.KeepDifferenceAge,
+			Log:               sc.Log,
+		}, nil, nil)
+		dv.view = &rtr.View{
+			Name:        vc.Name,
+			Data:        dv.server,
+			Prefixes:    vc.Match.Prefixes,
+			TLSSubjects: vc.Match.TLSSubjects,
+			SSHUsers:    vc.Match.SSHUsers,
+		}
+		views = append(views, dv)
+	}
+	return views, nil
+}
+
+// viewSessionIds derives the session IDs of a view from the configured ones of
+// the server. Each view has its own session, as a router moving to another
+// view must not get a diff, and the instances sharing a configuration agree on
+// it. Random IDs are used when none are configured.
+func viewSessionIds(sc rtr.ServerConfiguration, name string) (int, []uint16) {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	// Never zero, so that the view does not share the session of the server
+	offset := uint16(h.Sum32()) | 1
+
+	sessID := -1
+	if sc.SessId >= 0 {
+		sessID = int(uint16(sc.SessId) + offset)
+	}
+	var sessIDs []uint16
+	for _, id := range sc.SessIds {
+		sessIDs = append(sessIDs, id+offset)
+	}
+	return sessID, sessIDs
+}
+
+// loadSlurm reads the SLURM file of the view. It returns whether it changed
+// since the last time it was read. The previous one is kept on errors.
+func (dv *dataView) loadSlurm() (bool, error) {
+	if dv.slurmFile == "" {
+		return false, nil
+	}
+	data, err := os.ReadFile(dv.slurmFile)
+	if err != nil {
+		return false, err
+	}
+	hsum := newSHA256(data)
+	if bytes.Equal(dv.slurmHash, hsum) {
+		return false, nil
+	}
+	slurm, err := prefixfile.DecodeJSONSlurm(bytes.NewReader(data))
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", dv.slurmFile, err)
+	}
+	dv.slurm, dv.slurmHash = slurm, hsum
+	return true, nil
+}
+
+// filter returns the VRPs, router keys and ASPAs of the view.
+func (dv *dataView) filter(vrps []prefixfile.VRPJson, brks []prefixfile.BgpSecKeyJson, vaps []prefixfile.VAPJson) ([]prefixfile.VRPJson, []prefixfile.BgpSecKeyJson, []prefixfile.VAPJson) {
+	vrps = slices.DeleteFunc(slices.Clone(vrps), func(v prefixfile.VRPJson) bool {
+		_, excluded := dv.excludeTAs[v.TA]
+		return excluded
+	})
+	brks = slices.DeleteFunc(slices.Clone(brks), func(k prefixfile.BgpSecKeyJson) bool {
+		_, excluded := dv.excludeTAs[k.Ta]
+		return excluded
+	})
+	vaps = slices.DeleteFunc(slices.Clone(vaps), func(v prefixfile.VAPJson) bool {
+		_, excluded := dv.excludeTAs[v.TA]
+		return excluded
+	})
+	if dv.slurm != nil {
+		vrps, brks = dv.slurm.FilterAssert(vrps, brks, log.StandardLogger())
+	}
+	// The invalid prefixes are dropped by processData
+	vrps = slices.DeleteFunc(vrps, func(v prefixfile.VRPJson) bool {
+		prefix, err := v.GetPrefix2()
+		return err == nil && (prefix.Addr().Is4() && !dv.ipv4 || prefix.Addr().Is6() && !dv.ipv6)
+	})
+	return vrps, brks, vaps
+}
+
+func viewSelector(views []*dataView) rtr.ViewSelector {
+	if len(views) == 0 {
+		return nil
+	}
+	selector := make(rtr.Views, len(views))
+	for i, dv := range views {
+		selector[i] = dv.view
+	}
+	return selector
+}
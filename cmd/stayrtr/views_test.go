@@ -0,0 +1,243 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	rtr "github.com/bgp/stayrtr/lib"
+	"github.com/bgp/stayrtr/prefixfile"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadViews(t *testing.T) {
+	slurm := writeFile(t, "edge.slurm", `{
+		"slurmVersion": 1,
+		"validationOutputFilters": {"prefixFilters": [], "bgpsecFilters": []},
+		"locallyAddedAssertions": {
+			"prefixAssertions": [{"asn": 64499, "prefix": "203.0.113.0/24"}],
+			"bgpsecAssertions": []
+		}
+	}`)
+
+	tests := []struct {
+		desc    string
+		config  string
+		wantErr bool
+	}{
+		{"Valid", `[
+			{"name": "v4", "families": ["ipv4"], "match": {"prefixes": ["192.0.2.0/24"]}},
+			{"name": "edge", "exclude_tas": ["arin"], "slurm": "` + slurm + `", "match": {"ssh_users": ["edge"], "tls_subjects": ["CN=edge"]}}
+		]`, false},
+		{"No name", `[{"families": ["ipv4"]}]`, true},
+		{"Duplicate name", `[{"name": "v4"}, {"name": "v4"}]`, true},
+		{"Unknown family", `[{"name": "v4", "families": ["ipv5"]}]`, true},
+		{"Unknown field", `[{"name": "v4", "family": "ipv4"}]`, true},
+		{"Invalid prefix", `[{"name": "v4", "match": {"prefixes": ["192.0.2.0/33"]}}]`, true},
+		{"Missing SLURM file", `[{"name": "v4", "slurm": "/nonexistent"}]`, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			path := writeFile(t, "views.json", tc.config)
+			views, err := loadViews(path, rtr.ServerConfiguration{ProtocolVersion: rtr.PROTOCOL_VERSION_1})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Wanted error %v, but got (%v)", tc.wantErr, err)
+			}
+			if err == nil && len(views) != 2 {
+				t.Errorf("Wanted 2 views, but got %d", len(views))
+			}
+		})
+	}
+}
+
+func TestUpdateViews(t *testing.T) {
+	path := writeFile(t, "views.json", `[
+		{"name": "v4", "families": ["ipv4"]},
+		{"name": "no-arin", "exclude_tas": ["arin"]}
+	]`)
+	views, err := loadViews(path, rtr.ServerConfiguration{ProtocolVersion: rtr.PROTOCOL_VERSION_1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &state{
+		server:    rtr.NewServer(rtr.ServerConfiguration{ProtocolVersion: rtr.PROTOCOL_VERSION_1}, nil, nil),
+		views:     views,
+		lastdata:  &prefixfile.RPKIList{},
+		lockJson:  &sync.RWMutex{},
+		stateLock: &sync.Mutex{},
+	}
+
+	vrpsjson := []prefixfile.VRPJson{
+		{Prefix: "192.0.2.0/24", Length: 24, ASN: 64496, TA: "ripe"},
+		{Prefix: "198.51.100.0/24", Length: 24, ASN: 64497, TA: "arin"},
+		{Prefix: "2001:db8::/32", Length: 48, ASN: 64496, TA: "ripe"},
+	}
+	vapsjson := []prefixfile.VAPJson{
+		{CustomerAsid: 64496, Providers: []uint32{64497}},
+		{CustomerAsid: 64497, Providers: []uint32{64498}, TA: "arin"},
+	}
+	update := func(vrpsjson []prefixfile.VRPJson) {
+		vrps, brks, vaps, countv4, countv6 := processData(vrpsjson, nil, vapsjson)
+		if err := s.applyUpdateFromNewState(vrps, brks, vaps, vrpsjson, nil, vapsjson, countv4, countv6); err != nil {
+			t.Fatal(err)
+		}
+	}
+	update(vrpsjson)
+
+	// The ASPAs are in every view, except the ones of excluded TAs
+	for _, want := range []struct {
+		view  *dataView
+		count int
+	}{
+		{views[0], 4},
+		{views[1], 3},
+	} {
+		if got := want.view.server.CountSDs(); got != want.count {
+			t.Errorf("Wanted %d objects in view %s, but got %d", want.count, want.view.view.Name, got)
+		}
+	}
+	if got := s.server.CountSDs(); got != 5 {
+		t.Errorf("Wanted 5 objects in the server, but got %d", got)
+	}
+
+	// A change of IPv6 data does not change the IPv4 view
+	update(vrpsjson[:2])
+	if serial, _ := views[0].server.GetCurrentSerial(); serial != 0 {
+		t.Errorf("Wanted serial 0 for the IPv4 view, but got %d", serial)
+	}
+	diff, ok := views[1].server.GetSDsSerialDiff(0)
+	if serial, _ := views[1].server.GetCurrentSerial(); serial != 1 || !ok || len(diff) != 1 {
+		t.Errorf("Wanted serial 1 with a diff of 1 change, but got serial %d with %v (%v)", serial, diff, ok)
+	} else if vrp, ok := diff[0].(*rtr.VRP); !ok || vrp.Prefix != netip.MustParsePrefix("2001:db8::/32") || vrp.GetFlag() != rtr.FLAG_REMOVED {
+		t.Errorf("Wanted the IPv6 VRP to be removed, but got %v", diff[0])
+	}
+
+	s.clearData()
+	for _, dv := range views {
+		if dv.server.CountSDs() != 0 {
+			t.Errorf("Wanted view %s to be cleared", dv.view.Name)
+		}
+	}
+}
+
+func TestViewSlurmReload(t *testing.T) {
+	slurm := writeFile(t, "view.slurm.json", `{"validationOutputFilters": {"prefixFilters": [{"prefix": "192.0.2.0/24"}]}}`)
+	path := writeFile(t, "views.json", `[{"name": "edge", "slurm": "`+slurm+`"}]`)
+	views, err := loadViews(path, rtr.ServerConfiguration{ProtocolVersion: rtr.PROTOCOL_VERSION_1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &state{
+		server: rtr.NewServer(rtr.ServerConfiguration{ProtocolVersion: rtr.PROTOCOL_VERSION_1}, nil, nil),
+		views:  views,
+		lastdata: &prefixfile.RPKIList{
+			ROA: []prefixfile.VRPJson{
+				{Prefix: "192.0.2.0/24", Length: 24, ASN: 64496},
+				{Prefix: "198.51.100.0/24", Length: 24, ASN: 64497},
+			},
+		},
+		lockJson:  &sync.RWMutex{},
+		stateLock: &sync.Mutex{},
+	}
+	if err := s.updateFromNewState(); err != nil {
+		t.Fatal(err)
+	}
+	if got := views[0].server.CountSDs(); got != 1 {
+		t.Errorf("Wanted 1 object in the view, but got %d", got)
+	}
+
+	if s.updateViewsSlurm() {
+		t.Error("Wanted an identical SLURM file to be left as is")
+	}
+	if err := os.WriteFile(slurm, []byte(`{"validationOutputFilters": {"prefixFilters": [{"prefix": "198.51.100.0/24"}]}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !s.updateViewsSlurm() {
+		t.Fatal("Wanted the SLURM file to be reloaded")
+	}
+	if err := s.updateFromNewState(); err != nil {
+		t.Fatal(err)
+	}
+	diff, ok := views[0].server.GetSDsSerialDiff(0)
+	if !ok || len(diff) != 2 {
+		t.Errorf("Wanted a diff with 2 changes, but got %v (%v)", diff, ok)
+	}
+
+	// An invalid file keeps the previous one
+	if err := os.WriteFile(slurm, []byte(`{`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if s.updateViewsSlurm() || views[0].slurm == nil {
+		t.Error("Wanted the previous SLURM file to be kept")
+	}
+}
+
+func TestViewsSessionAndState(t *testing.T) {
+	path := writeFile(t, "views.json", `[{"name": "v4", "families": ["ipv4"]}, {"name": "v6", "families": ["ipv6"]}]`)
+	sc := rtr.ServerConfiguration{ProtocolVersion: rtr.PROTOCOL_VERSION_1, SessId: 1234}
+	newState := func(stateFile string) *state {
+		views, err := loadViews(path, sc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &state{
+			server:    rtr.NewServer(sc, nil, nil),
+			views:     views,
+			lastdata:  &prefixfile.RPKIList{},
+			lockJson:  &sync.RWMutex{},
+			stateLock: &sync.Mutex{},
+			stateFile: stateFile,
+		}
+	}
+	s := newState(filepath.Join(t.TempDir(), stateFileName))
+
+	// The views have their own sessions, the same on every instance
+	other := newState("")
+	ids := map[uint16]string{s.server.GetSessionId(rtr.PROTOCOL_VERSION_1): "server"}
+	for i, dv := range s.views {
+		id := dv.server.GetSessionId(rtr.PROTOCOL_VERSION_1)
+		if name, ok := ids[id]; ok {
+			t.Errorf("View %s has the session ID %d of %s", dv.view.Name, id, name)
+		}
+		ids[id] = dv.view.Name
+		if otherID := other.views[i].server.GetSessionId(rtr.PROTOCOL_VERSION_1); otherID != id {
+			t.Errorf("Wanted session ID %d for view %s, but got %d", id, dv.view.Name, otherID)
+		}
+	}
+
+	// The views are restored with the server
+	vrpsjson := []prefixfile.VRPJson{
+		{Prefix: "192.0.2.0/24", Length: 24, ASN: 64496},
+		{Prefix: "2001:db8::/32", Length: 48, ASN: 64496},
+	}
+	vrps, _, _, countv4, countv6 := processData(vrpsjson, nil, nil)
+	if err := s.applyUpdateFromNewState(vrps, nil, nil, vrpsjson, nil, nil, countv4, countv6); err != nil {
+		t.Fatal(err)
+	}
+	s.setDataBuildTime(time.Now())
+	s.views[0].server.RotateSession()
+	s.saveState()
+
+	r := newState(s.stateFile)
+	if !r.restoreState() {
+		t.Fatal("Wanted the state to be restored")
+	}
+	for i, dv := range r.views {
+		if got := dv.server.CountSDs(); got != 1 {
+			t.Errorf("Wanted 1 object in view %s, but got %d", dv.view.Name, got)
+		}
+		if got, want := dv.server.GetSessionId(rtr.PROTOCOL_VERSION_1), s.views[i].server.GetSessionId(rtr.PROTOCOL_VERSION_1); got != want {
+			t.Errorf("Wanted session ID %d for view %s, but got %d", want, dv.view.Name, got)
+		}
+	}
+}
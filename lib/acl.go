@@ -0,0 +1,119 @@
+package rtrlib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// ACL filters the connections by their source address. The rules are
+// evaluated in order and the first one matching decides. An address matching
+// no rule is rejected if the ACL has allow rules, and accepted otherwise.
+type ACL struct {
+	Rules []ACLRule
+}
+
+type ACLRule struct {
+	Allow  bool
+	Prefix netip.Prefix
+}
+
+func (r ACLRule) String() string {
+	if r.Allow {
+		return "allow " + r.Prefix.String()
+	}
+	return "deny " + r.Prefix.String()
+}
+
+// Allowed tells whether the ACL accepts connections from the address.
+func (a *ACL) Allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	hasAllow := false
+	for _, rule := range a.Rules {
+		if rule.Prefix.Contains(addr) {
+			return rule.Allow
+		}
+		hasAllow = hasAllow || rule.Allow
+	}
+	return !hasAllow
+}
+
+// AllowedConn tells whether the ACL accepts the connection. Connections
+// without an IP address (eg: Unix sockets) are always accepted.
+func (a *ACL) AllowedConn(conn net.Conn) bool {
+	addr, ok := connAddr(conn.RemoteAddr())
+	return !ok || a.Allowed(addr)
+}
+
+func connAddr(addr net.Addr) (netip.Addr, bool) {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.AddrPort().Addr(), true
+	case *net.UDPAddr:
+		return addr.AddrPort().Addr(), true
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr(), true
+}
+
+// ParseACL reads an ACL made of one rule per line: "allow" or "deny" followed
+// by a prefix or an address. Empty lines and comments starting with # are
+// ignored.
+func ParseACL(r io.Reader) (*ACL, error) {
+	acl := &ACL{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: wanted an action and a prefix", n)
+		}
+
+		var rule ACLRule
+		switch fields[0] {
+		case "allow":
+			rule.Allow = true
+		case "deny":
+		default:
+			return nil, fmt.Errorf("line %d: unknown action %q", n, fields[0])
+		}
+		if strings.Contains(fields[1], "/") {
+			prefix, err := netip.ParsePrefix(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			rule.Prefix = prefix.Masked()
+		} else {
+			addr, err := netip.ParseAddr(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			rule.Prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		acl.Rules = append(acl.Rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// ReadACLFile reads an ACL from a file, see ParseACL.
+func ReadACLFile(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseACL(f)
+}
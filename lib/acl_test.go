@@ -0,0 +1,75 @@
+package rtrlib
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParseACL(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader(`
+# Routers
+allow 192.0.2.0/24
+allow 2001:db8::1   # single address
+deny 198.51.100.7
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"allow 192.0.2.0/24", "allow 2001:db8::1/128", "deny 198.51.100.7/32"}
+	if len(acl.Rules) != len(want) {
+		t.Fatalf("Wanted %v, but got %v", want, acl.Rules)
+	}
+	for i := range want {
+		if got := acl.Rules[i].String(); got != want[i] {
+			t.Errorf("Wanted rule %q, but got %q", want[i], got)
+		}
+	}
+
+	for _, invalid := range []string{"permit 192.0.2.0/24", "allow", "allow 192.0.2.0/33", "deny example.com", "allow 192.0.2.0/24 extra"} {
+		if _, err := ParseACL(strings.NewReader(invalid)); err == nil {
+			t.Errorf("Wanted an error for %q", invalid)
+		}
+	}
+}
+
+func TestACLAllowed(t *testing.T) {
+	tests := []struct {
+		desc  string
+		rules string
+		addr  string
+		want  bool
+	}{
+		{"Empty", "", "192.0.2.1", true},
+		{"Allowed", "allow 192.0.2.0/24", "192.0.2.1", true},
+		{"Not allowed", "allow 192.0.2.0/24", "198.51.100.1", false},
+		{"Denied", "deny 192.0.2.0/24", "192.0.2.1", false},
+		{"Not denied", "deny 192.0.2.0/24", "198.51.100.1", true},
+		{"First match", "deny 192.0.2.1\nallow 192.0.2.0/24", "192.0.2.1", false},
+		{"First match allows", "allow 192.0.2.1\ndeny 192.0.2.0/24", "192.0.2.1", true},
+		{"Mapped IPv4", "allow 192.0.2.0/24", "::ffff:192.0.2.1", true},
+		{"IPv6 not allowed", "allow 192.0.2.0/24", "2001:db8::1", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			acl, err := ParseACL(strings.NewReader(tc.rules))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := acl.Allowed(netip.MustParseAddr(tc.addr)); got != tc.want {
+				t.Errorf("Wanted %v, but got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestACLAllowedConn(t *testing.T) {
+	acl := &ACL{Rules: []ACLRule{{Allow: true, Prefix: netip.MustParsePrefix("192.0.2.0/24")}}}
+	srv, cli := net.Pipe()
+	defer srv.Close()
+	defer cli.Close()
+	if !acl.AllowedConn(srv) {
+		t.Error("Wanted a connection without an IP address to be accepted")
+	}
+}
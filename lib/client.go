@@ -2,6 +2,7 @@ package rtrlib
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -16,8 +17,18 @@ type RTRClientSessionEventHandler interface {
 	ClientDisconnected(*ClientSession)
 }
 
+// RTRClientSessionConformanceHandler can be implemented by handlers of sessions
+// decoding strictly to be told about non-conformant PDUs instead of ending the session.
+// The PDU is then decoded leniently and passed to HandlePDU.
+type RTRClientSessionConformanceHandler interface {
+	HandleNonConformantPDU(*ClientSession, *DecodeError)
+}
+
 type ClientSession struct {
 	version uint8
+	strict  bool
+
+	tcpSignatures TCPSignatures
 
 	connected bool
 	tcpconn   net.Conn
@@ -39,16 +50,24 @@ type ClientConfiguration struct {
 	RetryInterval   uint32
 	ExpireInterval  uint32
 
+	// StrictDecoding validates the PDUs sent by the cache against the specification
+	StrictDecoding bool
+
+	// TCP-MD5 and TCP-AO keys of the connections of StartPlain
+	TCPSignatures TCPSignatures
+
 	Log Logger
 }
 
 func NewClientSession(configuration ClientConfiguration, handler RTRClientSessionEventHandler) *ClientSession {
 	return &ClientSession{
-		version:   configuration.ProtocolVersion,
-		transmits: make(chan PDU, 256),
-		quit:      make(chan bool),
-		log:       configuration.Log,
-		handler:   handler,
+		version:       configuration.ProtocolVersion,
+		strict:        configuration.StrictDecoding,
+		tcpSignatures: configuration.TCPSignatures,
+		transmits:     make(chan PDU, 256),
+		quit:          make(chan bool),
+		log:           configuration.Log,
+		handler:       handler,
 	}
 }
 
@@ -75,11 +94,13 @@ func (c *ClientSession) SendRawPDU(pdu PDU) {
 }
 
 func (c *ClientSession) sendLoop() {
+	var buf []byte
 	for c.connected {
 		select {
 		case pdu := <-c.transmits:
 			if c.wr != nil {
-				c.wr.Write(pdu.Bytes())
+				buf = pdu.AppendBinary(buf[:0])
+				c.wr.Write(buf)
 			}
 		case <-c.quit:
 			return
@@ -107,8 +128,9 @@ func (c *ClientSession) StartRW(rd io.Reader, wr io.Writer) error {
 	if c.handler != nil {
 		c.handler.ClientConnected(c)
 	}
+	pduReader := NewPDUReader(rd)
 	for c.connected {
-		dec, err := Decode(c.rd)
+		dec, err := c.decode(pduReader)
 		if err != nil || dec == nil {
 			if c.log != nil {
 				c.log.Errorf("Error %v", err)
@@ -116,11 +138,11 @@ func (c *ClientSession) StartRW(rd io.Reader, wr io.Writer) error {
 			c.Disconnect()
 			return err
 		}
-		if c.version == PROTOCOL_VERSION_1 && dec.GetVersion() == PROTOCOL_VERSION_0 {
+		if dec.GetVersion() < c.version {
 			if c.log != nil {
-				c.log.Infof("Downgrading to version 0")
+				c.log.Infof("Downgrading to version %d", dec.GetVersion())
 			}
-			c.version = PROTOCOL_VERSION_0
+			c.version = dec.GetVersion()
 		}
 
 		if c.handler != nil {
@@ -130,6 +152,24 @@ func (c *ClientSession) StartRW(rd io.Reader, wr io.Writer) error {
 	return nil
 }
 
+func (c *ClientSession) decode(rd *PDUReader) (PDU, error) {
+	frame, err := rd.NextFrame()
+	if err != nil {
+		return nil, err
+	}
+	dec, err := DecodeOptions{Strict: c.strict}.DecodeBytes(frame)
+	var decodeErr *DecodeError
+	if !errors.Is(err, ErrNonConformantPDU) || !errors.As(err, &decodeErr) {
+		return dec, err
+	}
+	handler, ok := c.handler.(RTRClientSessionConformanceHandler)
+	if !ok {
+		return nil, err
+	}
+	handler.HandleNonConformantPDU(c, decodeErr)
+	return DecodeBytes(frame)
+}
+
 func (c *ClientSession) StartWithConn(tcpconn net.Conn) error {
 	c.tcpconn = tcpconn
 	c.wr = tcpconn
@@ -149,11 +189,11 @@ func (c *ClientSession) StartWithSSH(tcpconn *net.TCPConn, session *ssh.Session)
 }
 
 func (c *ClientSession) StartPlain(addr string) error {
-	addrTCP, err := net.ResolveTCPAddr("tcp", addr)
-	if err != nil {
-		return err
+	dialer := net.Dialer{}
+	if len(c.tcpSignatures) > 0 {
+		dialer.Control = c.tcpSignatures.Control
 	}
-	tcpconn, err := net.DialTCP("tcp", nil, addrTCP)
+	tcpconn, err := dialer.Dial("tcp", addr)
 	if err != nil {
 		return err
 	}
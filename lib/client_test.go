@@ -2,6 +2,7 @@ package rtrlib
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"testing"
 
@@ -126,3 +127,60 @@ func TestRouterKeyEncodeDecode(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestASPAEncodeDecode(t *testing.T) {
+	p := &PDUASPA{
+		Version:           2,
+		Flags:             1,
+		CustomerASNumber:  64496,
+		ProviderASNumbers: []uint32{64497, 64498},
+	}
+
+	buf := bytes.NewBuffer(nil)
+	p.Write(buf)
+
+	outputPdu, err := Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cmp.Equal(outputPdu, PDU(p)) {
+		t.Fatalf("Wanted (%+v), but got (%+v)", p, outputPdu)
+	}
+}
+
+type conformanceTestClient struct {
+	TestClient
+
+	nonConformant []*DecodeError
+}
+
+func (tc *conformanceTestClient) HandleNonConformantPDU(cs *ClientSession, err *DecodeError) {
+	tc.nonConformant = append(tc.nonConformant, err)
+}
+
+func TestClientSessionNonConformant(t *testing.T) {
+	// Host bits are set in the prefix
+	pdu := []byte{1, PDU_ID_IPV4_PREFIX, 0, 0, 0, 0, 0, 20, 1, 24, 24, 0, 192, 0, 2, 1, 0, 0, 0xfb, 0xf0}
+
+	cc := getBasicClientConguration(PROTOCOL_VERSION_1)
+	cc.StrictDecoding = true
+	handler := &conformanceTestClient{}
+	cs := NewClientSession(cc, handler)
+
+	rd := NewPDUReader(bytes.NewReader(pdu))
+	if _, err := cs.decode(rd); err != nil {
+		t.Fatalf("Wanted the PDU to be decoded leniently, but got (%v)", err)
+	}
+
+	if len(handler.nonConformant) != 1 || !bytes.Equal(handler.nonConformant[0].PDU, pdu) {
+		t.Fatalf("Unexpected non-conformant PDUs %v", handler.nonConformant)
+	}
+
+	// Without a conformance handler, the error ends the session
+	cs = NewClientSession(cc, getClient())
+	rd = NewPDUReader(bytes.NewReader(pdu))
+	if _, err := cs.decode(rd); !errors.Is(err, ErrNonConformantPDU) {
+		t.Fatalf("Wanted a non-conformant PDU error, but got (%v)", err)
+	}
+}
@@ -0,0 +1,175 @@
+package rtrlib
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of Error Reports kept for each router
+	errorReportHistory = 10
+	// Number of routers whose Error Reports are kept, the ones with the
+	// oldest reports are forgotten first
+	errorReportRouters = 1024
+)
+
+// ReceivedErrorReport is an Error Report sent by a router, see GetErrorReports.
+type ReceivedErrorReport struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	Identity   string    `json:"identity,omitempty"`
+	Code       uint16    `json:"code"`
+	Error      string    `json:"error"`
+	Message    string    `json:"message,omitempty"`
+	// Hexadecimal copy of the PDU in error
+	PDU string `json:"pdu,omitempty"`
+}
+
+// isFatalError tells whether an Error Report ends the session: all of them
+// except No Data Available (RFC 8210, section 12).
+func isFatalError(code uint16) bool {
+	return code != PDU_ERROR_NODATA
+}
+
+// isDataError tells whether an Error Report means that the router disagrees
+// with the data received from the server.
+func isDataError(code uint16) bool {
+	return code == PDU_ERROR_WITHDRAWUNKNOWN || code == PDU_ERROR_DUPANNOUNCE
+}
+
+// errorText is the message of an Error Report, without the null terminator
+// some routers add.
+func errorText(pdu *PDUErrorReport) string {
+	return strings.TrimRight(pdu.ErrorMsg, "\x00")
+}
+
+type routerErrors struct {
+	reports []ReceivedErrorReport
+	// The next Serial Query is answered with a Cache Reset
+	reset bool
+}
+
+// routerKey identifies a router across its connections: routers behind the
+// same address are told apart by their transport and identity.
+type routerKey struct {
+	transport Transport
+	addr      netip.Addr
+	identity  string
+	// Clients without an address (eg: on a Unix socket) are only known by
+	// their connection
+	id uint64
+}
+
+func routerKeyOf(c *Client) routerKey {
+	addr, ok := connAddr(c.GetRemoteAddress())
+	if !ok {
+		return routerKey{id: c.GetID()}
+	}
+	return routerKey{
+		transport: c.GetTransport(),
+		addr:      addr.Unmap(),
+		identity:  c.GetIdentity(),
+	}
+}
+
+// errorReports are the Error Reports received from each router, kept when the
+// router reconnects.
+type errorReports struct {
+	lock    sync.Mutex
+	routers map[routerKey]*routerErrors
+}
+
+func newErrorReports() *errorReports {
+	return &errorReports{routers: make(map[routerKey]*routerErrors)}
+}
+
+func (e *errorReports) add(c *Client, pdu *PDUErrorReport, reset bool) {
+	report := ReceivedErrorReport{
+		Time:       time.Now(),
+		RemoteAddr: c.GetRemoteAddress().String(),
+		Identity:   c.GetIdentity(),
+		Code:       pdu.ErrorCode,
+		Error:      ErrorCodeToString(pdu.ErrorCode),
+		Message:    errorText(pdu),
+		PDU:        hex.EncodeToString(pdu.PDUCopy),
+	}
+	key := routerKeyOf(c)
+	// The reset could only be sent to the same connection, which is closed
+	// after a data error
+	reset = reset && key.id == 0
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	router, ok := e.routers[key]
+	if !ok {
+		if len(e.routers) >= errorReportRouters {
+			e.forgetOldest()
+		}
+		router = &routerErrors{}
+		e.routers[key] = router
+	}
+	if len(router.reports) >= errorReportHistory {
+		router.reports = slices.Delete(router.reports, 0, len(router.reports)-errorReportHistory+1)
+	}
+	router.reports = append(router.reports, report)
+	router.reset = router.reset || reset
+}
+
+func (e *errorReports) forgetOldest() {
+	var oldest routerKey
+	var oldestTime time.Time
+	for key, router := range e.routers {
+		last := router.reports[len(router.reports)-1].Time
+		if oldestTime.IsZero() || last.Before(oldestTime) {
+			oldest, oldestTime = key, last
+		}
+	}
+	delete(e.routers, oldest)
+}
+
+// takeReset tells whether the router must get a Cache Reset, and clears it.
+func (e *errorReports) takeReset(c *Client) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	router, ok := e.routers[routerKeyOf(c)]
+	if !ok || !router.reset {
+		return false
+	}
+	router.reset = false
+	return true
+}
+
+// router returns the reports of the router of a client.
+func (e *errorReports) router(c *Client) []ReceivedErrorReport {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if router, ok := e.routers[routerKeyOf(c)]; ok {
+		return slices.Clone(router.reports)
+	}
+	return nil
+}
+
+// all returns the reports of all the routers, sorted by time.
+func (e *errorReports) all() []ReceivedErrorReport {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	out := make([]ReceivedErrorReport, 0)
+	for _, router := range e.routers {
+		out = append(out, router.reports...)
+	}
+	slices.SortFunc(out, func(a, b ReceivedErrorReport) int { return a.Time.Compare(b.Time) })
+	return out
+}
+
+// GetErrorReports writes the last Error Reports received from each router as
+// JSON, oldest first. They are kept after the router disconnects.
+func (s *Server) GetErrorReports(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.errorReports.all())
+}
@@ -0,0 +1,138 @@
+package rtrlib
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestServerErrorReport(t *testing.T) {
+	h := &countingEventHandler{resets: make(chan struct{}, 1)}
+	s := NewServer(ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_1, ResetOnDataError: true}, nil, h)
+	addr := net.TCPAddrFromAddrPort(netip.MustParseAddrPort("192.0.2.1:323"))
+	connect := func() (net.Conn, chan struct{}) {
+		srv, cli := net.Pipe()
+		t.Cleanup(func() { cli.Close() })
+		client := ClientFromConn(&addrConn{Conn: srv, addr: addr}, s, s)
+		stopped := make(chan struct{})
+		go func() {
+			client.Start()
+			close(stopped)
+		}()
+		return cli, stopped
+	}
+	send := func(cli net.Conn, pdu PDU) {
+		if _, err := cli.Write(pdu.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// No Data Available does not end the session
+	cli, stopped := connect()
+	send(cli, &PDUErrorReport{Version: PROTOCOL_VERSION_1, ErrorCode: PDU_ERROR_NODATA, ErrorMsg: "no data"})
+	send(cli, &PDUResetQuery{Version: PROTOCOL_VERSION_1})
+	select {
+	case <-h.resets:
+	case <-stopped:
+		t.Fatal("Wanted the session to continue after No Data Available")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reset Query not handled")
+	}
+
+	// A data error ends the session, and the router gets a Cache Reset when
+	// it reconnects
+	pduCopy := (&PDUIPv4Prefix{Version: PROTOCOL_VERSION_1, Prefix: netip.MustParsePrefix("192.0.2.0/24"), MaxLen: 24, ASN: 64496}).Bytes()
+	send(cli, &PDUErrorReport{Version: PROTOCOL_VERSION_1, ErrorCode: PDU_ERROR_WITHDRAWUNKNOWN, PDUCopy: pduCopy, ErrorMsg: "unknown"})
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wanted the session to end after Withdrawal of Unknown Record")
+	}
+
+	cli, _ = connect()
+	send(cli, &PDUSerialQuery{Version: PROTOCOL_VERSION_1, SerialNumber: 42})
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	pdu, err := Decode(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pdu.(*PDUCacheReset); !ok {
+		t.Errorf("Wanted a Cache Reset, but got %v", pdu)
+	}
+
+	rec := httptest.NewRecorder()
+	s.GetErrorReports(rec, httptest.NewRequest("GET", "/clients/errors", nil))
+	var reports []ReceivedErrorReport
+	if err := json.NewDecoder(rec.Body).Decode(&reports); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("Wanted 2 reports, but got %+v", reports)
+	}
+	if reports[0].Code != PDU_ERROR_NODATA || reports[1].Error != "Withdrawal of Unknown Record" || reports[1].Message != "unknown" {
+		t.Errorf("Unexpected reports %+v", reports)
+	}
+
+	// A Reset Query clears the pending Cache Reset
+	cli, stopped = connect()
+	send(cli, &PDUErrorReport{Version: PROTOCOL_VERSION_1, ErrorCode: PDU_ERROR_DUPANNOUNCE, PDUCopy: pduCopy})
+	<-stopped
+	cli, _ = connect()
+	send(cli, &PDUResetQuery{Version: PROTOCOL_VERSION_1})
+	select {
+	case <-h.resets:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reset Query not handled")
+	}
+	srv, other := net.Pipe()
+	defer other.Close()
+	if s.errorReports.takeReset(ClientFromConn(&addrConn{Conn: srv, addr: addr}, nil, nil)) {
+		t.Error("Wanted the Cache Reset to be cleared by the Reset Query")
+	}
+}
+
+func TestErrorReportsHistory(t *testing.T) {
+	e := newErrorReports()
+	newClient := func(addr net.Addr, sshUser string) *Client {
+		srv, cli := net.Pipe()
+		t.Cleanup(func() { cli.Close() })
+		if addr == nil {
+			return ClientFromConn(srv, nil, nil)
+		}
+		c := ClientFromConn(&addrConn{Conn: srv, addr: addr}, nil, nil)
+		c.sshUser = sshUser
+		return c
+	}
+	addr := net.TCPAddrFromAddrPort(netip.MustParseAddrPort("192.0.2.1:323"))
+
+	client := newClient(addr, "edge1")
+	for i := 0; i < errorReportHistory+5; i++ {
+		e.add(client, &PDUErrorReport{ErrorCode: uint16(i)}, i == 0)
+	}
+	reports := e.router(newClient(addr, "edge1"))
+	if len(reports) != errorReportHistory || reports[0].Code != 5 {
+		t.Errorf("Wanted the last %d reports, but got %+v", errorReportHistory, reports)
+	}
+
+	// Another router behind the same address
+	other := newClient(addr, "edge2")
+	if reports := e.router(other); len(reports) != 0 || e.takeReset(other) {
+		t.Errorf("Wanted no reports for another router, but got %+v", reports)
+	}
+	if !e.takeReset(client) || e.takeReset(client) {
+		t.Error("Wanted a single Cache Reset")
+	}
+
+	// Clients without an address do not share their reports
+	unix1, unix2 := newClient(nil, ""), newClient(nil, "")
+	e.add(unix1, &PDUErrorReport{ErrorCode: PDU_ERROR_WITHDRAWUNKNOWN}, true)
+	if len(e.router(unix1)) != 1 || len(e.router(unix2)) != 0 {
+		t.Error("Wanted the reports to be kept by connection without an address")
+	}
+	if e.takeReset(unix1) {
+		t.Error("Wanted no Cache Reset without an address")
+	}
+}
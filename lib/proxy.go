@@ -0,0 +1,227 @@
+package rtrlib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time allowed to read the PROXY protocol header by default
+const defaultProxyHeaderTimeout = 5 * time.Second
+
+const (
+	// Maximum length of a v1 header, including the CRLF
+	proxyV1MaxLen = 107
+
+	proxyV2Local = 0x0
+	proxyV2Proxy = 0x1
+
+	proxyV2Unspec = 0x00
+	proxyV2TCP4   = 0x11
+	proxyV2TCP6   = 0x21
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocol enables the PROXY protocol (v1 and v2) on the listeners of a
+// transport: the connections start with a header giving the address of the
+// router, which is used instead of the address of the proxy for the ACLs,
+// the connection limits, the views and the logs.
+type ProxyProtocol struct {
+	// Proxies allowed to connect. The connections from other addresses are
+	// rejected, except the ones without an IP address (eg: Unix sockets).
+	Trusted []netip.Prefix
+	// Time allowed to read the header (0 for the default of 5 seconds)
+	HeaderTimeout time.Duration
+}
+
+// TrustedConn tells whether the connection comes from a trusted proxy.
+func (p *ProxyProtocol) TrustedConn(conn net.Conn) bool {
+	addr, ok := connAddr(conn.RemoteAddr())
+	if !ok {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, prefix := range p.Trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn is a connection whose addresses are given by a PROXY protocol
+// header.
+type proxyConn struct {
+	net.Conn
+	// Data received after the header, then the connection
+	r      io.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+func (c *proxyConn) RemoteAddr() net.Addr       { return c.remote }
+func (c *proxyConn) LocalAddr() net.Addr        { return c.local }
+
+// readHeader reads the PROXY protocol header at the start of the connection.
+// The connections of a proxy checking the health of the server (command
+// LOCAL in v2, protocol UNKNOWN in v1) keep their addresses.
+func (p *ProxyProtocol) readHeader(conn net.Conn) (*proxyConn, error) {
+	timeout := p.HeaderTimeout
+	if timeout <= 0 {
+		timeout = defaultProxyHeaderTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	br := bufio.NewReaderSize(conn, 256)
+	start, err := br.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	pc := &proxyConn{
+		Conn:   conn,
+		remote: conn.RemoteAddr(),
+		local:  conn.LocalAddr(),
+	}
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		err = pc.readV2(br)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		err = pc.readV1(br)
+	default:
+		err = errors.New("no PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pc.r = conn
+	if n := br.Buffered(); n > 0 {
+		buffered, _ := br.Peek(n)
+		pc.r = io.MultiReader(bytes.NewReader(bytes.Clone(buffered)), conn)
+	}
+	return pc, nil
+}
+
+// readV1 reads a header like "PROXY TCP4 192.0.2.1 198.51.100.1 65000 323\r\n".
+func (pc *proxyConn) readV1(br *bufio.Reader) error {
+	line, err := br.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) || len(line) > proxyV1MaxLen {
+		return fmt.Errorf("v1 header longer than %d bytes", proxyV1MaxLen)
+	} else if err != nil {
+		return err
+	}
+	header, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return errors.New("v1 header not terminated by CRLF")
+	}
+	fields := strings.Split(header, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("invalid v1 header %q", header)
+	}
+
+	var addrs [2]netip.AddrPort
+	for i := range addrs {
+		addr, err := netip.ParseAddr(fields[2+i])
+		if err != nil {
+			return fmt.Errorf("v1 header: %w", err)
+		}
+		if addr.Is4() != (fields[1] == "TCP4") || addr.Zone() != "" {
+			return fmt.Errorf("v1 header: address %v is not %s", addr, fields[1])
+		}
+		port := fields[4+i]
+		value, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || (len(port) > 1 && port[0] == '0') {
+			return fmt.Errorf("v1 header: invalid port %q", port)
+		}
+		addrs[i] = netip.AddrPortFrom(addr, uint16(value))
+	}
+	pc.remote = net.TCPAddrFromAddrPort(addrs[0])
+	pc.local = net.TCPAddrFromAddrPort(addrs[1])
+	return nil
+}
+
+// readV2 reads a binary header: the signature, the version and command, the
+// family, the length of the addresses and the addresses, followed by TLVs.
+func (pc *proxyConn) readV2(br *bufio.Reader) error {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return err
+	}
+	versionCommand, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return err
+	}
+	if versionCommand>>4 != 2 {
+		return fmt.Errorf("v2 header: unsupported version %d", versionCommand>>4)
+	}
+	switch versionCommand & 0xf {
+	case proxyV2Local:
+		return nil
+	case proxyV2Proxy:
+	default:
+		return fmt.Errorf("v2 header: unknown command %d", versionCommand&0xf)
+	}
+
+	var src, dst netip.Addr
+	var ports, tlvs []byte
+	switch family {
+	case proxyV2Unspec:
+		return nil
+	case proxyV2TCP4:
+		if len(payload) < 12 {
+			return errors.New("v2 header: truncated IPv4 addresses")
+		}
+		src, dst = netip.AddrFrom4([4]byte(payload[0:4])), netip.AddrFrom4([4]byte(payload[4:8]))
+		ports, tlvs = payload[8:12], payload[12:]
+	case proxyV2TCP6:
+		if len(payload) < 36 {
+			return errors.New("v2 header: truncated IPv6 addresses")
+		}
+		src, dst = netip.AddrFrom16([16]byte(payload[0:16])), netip.AddrFrom16([16]byte(payload[16:32]))
+		ports, tlvs = payload[32:36], payload[36:]
+	default:
+		return fmt.Errorf("v2 header: unsupported family 0x%02x", family)
+	}
+	// The TLVs are not used but must be well formed
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return errors.New("v2 header: truncated TLV")
+		}
+		n := 3 + int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < n {
+			return errors.New("v2 header: truncated TLV")
+		}
+		tlvs = tlvs[n:]
+	}
+	pc.remote = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(ports[0:2])))
+	pc.local = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, binary.BigEndian.Uint16(ports[2:4])))
+	return nil
+}
+
+// netConn returns the network connection under the TLS and PROXY protocol
+// layers.
+func netConn(conn net.Conn) net.Conn {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if pc, ok := conn.(*proxyConn); ok {
+		conn = pc.Conn
+	}
+	return conn
+}
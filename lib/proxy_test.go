@@ -0,0 +1,228 @@
+package rtrlib
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// proxyV2Header builds a v2 header for the addresses, followed by the TLVs.
+func proxyV2Header(command byte, src, dst netip.AddrPort, tlvs []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command)
+	var addrs []byte
+	if src.Addr().Is4() {
+		header = append(header, proxyV2TCP4)
+		addrs = append(addrs, src.Addr().AsSlice()...)
+		addrs = append(addrs, dst.Addr().AsSlice()...)
+	} else {
+		header = append(header, proxyV2TCP6)
+		addrs = append(addrs, src.Addr().AsSlice()...)
+		addrs = append(addrs, dst.Addr().AsSlice()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, src.Port())
+	addrs = binary.BigEndian.AppendUint16(addrs, dst.Port())
+	addrs = append(addrs, tlvs...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src4, dst4 := netip.MustParseAddrPort("192.0.2.1:65000"), netip.MustParseAddrPort("198.51.100.1:323")
+	src6, dst6 := netip.MustParseAddrPort("[2001:db8::1]:65000"), netip.MustParseAddrPort("[2001:db8::2]:323")
+	local := proxyV2Header(proxyV2Local, src4, dst4, nil)
+	truncated := proxyV2Header(proxyV2Proxy, src4, dst4, nil)
+	binary.BigEndian.PutUint16(truncated[14:], 8)
+	udp := proxyV2Header(proxyV2Proxy, src4, dst4, nil)
+	udp[13] = 0x12
+
+	tests := []struct {
+		desc   string
+		header string
+		remote string // empty for the address of the proxy, "error" for an error
+	}{
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 198.51.100.1 65000 323\r\n", "192.0.2.1:65000"},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 65000 323\r\n", "[2001:db8::1]:65000"},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", ""},
+		{"v1 UNKNOWN with addresses", "PROXY UNKNOWN 2001:db8::1 2001:db8::2 65000 323\r\n", ""},
+		{"v2 TCP4", string(proxyV2Header(proxyV2Proxy, src4, dst4, nil)), "192.0.2.1:65000"},
+		{"v2 TCP6 with TLVs", string(proxyV2Header(proxyV2Proxy, src6, dst6, []byte{0x04, 0x00, 0x01, 0xff, 0x01, 0x00, 0x00})), "[2001:db8::1]:65000"},
+		{"v2 LOCAL", string(local), ""},
+
+		{"No header", "\x00\x08\x00\x00\x00\x00\x00\x08rtr", "error"},
+		{"v1 without CRLF", "PROXY TCP4 192.0.2.1 198.51.100.1 65000 323\n", "error"},
+		{"v1 too long", "PROXY UNKNOWN " + string(make([]byte, 100)) + "\r\n", "error"},
+		{"v1 unknown protocol", "PROXY UDP4 192.0.2.1 198.51.100.1 65000 323\r\n", "error"},
+		{"v1 wrong family", "PROXY TCP4 2001:db8::1 2001:db8::2 65000 323\r\n", "error"},
+		{"v1 invalid address", "PROXY TCP4 192.0.2.256 198.51.100.1 65000 323\r\n", "error"},
+		{"v1 invalid port", "PROXY TCP4 192.0.2.1 198.51.100.1 65536 323\r\n", "error"},
+		{"v1 port with leading zero", "PROXY TCP4 192.0.2.1 198.51.100.1 065000 323\r\n", "error"},
+		{"v1 double space", "PROXY TCP4  192.0.2.1 198.51.100.1 65000 323\r\n", "error"},
+		{"v1 missing port", "PROXY TCP4 192.0.2.1 198.51.100.1 65000\r\n", "error"},
+		{"v2 version 1", string(append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0, 0)), "error"},
+		{"v2 unknown command", string(append(append([]byte{}, proxyV2Signature...), 0x22, 0x11, 0, 0)), "error"},
+		{"v2 truncated addresses", string(truncated), "error"},
+		{"v2 UDP", string(udp), "error"},
+		{"v2 truncated TLV", string(proxyV2Header(proxyV2Proxy, src4, dst4, []byte{0x04, 0x00, 0x02, 0xff})), "error"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			proxy, router := net.Pipe()
+			defer proxy.Close()
+			defer router.Close()
+			go func() {
+				proxy.Write([]byte(tc.header + "data"))
+			}()
+
+			conn, err := (&ProxyProtocol{HeaderTimeout: time.Second}).readHeader(router)
+			if tc.remote == "error" {
+				if err == nil {
+					t.Errorf("Wanted an error, but got a connection from %v", conn.RemoteAddr())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tc.remote
+			if want == "" {
+				want = router.RemoteAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != want {
+				t.Errorf("Wanted remote address %s, but got %s", want, got)
+			}
+			data := make([]byte, 4)
+			if _, err := io.ReadFull(conn, data); err != nil || string(data) != "data" {
+				t.Errorf("Wanted the data following the header, but got %q (%v)", data, err)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderTimeout(t *testing.T) {
+	proxy, router := net.Pipe()
+	defer proxy.Close()
+	defer router.Close()
+	go proxy.Write([]byte("PROXY TCP4 "))
+	if _, err := (&ProxyProtocol{HeaderTimeout: 50 * time.Millisecond}).readHeader(router); err == nil {
+		t.Error("Wanted an error for an incomplete header")
+	}
+}
+
+func TestServeProxyProtocol(t *testing.T) {
+	h := &rejectingEventHandler{rejected: make(chan RejectReason, 1)}
+	s := NewServer(ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_1}, h, nil)
+	s.SetProxyProtocol(TransportTCP, &ProxyProtocol{Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}})
+	s.SetACL(TransportTCP, &ACL{Rules: []ACLRule{{Allow: false, Prefix: netip.MustParsePrefix("192.0.2.66/32")}}})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- s.Serve(l, TransportTCP)
+	}()
+	defer func() {
+		s.Shutdown(context.Background())
+		<-served
+	}()
+	dial := func(header string) net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		if _, err := conn.Write([]byte(header)); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	wantRejected := func(want RejectReason) {
+		t.Helper()
+		select {
+		case reason := <-h.rejected:
+			if reason != want {
+				t.Errorf("Wanted the connection to be rejected with %v, but got %v", want, reason)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Connection not rejected")
+		}
+	}
+
+	dial("PROXY TCP4 192.0.2.1 198.51.100.1 65000 323\r\n")
+	var clients []*Client
+	for deadline := time.Now().Add(5 * time.Second); len(clients) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		clients = s.GetClientList()
+	}
+	if len(clients) != 1 {
+		t.Fatalf("Wanted 1 client, but got %d", len(clients))
+	}
+	if addr := clients[0].GetRemoteAddress().String(); addr != "192.0.2.1:65000" {
+		t.Errorf("Wanted the address of the router, but got %s", addr)
+	}
+
+	// The ACL applies to the address of the router
+	dial("PROXY TCP4 192.0.2.66 198.51.100.1 65000 323\r\n")
+	wantRejected(RejectACL)
+
+	dial("PROXY TCP4 192.0.2.1\r\n")
+	wantRejected(RejectProxyHeader)
+
+	s.SetProxyProtocol(TransportTCP, &ProxyProtocol{Trusted: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}})
+	dial("PROXY TCP4 192.0.2.1 198.51.100.1 65000 323\r\n")
+	wantRejected(RejectProxyUntrusted)
+}
+
+func TestServeProxyProtocolTLS(t *testing.T) {
+	ca := newTestCertificate(t, "Test CA", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	s := NewServer(ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_1}, nil, nil)
+	s.SetProxyProtocol(TransportTLS, &ProxyProtocol{Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}})
+	s.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{newTestCertificate(t, "server", &ca)}})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- s.Serve(l, TransportTLS)
+	}()
+	defer func() {
+		s.Shutdown(context.Background())
+		<-served
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	src, dst := netip.MustParseAddrPort("[2001:db8::1]:65000"), netip.MustParseAddrPort("[2001:db8::2]:323")
+	if _, err := conn.Write(proxyV2Header(proxyV2Proxy, src, dst, nil)); err != nil {
+		t.Fatal(err)
+	}
+	tc := tls.Client(conn, &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"})
+	if err := tc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	var clients []*Client
+	for deadline := time.Now().Add(5 * time.Second); len(clients) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		clients = s.GetClientList()
+	}
+	if len(clients) != 1 {
+		t.Fatalf("Wanted 1 client, but got %d", len(clients))
+	}
+	if addr := clients[0].GetRemoteAddress().String(); addr != src.String() {
+		t.Errorf("Wanted the address of the router, but got %s", addr)
+	}
+}
@@ -0,0 +1,145 @@
+package rtrlib
+
+import (
+	"sync"
+)
+
+// Default size of the PDUs queued for a client, see ServerConfiguration
+const defaultSendQueueSize = 4 << 20
+
+// SlowClientPolicy selects what happens to a Serial Notify sent to a client
+// whose send queue is full. Responses to the queries of the client wait for
+// room in the queue instead: with a write timeout, a client that stops
+// reading is eventually disconnected.
+type SlowClientPolicy int
+
+const (
+	// SlowClientDisconnect disconnects the client.
+	SlowClientDisconnect SlowClientPolicy = iota
+	// SlowClientDropNotify drops the Serial Notify: the client gets the
+	// changes with its next query.
+	SlowClientDropNotify
+)
+
+func (p SlowClientPolicy) String() string {
+	switch p {
+	case SlowClientDisconnect:
+		return "disconnect"
+	case SlowClientDropNotify:
+		return "drop-notify"
+	default:
+		return "unknown"
+	}
+}
+
+// A RTRServerEventHandler can also implement this interface to be told about
+// the clients that cannot keep up with the PDUs sent to them.
+type SlowClientHandler interface {
+	// ClientSlow is called when a client is disconnected because a write
+	// timed out or its queue is full, or when a Serial Notify is dropped.
+	ClientSlow(c *Client, disconnected bool)
+}
+
+// sendQueue holds the PDUs waiting to be written to a client. It is bounded
+// by the size of the PDUs rather than by their number: a PDU that does not
+// fit is refused, unless the queue is empty.
+type sendQueue struct {
+	lock sync.Mutex
+	// PDUs are taken from out and appended to in, which replaces out once
+	// it is consumed: both arrays are reused.
+	out   []queuedPDU
+	next  int
+	in    []queuedPDU
+	size  int
+	limit int
+	ready chan struct{} // holds a value when PDUs were queued
+	room  chan struct{} // closed when PDUs are taken after a PDU was refused
+	full  bool
+}
+
+type queuedPDU struct {
+	pdu  PDU
+	size int
+}
+
+func newSendQueue(limit int) *sendQueue {
+	return &sendQueue{
+		limit: limit,
+		ready: make(chan struct{}, 1),
+		room:  make(chan struct{}),
+	}
+}
+
+// push queues the PDU if it fits. Otherwise it returns a channel closed once
+// PDUs are taken from the queue.
+func (q *sendQueue) push(pdu PDU) (bool, <-chan struct{}) {
+	size := pduLength(pdu)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.len() > 0 && q.size+size > q.limit {
+		q.full = true
+		return false, q.room
+	}
+	q.in = append(q.in, queuedPDU{pdu: pdu, size: size})
+	q.size += size
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// pop takes the first PDU of the queue.
+func (q *sendQueue) pop() (PDU, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.next == len(q.out) {
+		if len(q.in) == 0 {
+			return nil, false
+		}
+		clear(q.out)
+		q.out, q.in, q.next = q.in, q.out[:0], 0
+	}
+	first := q.out[q.next]
+	q.next++
+	q.size -= first.size
+	if q.full {
+		close(q.room)
+		q.room = make(chan struct{})
+		q.full = false
+	}
+	return first.pdu, true
+}
+
+// queued returns the number of PDUs and bytes in the queue.
+func (q *sendQueue) queued() (int, int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.len(), q.size
+}
+
+func (q *sendQueue) len() int {
+	return len(q.out) - q.next + len(q.in)
+}
+
+// pduLength returns the size of the PDU on the wire.
+func pduLength(pdu PDU) int {
+	switch pdu := pdu.(type) {
+	case *encodedPDUs:
+		return len(pdu.data)
+	case *PDUIPv4Prefix:
+		return 20
+	case *PDUIPv6Prefix:
+		return 32
+	case *PDUCacheResponse, *PDUCacheReset, *PDUResetQuery:
+		return 8
+	case *PDUSerialNotify, *PDUSerialQuery:
+		return 12
+	case *PDURouterKey:
+		return 32 + len(pdu.SubjectPublicKeyInfo)
+	case *PDUASPA:
+		return 12 + 4*len(pdu.ProviderASNumbers)
+	default:
+		return len(pdu.Bytes())
+	}
+}
@@ -0,0 +1,88 @@
+package rtrlib
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestSendQueue(t *testing.T) {
+	q := newSendQueue(20)
+	notify := &PDUSerialNotify{}
+
+	if ok, _ := q.push(notify); !ok {
+		t.Fatal("Wanted the first PDU to be queued")
+	}
+	ok, room := q.push(notify)
+	if ok {
+		t.Fatal("Wanted the second PDU to be refused")
+	}
+	if n, size := q.queued(); n != 1 || size != 12 {
+		t.Errorf("Wanted 1 PDU of 12 bytes, but got %d PDUs of %d bytes", n, size)
+	}
+
+	if pdu, ok := q.pop(); !ok || pdu != notify {
+		t.Errorf("Wanted the queued PDU, but got %v (%v)", pdu, ok)
+	}
+	select {
+	case <-room:
+	default:
+		t.Error("Wanted room once the PDU was taken")
+	}
+	if _, ok := q.pop(); ok {
+		t.Error("Wanted the queue to be empty")
+	}
+
+	// A PDU larger than the queue is accepted when it is empty
+	large := &encodedPDUs{data: make([]byte, 100)}
+	if ok, _ := q.push(large); !ok {
+		t.Error("Wanted a large PDU to be queued in an empty queue")
+	}
+	if ok, _ := q.push(notify); ok {
+		t.Error("Wanted a PDU to be refused after a large one")
+	}
+}
+
+func TestSendQueueOrder(t *testing.T) {
+	q := newSendQueue(1 << 20)
+	for i := uint32(0); i < 10; i++ {
+		q.push(&PDUSerialNotify{SerialNumber: i})
+		if i%3 == 0 {
+			// Interleaves pushes and pops, swapping the arrays
+			q.pop()
+		}
+	}
+	var got []uint32
+	for pdu, ok := q.pop(); ok; pdu, ok = q.pop() {
+		got = append(got, pdu.(*PDUSerialNotify).SerialNumber)
+	}
+	want := []uint32{4, 5, 6, 7, 8, 9}
+	if len(got) != len(want) {
+		t.Fatalf("Wanted %v, but got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Wanted %v, but got %v", want, got)
+		}
+	}
+}
+
+func TestPDULength(t *testing.T) {
+	pdus := []PDU{
+		&PDUIPv4Prefix{Prefix: netip.MustParsePrefix("192.0.2.0/24")},
+		&PDUIPv6Prefix{Prefix: netip.MustParsePrefix("2001:db8::/32")},
+		&PDUCacheResponse{},
+		&PDUCacheReset{},
+		&PDUResetQuery{},
+		&PDUSerialNotify{},
+		&PDUSerialQuery{},
+		&PDURouterKey{SubjectKeyIdentifier: make([]byte, 20), SubjectPublicKeyInfo: make([]byte, 91)},
+		&PDUASPA{Version: PROTOCOL_VERSION_2, ProviderASNumbers: []uint32{64496, 64497}},
+		&PDUEndOfData{Version: PROTOCOL_VERSION_1},
+		&PDUErrorReport{ErrorMsg: "error"},
+	}
+	for _, pdu := range pdus {
+		if got, want := pduLength(pdu), len(pdu.Bytes()); got != want {
+			t.Errorf("Wanted length %d for %v, but got %d", want, pdu, got)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package rtrlib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+const (
+	pduHeaderSize     = 8
+	pduReaderInitSize = 8192
+	// Same limit as bufio.Reader
+	maxConsecutiveEmptyReads = 100
+)
+
+var ErrInvalidPDULength = errors.New("invalid PDU length")
+
+// PDUReader splits a stream into PDUs using the length field of the header.
+// Partial PDUs are buffered until the rest arrives and several PDUs received
+// in a single read are returned one after the other without reading again.
+type PDUReader struct {
+	rd  io.Reader
+	buf []byte
+	r   int // start of the unread data in buf
+	w   int // end of the unread data in buf
+	err error
+}
+
+func NewPDUReader(rd io.Reader) *PDUReader {
+	return &PDUReader{
+		rd:  rd,
+		buf: make([]byte, pduReaderInitSize),
+	}
+}
+
+// Buffered returns the number of bytes that have been read from the stream
+// but not yet returned as a PDU.
+func (r *PDUReader) Buffered() int {
+	return r.w - r.r
+}
+
+// NextFrame returns the raw bytes of the next PDU (including its header).
+// The returned slice is only valid until the next call to NextFrame or Next.
+func (r *PDUReader) NextFrame() ([]byte, error) {
+	for {
+		if n := r.w - r.r; n >= pduHeaderSize {
+			length := binary.BigEndian.Uint32(r.buf[r.r+4 : r.r+8])
+			// The stream cannot be framed anymore: only the header can be reported
+			if length < pduHeaderSize {
+				return nil, r.lengthError(fmt.Errorf("%w: %d < %d", ErrInvalidPDULength, length, pduHeaderSize))
+			}
+			if length > messageMaxSize {
+				return nil, r.lengthError(fmt.Errorf("%w: %d > %d", ErrInvalidPDULength, length, messageMaxSize))
+			}
+			if n >= int(length) {
+				frame := r.buf[r.r : r.r+int(length)]
+				r.r += int(length)
+				return frame, nil
+			}
+			r.reserve(int(length))
+		}
+
+		if err := r.fill(); err != nil {
+			if err == io.EOF && r.Buffered() > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+}
+
+func (r *PDUReader) lengthError(err error) *DecodeError {
+	return &DecodeError{
+		Code: PDU_ERROR_CORRUPTDATA,
+		PDU:  slices.Clone(r.buf[r.r : r.r+pduHeaderSize]),
+		Err:  err,
+	}
+}
+
+// Next decodes the next PDU of the stream.
+func (r *PDUReader) Next() (PDU, error) {
+	frame, err := r.NextFrame()
+	if err != nil {
+		return nil, err
+	}
+	return DecodeBytes(frame)
+}
+
+// reserve makes sure a PDU of the given size starting at the current read
+// position fits in the buffer.
+func (r *PDUReader) reserve(size int) {
+	if len(r.buf)-r.r >= size {
+		return
+	}
+	if size > len(r.buf) {
+		buf := make([]byte, max(size, 2*len(r.buf)))
+		r.w = copy(buf, r.buf[r.r:r.w])
+		r.r = 0
+		r.buf = buf
+		return
+	}
+	r.compact()
+}
+
+func (r *PDUReader) compact() {
+	r.w = copy(r.buf, r.buf[r.r:r.w])
+	r.r = 0
+}
+
+func (r *PDUReader) fill() error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.r == r.w {
+		r.r, r.w = 0, 0
+	} else if r.w == len(r.buf) {
+		r.compact()
+	}
+
+	// Readers may return no data and no error, give up only if they keep
+	// doing so.
+	for i := 0; i < maxConsecutiveEmptyReads; i++ {
+		n, err := r.rd.Read(r.buf[r.w:])
+		r.w += n
+		if err != nil {
+			// Bytes received along with an error are processed first,
+			// the error is returned on the next read.
+			r.err = err
+			if n > 0 {
+				return nil
+			}
+			return err
+		}
+		if n > 0 {
+			return nil
+		}
+	}
+	return io.ErrNoProgress
+}
@@ -0,0 +1,195 @@
+package rtrlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+	"testing"
+	"testing/iotest"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var prefixComparer = cmp.Comparer(func(x, y netip.Prefix) bool {
+	return x == y
+})
+
+func readAllPDUs(t *testing.T, rd *PDUReader) []PDU {
+	t.Helper()
+	pdus := make([]PDU, 0)
+	for {
+		pdu, err := rd.Next()
+		if err == io.EOF {
+			return pdus
+		}
+		if err != nil {
+			t.Fatalf("unexpected error after %d PDUs: %v", len(pdus), err)
+		}
+		pdus = append(pdus, pdu)
+	}
+}
+
+func testPDUs() []PDU {
+	return []PDU{
+		&PDUResetQuery{Version: PROTOCOL_VERSION_1},
+		&PDUSerialQuery{Version: PROTOCOL_VERSION_1, SessionId: 123, SerialNumber: 456},
+		&PDUIPv6Prefix{
+			Version: PROTOCOL_VERSION_1,
+			Prefix:  netip.MustParsePrefix("2001:db8::/32"),
+			MaxLen:  48,
+			ASN:     64496,
+			Flags:   FLAG_ADDED,
+		},
+		&PDURouterKey{
+			Version:              PROTOCOL_VERSION_1,
+			Flags:                FLAG_ADDED,
+			SubjectKeyIdentifier: bytes.Repeat([]byte{0x01}, 20),
+			ASN:                  64497,
+			// Larger than the initial buffer of the reader
+			SubjectPublicKeyInfo: bytes.Repeat([]byte{0x02}, 3*pduReaderInitSize),
+		},
+		&PDUEndOfData{Version: PROTOCOL_VERSION_1, SessionId: 123, SerialNumber: 457},
+	}
+}
+
+func concatPDUs(pdus []PDU) []byte {
+	buf := bytes.NewBuffer(nil)
+	for _, pdu := range pdus {
+		pdu.Write(buf)
+	}
+	return buf.Bytes()
+}
+
+func TestPDUReaderCoalesced(t *testing.T) {
+	want := testPDUs()
+	got := readAllPDUs(t, NewPDUReader(bytes.NewReader(concatPDUs(want))))
+
+	if diff := cmp.Diff(want, got, prefixComparer); diff != "" {
+		t.Fatalf("unexpected PDUs (-want +got):\n%s", diff)
+	}
+}
+
+func TestPDUReaderFragmented(t *testing.T) {
+	want := testPDUs()
+	got := readAllPDUs(t, NewPDUReader(iotest.OneByteReader(bytes.NewReader(concatPDUs(want)))))
+
+	if diff := cmp.Diff(want, got, prefixComparer); diff != "" {
+		t.Fatalf("unexpected PDUs (-want +got):\n%s", diff)
+	}
+}
+
+func TestPDUReaderDataErr(t *testing.T) {
+	want := testPDUs()
+	got := readAllPDUs(t, NewPDUReader(iotest.DataErrReader(bytes.NewReader(concatPDUs(want)))))
+
+	if diff := cmp.Diff(want, got, prefixComparer); diff != "" {
+		t.Fatalf("unexpected PDUs (-want +got):\n%s", diff)
+	}
+}
+
+// emptyReadReader returns an empty read without error between PDUs.
+type emptyReadReader struct {
+	pdus  [][]byte
+	empty bool
+}
+
+func (r *emptyReadReader) Read(p []byte) (int, error) {
+	if len(r.pdus) == 0 {
+		return 0, io.EOF
+	}
+	if r.empty = !r.empty; r.empty {
+		return 0, nil
+	}
+	n := copy(p, r.pdus[0])
+	if r.pdus[0] = r.pdus[0][n:]; len(r.pdus[0]) == 0 {
+		r.pdus = r.pdus[1:]
+	}
+	return n, nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	return 0, nil
+}
+
+func TestPDUReaderEmptyReads(t *testing.T) {
+	want := testPDUs()
+	rd := &emptyReadReader{}
+	for _, pdu := range want {
+		rd.pdus = append(rd.pdus, pdu.Bytes())
+	}
+	got := readAllPDUs(t, NewPDUReader(rd))
+
+	if diff := cmp.Diff(want, got, prefixComparer); diff != "" {
+		t.Fatalf("unexpected PDUs (-want +got):\n%s", diff)
+	}
+
+	if _, err := NewPDUReader(zeroReader{}).Next(); err != io.ErrNoProgress {
+		t.Fatalf("Wanted error (%v), but got (%v)", io.ErrNoProgress, err)
+	}
+}
+
+func TestPDUReaderErrors(t *testing.T) {
+	header := func(length uint32) []byte {
+		b := []byte{PROTOCOL_VERSION_1, PDU_ID_RESET_QUERY, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[4:], length)
+		return b
+	}
+
+	tests := []struct {
+		desc string
+		data []byte
+		want error
+	}{{
+		desc: "Oversized PDU",
+		data: header(messageMaxSize + 1),
+		want: ErrInvalidPDULength,
+	}, {
+		desc: "Length smaller than header",
+		data: header(4),
+		want: ErrInvalidPDULength,
+	}, {
+		desc: "Truncated header",
+		data: header(8)[:5],
+		want: io.ErrUnexpectedEOF,
+	}, {
+		desc: "Truncated PDU",
+		data: append(header(12), 0, 0),
+		want: io.ErrUnexpectedEOF,
+	}, {
+		desc: "Empty stream",
+		data: []byte{},
+		want: io.EOF,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			rd := NewPDUReader(bytes.NewReader(tc.data))
+			_, err := rd.NextFrame()
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("Wanted error (%v), but got (%v)", tc.want, err)
+			}
+		})
+	}
+}
+
+func TestPDUReaderBuffered(t *testing.T) {
+	first := &PDUResetQuery{Version: PROTOCOL_VERSION_1}
+	second := &PDUCacheReset{Version: PROTOCOL_VERSION_1}
+	data := concatPDUs([]PDU{first, second})
+
+	rd := NewPDUReader(bytes.NewReader(data[:len(data)-3]))
+	pdu, err := rd.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(pdu, PDU(first)) {
+		t.Fatalf("Wanted (%+v), but got (%+v)", first, pdu)
+	}
+	if rd.Buffered() != 5 {
+		t.Fatalf("Wanted 5 buffered bytes, but got %d", rd.Buffered())
+	}
+}
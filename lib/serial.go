@@ -0,0 +1,22 @@
+package rtrlib
+
+// Serial numbers wrap around at 2^32 and are compared using the serial
+// number arithmetic of RFC 1982 (with SERIAL_BITS = 32) as required by
+// RFC 8210. Incrementing a uint32 serial already follows its addition.
+
+const serialHalf = 1 << 31
+
+// SerialLess reports whether serial a comes before serial b. Serials that
+// are exactly 2^31 apart cannot be compared: neither comes before the other.
+func SerialLess(a, b uint32) bool {
+	return a != b && b-a < serialHalf
+}
+
+// SerialDistance returns the number of increments needed to go from serial
+// from to serial to. It returns false if to does not come after from.
+func SerialDistance(from, to uint32) (uint32, bool) {
+	if from != to && !SerialLess(from, to) {
+		return 0, false
+	}
+	return to - from, true
+}
@@ -0,0 +1,56 @@
+package rtrlib
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSerialLess(t *testing.T) {
+	tests := []struct {
+		desc string
+		a, b uint32
+		want bool
+	}{
+		{"Equal", 5, 5, false},
+		{"Before", 5, 6, true},
+		{"After", 6, 5, false},
+		{"Before wrap", math.MaxUint32, 0, true},
+		{"After wrap", 0, math.MaxUint32, false},
+		{"Far before wrap", math.MaxUint32 - 10, 10, true},
+		{"Largest distance", 0, math.MaxInt32, true},
+		{"Largest distance reversed", math.MaxInt32, 0, false},
+		{"Not comparable", 0, 1 << 31, false},
+		{"Not comparable reversed", 1 << 31, 0, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := SerialLess(tc.a, tc.b); got != tc.want {
+				t.Errorf("SerialLess(%d, %d) = %v, want %v", tc.a, tc.b, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSerialDistance(t *testing.T) {
+	tests := []struct {
+		desc     string
+		from, to uint32
+		want     uint32
+		ok       bool
+	}{
+		{"Equal", 5, 5, 0, true},
+		{"Forward", 5, 8, 3, true},
+		{"Backward", 8, 5, 0, false},
+		{"Across wrap", math.MaxUint32 - 1, 2, 4, true},
+		{"Backward across wrap", 2, math.MaxUint32 - 1, 0, false},
+		{"Not comparable", 0, 1 << 31, 0, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, ok := SerialDistance(tc.from, tc.to)
+			if got != tc.want || ok != tc.ok {
+				t.Errorf("SerialDistance(%d, %d) = %d, %v, want %d, %v", tc.from, tc.to, got, ok, tc.want, tc.ok)
+			}
+		})
+	}
+}
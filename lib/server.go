@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -12,12 +14,61 @@ import (
 	"net"
 	"net/http"
 	"net/netip"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/sync/errgroup"
 )
 
+const (
+	// Time allowed to write the remaining PDUs when disconnecting a client
+	flushTimeout = 5 * time.Second
+
+	// Bounds of the delay between retries when accepting connections fails
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = 1 * time.Second
+
+	// Time allowed for the TLS handshake of a new connection
+	tlsHandshakeTimeout = 10 * time.Second
+
+	// Number of rotated session IDs for which routers get a Cache Reset
+	maxPrevSessions = 16
+
+	// Data PDUs are coalesced in a buffer up to this size before being written
+	sendBufferSize = 64 * 1024
+	// Buffers grown larger than this (eg: by a large Router Key) are not reused
+	maxPooledBufferSize = 4 * sendBufferSize
+)
+
+var sendBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, sendBufferSize)
+		return &buf
+	},
+}
+
+func getSendBuffer() *[]byte {
+	return sendBufferPool.Get().(*[]byte)
+}
+
+func putSendBuffer(buf *[]byte) {
+	if cap(*buf) > maxPooledBufferSize {
+		return
+	}
+	*buf = (*buf)[:0]
+	sendBufferPool.Put(buf)
+}
+
+// ErrServerClosed is returned by the Start functions after a call to Shutdown.
+var ErrServerClosed = errors.New("rtr: server closed")
+
+// ErrSerialNotAfter is returned by AddDataSerial for changed data whose serial
+// does not come after the current one.
+var ErrSerialNotAfter = errors.New("rtr: serial does not come after the current one")
+
 func GenerateSessionId() uint16 {
 	return uint16(rand.Intn(math.MaxUint16 + 1))
 }
@@ -53,6 +104,21 @@ type SendableDataManager interface {
 	GetSDsSerialDiff(uint32) ([]SendableData, bool)
 }
 
+// A SendableDataManager can also implement this interface to provide the data
+// already encoded as PDUs for a protocol version (with or without BGPsec keys).
+// The encoding is shared between the clients and returned with its serial.
+type SendableDataEncoder interface {
+	GetCurrentEncodedSDs(version uint8, bgpsec bool) ([]byte, uint32, bool)
+	GetEncodedSDsSerialDiff(serial uint32, version uint8, bgpsec bool) ([]byte, uint32, bool)
+}
+
+// A SendableDataManager can also implement this interface to recognize the
+// session IDs replaced by a rotation. Routers querying with one of them get a
+// Cache Reset instead of being disconnected.
+type SessionHistory interface {
+	IsPreviousSessionId(version uint8, sessionId uint16) bool
+}
+
 type DefaultRTREventHandler struct {
 	sdManager SendableDataManager
 	Log       Logger
@@ -62,19 +128,41 @@ func (e *DefaultRTREventHandler) SetSDManager(m SendableDataManager) {
 	e.sdManager = m
 }
 
+// manager returns the data served to the client: the one of its view, if any.
+func (e *DefaultRTREventHandler) manager(c *Client) SendableDataManager {
+	if v := c.GetView(); v != nil {
+		return v.Data
+	}
+	return e.sdManager
+}
+
 func (e *DefaultRTREventHandler) RequestCache(c *Client) {
 	if e.Log != nil {
 		e.Log.Debugf("%v > Request Cache", c)
 	}
-	sessionId := e.sdManager.GetSessionId(c.GetVersion())
-	serial, valid := e.sdManager.GetCurrentSerial()
+	sdManager := e.manager(c)
+	sessionId := sdManager.GetSessionId(c.GetVersion())
+	serial, valid := sdManager.GetCurrentSerial()
 	if !valid {
 		c.SendNoDataError()
 		if e.Log != nil {
 			e.Log.Debugf("%v < No data", c)
 		}
+	} else if encoder, ok := sdManager.(SendableDataEncoder); ok {
+		data, serial, exists := encoder.GetCurrentEncodedSDs(c.GetVersion(), !c.dontSendBGPsecKeys)
+		if !exists {
+			c.SendInternalError()
+			if e.Log != nil {
+				e.Log.Debugf("%v < Internal error requesting cache (does not exists)", c)
+			}
+		} else {
+			c.SendEncodedSDs(sessionId, serial, data)
+			if e.Log != nil {
+				e.Log.Debugf("%v < Sent cache (current serial %d, session: %d)", c, serial, sessionId)
+			}
+		}
 	} else {
-		data, exists := e.sdManager.GetCurrentSDs()
+		data, exists := sdManager.GetCurrentSDs()
 		if !exists {
 			c.SendInternalError()
 			if e.Log != nil {
@@ -93,23 +181,49 @@ func (e *DefaultRTREventHandler) RequestNewVersion(c *Client, sessionId uint16,
 	if e.Log != nil {
 		e.Log.Debugf("%v > Request New Version", c)
 	}
-	serverSessionId := e.sdManager.GetSessionId(c.GetVersion())
+	sdManager := e.manager(c)
+	serverSessionId := sdManager.GetSessionId(c.GetVersion())
+	if history, ok := sdManager.(SessionHistory); ok && sessionId != serverSessionId && history.IsPreviousSessionId(c.GetVersion(), sessionId) {
+		c.SendCacheReset()
+		if e.Log != nil {
+			e.Log.Debugf("%v < Sent cache reset (client asked for previous session %d, server is at %d)", c, sessionId, serverSessionId)
+		}
+		return
+	}
 	if sessionId != serverSessionId {
-		c.SendCorruptData()
+		query := &PDUSerialQuery{
+			Version:      c.GetVersion(),
+			SessionId:    sessionId,
+			SerialNumber: serialNumber,
+		}
+		c.SendCorruptData(query.Bytes())
 		if e.Log != nil {
 			e.Log.Debugf("%v < Invalid request (client asked for session %d but server is at %d)", c, sessionId, serverSessionId)
 		}
 		c.Disconnect()
 		return
 	}
-	serial, valid := e.sdManager.GetCurrentSerial()
+	serial, valid := sdManager.GetCurrentSerial()
 	if !valid {
 		c.SendNoDataError()
 		if e.Log != nil {
 			e.Log.Debugf("%v < No data", c)
 		}
+	} else if encoder, ok := sdManager.(SendableDataEncoder); ok {
+		data, serial, exists := encoder.GetEncodedSDsSerialDiff(serialNumber, c.GetVersion(), !c.dontSendBGPsecKeys)
+		if !exists {
+			c.SendCacheReset()
+			if e.Log != nil {
+				e.Log.Debugf("%v < Sent cache reset", c)
+			}
+		} else {
+			c.SendEncodedSDs(sessionId, serial, data)
+			if e.Log != nil {
+				e.Log.Debugf("%v < Sent cache (current serial %d, session from client: %d)", c, serial, sessionId)
+			}
+		}
 	} else {
-		data, exists := e.sdManager.GetSDsSerialDiff(serialNumber)
+		data, exists := sdManager.GetSDsSerialDiff(serialNumber)
 		if !exists {
 			c.SendCacheReset()
 			if e.Log != nil {
@@ -128,11 +242,9 @@ type Server struct {
 	baseVersion uint8
 	clientlock  *sync.RWMutex
 	clients     []*Client
-	sessId      []uint16
-	connected   int
-	maxconn     int
 
 	sshconfig *ssh.ServerConfig
+	tlsconfig *tls.Config
 
 	handler        RTRServerEventHandler
 	simpleHandler  RTREventHandler
@@ -140,27 +252,73 @@ type Server struct {
 	disableBGPSec  bool
 	enableNODELAY  bool
 
-	sdlock          *sync.RWMutex
-	sdListDiff      [][]SendableData
-	sdCurrent       []SendableData
-	sdCurrentSerial uint32
-	keepDiff        int
+	writeTimeout  time.Duration
+	sendQueueSize int
+	slowPolicy    SlowClientPolicy
+	keepAlive     net.KeepAliveConfig
+	tcpSignatures TCPSignatures
+	idleTimeout   time.Duration
+
+	acls    [TransportSSH + 1]atomic.Pointer[ACL]
+	proxies [TransportSSH + 1]atomic.Pointer[ProxyProtocol]
+	views   ViewSelector
+
+	// The data served is read lock-free from the current snapshot, updates
+	// are serialized by sdUpdateLock and publish a new snapshot.
+	sdSnapshot   atomic.Pointer[sdSnapshot]
+	sdUpdateLock *sync.Mutex
+	keepDiff     int
+	keepDiffAge  time.Duration
 
 	pduRefreshInterval uint32
 	pduRetryInterval   uint32
 	pduExpireInterval  uint32
 
+	// Listeners and connections, tracked to be closed on shutdown and to
+	// enforce the connection limits
+	lifecycleLock  *sync.Mutex
+	listeners      map[net.Listener]int // number of connections accepted
+	conns          map[net.Conn]*trackedConn
+	ipConns        map[netip.Addr]int
+	proxied        map[net.Conn]struct{} // reading a PROXY protocol header
+	connected      int
+	maxconn        int
+	maxconnListen  int
+	maxconnIP      int
+	done           chan struct{}
+	closed         bool
+	loopsWg        *sync.WaitGroup
+	connsWg        *sync.WaitGroup
+	notifyShutdown bool
+
+	// Error Reports received from the routers
+	errorReports     *errorReports
+	resetOnDataError bool
+
 	log        Logger
 	logverbose bool
 }
 
 type ServerConfiguration struct {
-	MaxConn         int
+	// Maximum number of connections, in total, accepted by each listener and
+	// from each IP address (0 for no limit)
+	MaxConn            int
+	MaxConnPerListener int
+	MaxConnPerIP       int
+
 	ProtocolVersion uint8
 	EnforceVersion  bool
-	KeepDifference  int
-
+	// Number of serials for which a diff can be sent (0 for no limit)
+	KeepDifference int
+	// Time for which a serial can be updated with a diff (0 for no limit)
+	KeepDifferenceAge time.Duration
+
+	// Session ID of all the protocol versions, from 0 to 65535. When
+	// negative, a random one is generated for the ProtocolVersion and the
+	// lower versions use it minus 100 per version.
 	SessId int
+	// Session IDs of each protocol version, overriding SessId
+	SessIds []uint16
 
 	DisableBGPSec bool
 	EnableNODELAY bool
@@ -169,16 +327,49 @@ type ServerConfiguration struct {
 	RetryInterval   uint32
 	ExpireInterval  uint32
 
+	// Sends an Error Report to the clients before disconnecting them on shutdown
+	NotifyShutdown bool
+	// Answers the next Serial Query of a router that reported a data error
+	// (withdrawal of an unknown record or duplicate announcement) with a
+	// Cache Reset, so that it reloads the whole data
+	ResetOnDataError bool
+
+	// Time allowed for a write to a client before disconnecting it (0 for no limit)
+	WriteTimeout time.Duration
+	// Size in bytes of the PDUs queued for a client (0 for the default of 4 MiB)
+	SendQueueSize int
+	// What happens to the Serial Notify sent to a client whose queue is full
+	SlowClientPolicy SlowClientPolicy
+
+	// TCP keepalive of the connections (the zero value keeps the defaults of Go)
+	KeepAlive net.KeepAliveConfig
+	// TCP-MD5 and TCP-AO keys of the peers of the listener created by Start
+	TCPSignatures TCPSignatures
+	// Time without a query after which a client is disconnected (0 for the
+	// expire interval, negative for no limit)
+	IdleTimeout time.Duration
+
+	// Selects the data served to each client (nil to serve the data of the
+	// server to all of them)
+	Views ViewSelector
+
 	Log        Logger
 	LogVerbose bool
 }
 
 func NewServer(configuration ServerConfiguration, handler RTRServerEventHandler, simpleHandler RTREventHandler) *Server {
-	sessids := make([]uint16, 0, int(configuration.ProtocolVersion)+1)
-	s := GenerateSessionId()
-	for i := 0; i <= int(configuration.ProtocolVersion); i++ {
-		sessids = append(sessids, s+uint16(100*i))
+	sessids := make([]uint16, int(configuration.ProtocolVersion)+1)
+	if configuration.SessId >= 0 {
+		for i := range sessids {
+			sessids[i] = uint16(configuration.SessId)
+		}
+	} else {
+		s := GenerateSessionId()
+		for i := range sessids {
+			sessids[i] = s + uint16(100*i)
+		}
 	}
+	copy(sessids, configuration.SessIds)
 
 	refreshInterval := uint32(3600)
 	if configuration.RefreshInterval != 0 {
@@ -192,22 +383,36 @@ func NewServer(configuration ServerConfiguration, handler RTRServerEventHandler,
 	if configuration.ExpireInterval != 0 {
 		expireInterval = configuration.ExpireInterval
 	}
+	sendQueueSize := defaultSendQueueSize
+	if configuration.SendQueueSize > 0 {
+		sendQueueSize = configuration.SendQueueSize
+	}
+	// Routers discard the data after the expire interval without a refresh
+	idleTimeout := time.Duration(expireInterval) * time.Second
+	if configuration.IdleTimeout != 0 {
+		idleTimeout = max(configuration.IdleTimeout, 0)
+	}
 
-	return &Server{
-		sdlock:     &sync.RWMutex{},
-		sdListDiff: make([][]SendableData, 0),
-		sdCurrent:  make([]SendableData, 0),
-		keepDiff:   configuration.KeepDifference,
+	server := &Server{
+		sdUpdateLock: &sync.Mutex{},
+		keepDiff:     configuration.KeepDifference,
+		keepDiffAge:  configuration.KeepDifferenceAge,
 
 		clientlock:  &sync.RWMutex{},
 		clients:     make([]*Client, 0),
-		sessId:      sessids,
-		maxconn:     configuration.MaxConn,
 		baseVersion: configuration.ProtocolVersion,
 
 		enforceVersion: configuration.EnforceVersion,
 		disableBGPSec:  configuration.DisableBGPSec,
 
+		writeTimeout:  configuration.WriteTimeout,
+		sendQueueSize: sendQueueSize,
+		slowPolicy:    configuration.SlowClientPolicy,
+		keepAlive:     configuration.KeepAlive,
+		tcpSignatures: configuration.TCPSignatures,
+		idleTimeout:   idleTimeout,
+		views:         configuration.Views,
+
 		pduRefreshInterval: refreshInterval,
 		pduRetryInterval:   retryInterval,
 		pduExpireInterval:  expireInterval,
@@ -215,9 +420,31 @@ func NewServer(configuration ServerConfiguration, handler RTRServerEventHandler,
 		handler:       handler,
 		simpleHandler: simpleHandler,
 
+		lifecycleLock:  &sync.Mutex{},
+		listeners:      make(map[net.Listener]int),
+		conns:          make(map[net.Conn]*trackedConn),
+		ipConns:        make(map[netip.Addr]int),
+		proxied:        make(map[net.Conn]struct{}),
+		maxconn:        configuration.MaxConn,
+		maxconnListen:  configuration.MaxConnPerListener,
+		maxconnIP:      configuration.MaxConnPerIP,
+		done:           make(chan struct{}),
+		loopsWg:        &sync.WaitGroup{},
+		connsWg:        &sync.WaitGroup{},
+		notifyShutdown: configuration.NotifyShutdown,
+
+		errorReports:     newErrorReports(),
+		resetOnDataError: configuration.ResetOnDataError,
+
 		log:        configuration.Log,
 		logverbose: configuration.LogVerbose,
 	}
+	server.sdSnapshot.Store(&sdSnapshot{
+		sessionIds: sessids,
+		current:    make([]SendableData, 0),
+		encoded:    make(map[encodingKey]*encodedSDs),
+	})
+	return server
 }
 
 func ConvertSDListToMap(SDs []SendableData) map[string]uint8 {
@@ -228,29 +455,39 @@ func ConvertSDListToMap(SDs []SendableData) map[string]uint8 {
 	return sdMap
 }
 
+func convertSDListToItemMap(SDs []SendableData) map[string]SendableData {
+	sdMap := make(map[string]SendableData, len(SDs))
+	for _, v := range SDs {
+		sdMap[v.HashKey()] = v
+	}
+	return sdMap
+}
+
 func ComputeDiff(newSDs, prevSDs []SendableData, populateUnchanged bool) (added, removed, unchanged []SendableData) {
 	added = make([]SendableData, 0)
 	removed = make([]SendableData, 0)
 	unchanged = make([]SendableData, 0)
 
-	newSDsMap := ConvertSDListToMap(newSDs)
-	prevSDsMap := ConvertSDListToMap(prevSDs)
+	newSDsMap := convertSDListToItemMap(newSDs)
+	prevSDsMap := convertSDListToItemMap(prevSDs)
 
 	for _, item := range newSDs {
-		_, exists := prevSDsMap[item.HashKey()]
-		if !exists {
+		// Some types (eg: ASPA) are keyed on a subset of their content and
+		// an item with the same key but different content replaces the previous one.
+		prev, exists := prevSDsMap[item.HashKey()]
+		if !exists || !item.Equals(prev) {
 			rcopy := item.Copy()
 			rcopy.SetFlag(FLAG_ADDED)
 			added = append(added, rcopy)
 		}
 	}
 	for _, item := range prevSDs {
-		_, exists := newSDsMap[item.HashKey()]
+		next, exists := newSDsMap[item.HashKey()]
 		if !exists {
 			rcopy := item.Copy()
 			rcopy.SetFlag(FLAG_REMOVED)
 			removed = append(removed, rcopy)
-		} else if populateUnchanged {
+		} else if populateUnchanged && item.Equals(next) {
 			rcopy := item.Copy()
 			unchanged = append(unchanged, rcopy)
 		}
@@ -293,106 +530,314 @@ func ApplyDiff(diff, prevSDs []SendableData) []SendableData {
 }
 
 func (s *Server) GetSessionId(version uint8) uint16 {
-	return s.sessId[version]
+	return s.sdSnapshot.Load().sessionIds[version]
 }
 
-func (s *Server) GetCurrentSDs() ([]SendableData, bool) {
-	s.sdlock.RLock()
-	sd := s.sdCurrent
-	s.sdlock.RUnlock()
-	return sd, true
+// IsPreviousSessionId tells whether the session ID was used for the version
+// before a rotation.
+func (s *Server) IsPreviousSessionId(version uint8, sessionId uint16) bool {
+	for _, ids := range s.sdSnapshot.Load().prevSessionIds {
+		if int(version) < len(ids) && ids[version] == sessionId {
+			return true
+		}
+	}
+	return false
+}
+
+// RotateSession switches to new session IDs and drops the diff history.
+// The routers are sent a Serial Notify and get a Cache Reset when they query
+// with the previous session, after which they reload the whole data.
+func (s *Server) RotateSession() {
+	s.sdUpdateLock.Lock()
+	snap := s.sdSnapshot.Load()
+	sessionIds := make([]uint16, len(snap.sessionIds))
+	for i, id := range snap.sessionIds {
+		sessionIds[i] = id + 1
+	}
+	prevSessionIds := append([][]uint16{snap.sessionIds}, snap.prevSessionIds...)
+	if len(prevSessionIds) > maxPrevSessions {
+		prevSessionIds = prevSessionIds[:maxPrevSessions]
+	}
+	s.sdSnapshot.Store(&sdSnapshot{
+		sessionIds:     sessionIds,
+		prevSessionIds: prevSessionIds,
+		serial:         snap.serial,
+		current:        snap.current,
+		encoded:        make(map[encodingKey]*encodedSDs),
+	})
+	s.sdUpdateLock.Unlock()
+
+	if s.log != nil {
+		s.log.Infof("Rotated session from %v to %v", snap.sessionIds, sessionIds)
+	}
+	s.NotifyClientsLatest()
 }
 
-func (s *Server) GetSDsSerialDiff(serial uint32) ([]SendableData, bool) {
-	s.sdlock.RLock()
-	sd, ok := s.getSDsSerialDiff(serial)
-	s.sdlock.RUnlock()
-	return sd, ok
+// sdSnapshot is a consistent state of the data served. It is never modified
+// once published: updates build a new snapshot.
+type sdSnapshot struct {
+	// Session ID of each protocol version, and the ones before the last rotations
+	sessionIds     []uint16
+	prevSessionIds [][]uint16
+
+	serial  uint32
+	current []SendableData
+	// The updates that led to this snapshot, oldest first
+	deltas []*sdDelta
+
+	// Encodings of the data and diffs, built by the first client asking for them
+	encodedLock sync.Mutex
+	encoded     map[encodingKey]*encodedSDs
 }
 
-func (s *Server) getSDsSerialDiff(serial uint32) ([]SendableData, bool) {
-	if serial == s.sdCurrentSerial {
+// sdDelta is the diff applied by an update. Deltas are shared between
+// snapshots and never modified.
+type sdDelta struct {
+	serial  uint32 // serial of the data the delta applies to
+	time    time.Time
+	changes []sdChange
+}
+
+type sdChange struct {
+	sd   SendableData // the object added, or removed if flagged as such
+	prev SendableData // the object with the same key before the update, if any
+}
+
+// serialDiff returns the diff from a serial, unless the data of that serial
+// was replaced more than maxAge ago (0 for no limit). The deltas older than
+// maxAge are only dropped by the next update.
+func (snap *sdSnapshot) serialDiff(serial uint32, maxAge time.Duration) ([]SendableData, bool) {
+	if serial == snap.serial {
 		return []SendableData{}, true
 	}
-	if serial > s.sdCurrentSerial {
+	// Serials usually increase by one, but can be set by the caller
+	if !SerialLess(serial, snap.serial) {
 		return nil, false
 	}
-	diff := int(s.sdCurrentSerial - serial)
-	if diff > len(s.sdListDiff) {
-		return nil, false
+	for i := len(snap.deltas) - 1; i >= 0; i-- {
+		if snap.deltas[i].serial == serial {
+			if maxAge > 0 && time.Since(snap.deltas[i].time) > maxAge {
+				return nil, false
+			}
+			return mergeDeltas(snap.deltas[i:]), true
+		}
 	}
-
-	sd := s.sdListDiff[len(s.sdListDiff)-diff]
-	return sd, true
+	return nil, false
 }
 
-func (s *Server) GetCurrentSerial() (uint32, bool) {
-	s.sdlock.RLock()
-	serial, valid := s.getCurrentSerial()
-	s.sdlock.RUnlock()
-	return serial, valid
+// mergeDeltas returns the diff made by consecutive deltas. Objects that
+// ended up as they were before the first delta are left out.
+func mergeDeltas(deltas []*sdDelta) []SendableData {
+	type merged struct {
+		first, last sdChange
+	}
+	changes := make(map[string]*merged)
+	keys := make([]string, 0)
+	for _, d := range deltas {
+		for _, c := range d.changes {
+			key := c.sd.HashKey()
+			m, ok := changes[key]
+			if !ok {
+				m = &merged{first: c}
+				changes[key] = m
+				keys = append(keys, key)
+			}
+			m.last = c
+		}
+	}
+
+	diff := make([]SendableData, 0, len(keys))
+	for _, key := range keys {
+		m := changes[key]
+		before, after := m.first.prev, m.last.sd
+		if after.GetFlag() == FLAG_REMOVED {
+			if before != nil {
+				diff = append(diff, after)
+			}
+		} else if before == nil || !before.Equals(after) {
+			diff = append(diff, after)
+		}
+	}
+	return diff
 }
 
-func (s *Server) getCurrentSerial() (uint32, bool) {
-	return s.sdCurrentSerial, len(s.sdCurrent) > 0
+func (snap *sdSnapshot) valid() bool {
+	return len(snap.current) > 0
 }
 
-func (s *Server) generateSerial() uint32 {
-	newserial := s.sdCurrentSerial
-	if len(s.sdCurrent) > 0 {
+func (snap *sdSnapshot) nextSerial() uint32 {
+	newserial := snap.serial
+	if snap.valid() {
+		// Wraps around to 0 after 2^32-1 (RFC 1982)
 		newserial++
 	}
 	return newserial
 }
 
-func (s *Server) CountSDs() int {
-	s.sdlock.RLock()
-	defer s.sdlock.RUnlock()
+type encodingKey struct {
+	from    uint32 // serial the diff starts from, equal to the snapshot serial for the full data
+	full    bool
+	version uint8
+	bgpsec  bool
+}
+
+// encodedSDs is built by the first client asking for it
+type encodedSDs struct {
+	once sync.Once
+	data []byte
+}
+
+// getEncoded returns the encoding of data for the key, built on first use.
+func (snap *sdSnapshot) getEncoded(key encodingKey, data []SendableData) []byte {
+	snap.encodedLock.Lock()
+	enc, ok := snap.encoded[key]
+	if !ok {
+		enc = &encodedSDs{}
+		snap.encoded[key] = enc
+	}
+	snap.encodedLock.Unlock()
+
+	enc.once.Do(func() {
+		enc.data = AppendSDs(nil, key.version, key.bgpsec, data)
+	})
+	return enc.data
+}
+
+func (s *Server) GetCurrentSDs() ([]SendableData, bool) {
+	return s.sdSnapshot.Load().current, true
+}
+
+func (s *Server) GetSDsSerialDiff(serial uint32) ([]SendableData, bool) {
+	return s.sdSnapshot.Load().serialDiff(serial, s.keepDiffAge)
+}
 
-	return len(s.sdCurrent)
+func (s *Server) GetCurrentSerial() (uint32, bool) {
+	snap := s.sdSnapshot.Load()
+	return snap.serial, snap.valid()
+}
+
+func (s *Server) CountSDs() int {
+	return len(s.sdSnapshot.Load().current)
 }
 
 func (s *Server) AddData(new []SendableData) bool {
-	s.sdlock.RLock()
+	s.sdUpdateLock.Lock()
+	defer s.sdUpdateLock.Unlock()
+	snap := s.sdSnapshot.Load()
 
-	added, removed, _ := ComputeDiff(new, s.sdCurrent, false)
+	added, removed, _ := ComputeDiff(new, snap.current, false)
 	if s.log != nil && s.logverbose {
 		s.log.Debugf("Computed diff: added (%v), removed (%v)", added, removed)
 	} else if s.log != nil {
 		s.log.Debugf("Computed diff: added (%d), removed (%d)", len(added), len(removed))
 	}
 	curDiff := append(added, removed...)
-	s.sdlock.RUnlock()
 
 	if len(curDiff) == 0 {
 		return false
 	} else {
-		s.AddSDsDiff(curDiff)
+		s.addSDsDiff(snap, curDiff, snap.nextSerial())
 		return true
 	}
 }
 
+// AddDataSerial is like AddData, but publishes the data with the given serial
+// so that caches serving the same data present the same serial. The serial is
+// published even when the data did not change. Changed data whose serial does
+// not come after the current one is rejected with ErrSerialNotAfter: caches
+// would otherwise present different data with the same serial.
+func (s *Server) AddDataSerial(new []SendableData, serial uint32) (bool, error) {
+	s.sdUpdateLock.Lock()
+	defer s.sdUpdateLock.Unlock()
+	snap := s.sdSnapshot.Load()
+
+	added, removed, _ := ComputeDiff(new, snap.current, false)
+	curDiff := append(added, removed...)
+	if snap.valid() && !SerialLess(snap.serial, serial) {
+		if len(curDiff) == 0 {
+			return false, nil
+		}
+		return false, fmt.Errorf("%w: %d, current %d", ErrSerialNotAfter, serial, snap.serial)
+	} else if len(curDiff) == 0 && !snap.valid() {
+		return false, nil
+	}
+	if s.log != nil {
+		s.log.Debugf("Computed diff: added (%d), removed (%d), serial %d", len(added), len(removed), serial)
+	}
+	s.addSDsDiff(snap, curDiff, serial)
+	return true, nil
+}
+
 func (s *Server) AddSDsDiff(diff []SendableData) {
-	s.sdlock.RLock()
-	nextDiff := make([][]SendableData, len(s.sdListDiff)+1)
-	for i, prevSDs := range s.sdListDiff {
-		nextDiff[i] = ApplyDiff(diff, prevSDs)
+	s.sdUpdateLock.Lock()
+	defer s.sdUpdateLock.Unlock()
+	snap := s.sdSnapshot.Load()
+	s.addSDsDiff(snap, diff, snap.nextSerial())
+}
+
+// addSDsDiff publishes the snapshot resulting from applying diff to snap,
+// with the given serial. It must be called with sdUpdateLock held.
+func (s *Server) addSDsDiff(snap *sdSnapshot, diff []SendableData, serial uint32) {
+	// Only the deltas are kept: diffs are merged when a client asks for them.
+	// No client has the serial of empty data, the history restarts after it.
+	var deltas []*sdDelta
+	if snap.valid() {
+		now := time.Now()
+		prevSDs := convertSDListToItemMap(snap.current)
+		delta := &sdDelta{
+			serial:  snap.serial,
+			time:    now,
+			changes: make([]sdChange, len(diff)),
+		}
+		for i, sd := range diff {
+			delta.changes[i] = sdChange{sd: sd, prev: prevSDs[sd.HashKey()]}
+		}
+
+		deltas = snap.deltas
+		if s.keepDiff > 0 && len(deltas) >= s.keepDiff {
+			deltas = deltas[len(deltas)-s.keepDiff+1:]
+		}
+		if s.keepDiffAge > 0 {
+			for len(deltas) > 0 && now.Sub(deltas[0].time) > s.keepDiffAge {
+				deltas = deltas[1:]
+			}
+		}
+		deltas = append(slices.Clip(deltas), delta)
 	}
-	newSDCurrent := ApplyDiff(diff, s.sdCurrent)
-	s.sdlock.RUnlock()
 
-	s.sdlock.Lock()
-	defer s.sdlock.Unlock()
-	newserial := s.generateSerial()
+	s.sdSnapshot.Store(&sdSnapshot{
+		sessionIds:     snap.sessionIds,
+		prevSessionIds: snap.prevSessionIds,
+		serial:         serial,
+		current:        ApplyDiff(diff, snap.current),
+		deltas:         deltas,
+		encoded:        make(map[encodingKey]*encodedSDs),
+	})
+}
 
-	nextDiff = append(nextDiff, diff)
-	if s.keepDiff > 0 && len(nextDiff) > s.keepDiff {
-		nextDiff = nextDiff[len(nextDiff)-s.keepDiff:]
+func (s *Server) GetCurrentEncodedSDs(version uint8, bgpsec bool) ([]byte, uint32, bool) {
+	snap := s.sdSnapshot.Load()
+	key := encodingKey{
+		from:    snap.serial,
+		full:    true,
+		version: version,
+		bgpsec:  bgpsec,
 	}
+	return snap.getEncoded(key, snap.current), snap.serial, true
+}
 
-	s.sdListDiff = nextDiff
-	s.sdCurrent = newSDCurrent
-	s.sdCurrentSerial = newserial
+func (s *Server) GetEncodedSDsSerialDiff(serial uint32, version uint8, bgpsec bool) ([]byte, uint32, bool) {
+	snap := s.sdSnapshot.Load()
+	sd, ok := snap.serialDiff(serial, s.keepDiffAge)
+	if !ok {
+		return nil, 0, false
+	}
+	key := encodingKey{
+		from:    serial,
+		version: version,
+		bgpsec:  bgpsec,
+	}
+	return snap.getEncoded(key, sd), snap.serial, true
 }
 
 func (s *Server) SetBaseVersion(version uint8) {
@@ -404,8 +849,13 @@ func (s *Server) SetVersionEnforced(adapt bool) {
 }
 
 func (s *Server) SetMaxConnections(maxconn int) {
-	if s.connected > maxconn {
-		todisconnect := s.connected - maxconn
+	s.lifecycleLock.Lock()
+	s.maxconn = maxconn
+	connected := s.connected
+	s.lifecycleLock.Unlock()
+
+	if maxconn > 0 && connected > maxconn {
+		todisconnect := connected - maxconn
 		clients := s.GetClientList()
 		if s.log != nil {
 			s.log.Debugf("Too many clients connected, disconnecting first %v", todisconnect)
@@ -416,13 +866,22 @@ func (s *Server) SetMaxConnections(maxconn int) {
 			}
 		}
 	}
-	s.maxconn = maxconn
 }
 
 func (s *Server) GetMaxConnections() int {
+	s.lifecycleLock.Lock()
+	defer s.lifecycleLock.Unlock()
 	return s.maxconn
 }
 
+// GetConnectionCount returns the number of connections accepted, including
+// the ones not yet used by a client.
+func (s *Server) GetConnectionCount() int {
+	s.lifecycleLock.Lock()
+	defer s.lifecycleLock.Unlock()
+	return s.connected
+}
+
 func (s *Server) GetClientRemoteAddrs(w http.ResponseWriter, r *http.Request) {
 	clients := s.GetClientList()
 	out := make([]string, len(clients))
@@ -432,12 +891,82 @@ func (s *Server) GetClientRemoteAddrs(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(out)
 }
 
+// ClientInfo describes a connected client, see GetClientsInfo.
+type ClientInfo struct {
+	ID         uint64     `json:"id"`
+	Transport  string     `json:"transport"`
+	RemoteAddr string     `json:"remote_addr"`
+	LocalAddr  string     `json:"local_addr"`
+	Version    uint8      `json:"version"`
+	Connected  time.Time  `json:"connected"`
+	LastQuery  *time.Time `json:"last_query"`
+	// Serial of the last Serial Query
+	Serial *uint32 `json:"serial"`
+	// Identity is the TLS subject or the SSH user
+	Identity   string `json:"identity,omitempty"`
+	TLSSubject string `json:"tls_subject,omitempty"`
+	SSHUser    string `json:"ssh_user,omitempty"`
+	View       string `json:"view,omitempty"`
+	// Seconds since the last query, or since the connection without a query
+	Idle      float64 `json:"idle"`
+	PDUsSent  uint64  `json:"pdus_sent"`
+	BytesSent uint64  `json:"bytes_sent"`
+	// Last Error Reports received from the router, see GetErrorReports
+	ErrorReports []ReceivedErrorReport `json:"error_reports,omitempty"`
+}
+
+// GetClientsInfo writes the ClientInfo of the connected clients as JSON.
+func (s *Server) GetClientsInfo(w http.ResponseWriter, r *http.Request) {
+	clients := s.GetClientList()
+	out := make([]ClientInfo, len(clients))
+	now := time.Now()
+	for i, c := range clients {
+		out[i] = ClientInfo{
+			ID:           c.GetID(),
+			Transport:    c.GetTransport().String(),
+			RemoteAddr:   c.GetRemoteAddress().String(),
+			LocalAddr:    c.GetLocalAddress().String(),
+			Version:      c.GetVersion(),
+			Connected:    c.GetConnectionTime(),
+			Identity:     c.GetIdentity(),
+			TLSSubject:   c.GetTLSSubject(),
+			SSHUser:      c.GetSSHUser(),
+			Idle:         now.Sub(c.GetConnectionTime()).Seconds(),
+			PDUsSent:     c.GetPDUsSent(),
+			BytesSent:    c.GetBytesSent(),
+			ErrorReports: s.errorReports.router(c),
+		}
+		if serial, ok := c.GetSerial(); ok {
+			out[i].Serial = &serial
+		}
+		if v := c.GetView(); v != nil {
+			out[i].View = v.Name
+		}
+		if last := c.GetLastQueryTime(); !last.IsZero() {
+			out[i].LastQuery = &last
+			out[i].Idle = now.Sub(last).Seconds()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
 func (s *Server) ClientConnected(c *Client) {
 	s.clientlock.Lock()
 	s.clients = append(s.clients, c)
-	s.connected++
 	s.clientlock.Unlock()
 
+	// A client starting while the server shuts down may have been missed by Shutdown
+	s.lifecycleLock.Lock()
+	if tc, ok := s.conns[c.tcpconn]; ok {
+		tc.used = true
+	}
+	closed := s.closed
+	s.lifecycleLock.Unlock()
+	if closed {
+		c.Disconnect()
+	}
+
 	if s.handler != nil {
 		s.handler.ClientConnected(c)
 	}
@@ -452,7 +981,6 @@ func (s *Server) ClientDisconnected(c *Client) {
 		}
 	}
 	s.clients = tmpclients
-	s.connected--
 	s.clientlock.Unlock()
 
 	if s.handler != nil {
@@ -466,7 +994,7 @@ func (s *Server) HandlePDU(c *Client, pdu PDU) {
 		if s.log != nil {
 			s.log.Debugf("Client %v uses version %v and server is using %v", c.String(), c.GetVersion(), s.baseVersion)
 		}
-		c.SendWrongVersionError()
+		c.SendWrongVersionError(pdu.Bytes())
 		c.Disconnect()
 	}
 	if c.GetVersion() > s.baseVersion {
@@ -474,34 +1002,167 @@ func (s *Server) HandlePDU(c *Client, pdu PDU) {
 		c.SetVersion(s.baseVersion)
 	}
 
+	report, _ := pdu.(*PDUErrorReport)
+	if report != nil {
+		s.errorReported(c, report)
+	}
 	if s.handler != nil {
 		s.handler.HandlePDU(c, pdu)
 	}
+	if report != nil && isFatalError(report.ErrorCode) {
+		// No Error Report is sent in response
+		c.Disconnect()
+	}
+}
+
+// errorReported logs and records an Error Report sent by a router.
+func (s *Server) errorReported(c *Client, report *PDUErrorReport) {
+	reset := s.resetOnDataError && isDataError(report.ErrorCode)
+	s.errorReports.add(c, report, reset)
+	if s.log == nil {
+		return
+	}
+	if isFatalError(report.ErrorCode) {
+		s.log.Warnf("%v: received Error Report %q (%d): %q, disconnecting", c.String(),
+			ErrorCodeToString(report.ErrorCode), report.ErrorCode, errorText(report))
+	} else {
+		s.log.Infof("%v: received Error Report %q (%d): %q", c.String(),
+			ErrorCodeToString(report.ErrorCode), report.ErrorCode, errorText(report))
+	}
+	if reset {
+		s.log.Infof("%v: the next Serial Query will be answered with a Cache Reset", c.String())
+	}
+}
+
+func (s *Server) ClientSlow(c *Client, disconnected bool) {
+	if h, ok := s.handler.(SlowClientHandler); ok {
+		h.ClientSlow(c, disconnected)
+	}
+}
+
+// takeReset tells whether the client must get a Cache Reset, after a data
+// error or a call to ResetClient, and clears it.
+func (s *Server) takeReset(c *Client) bool {
+	reported := s.errorReports.takeReset(c)
+	return c.resetPending.Swap(false) || reported
 }
 
 func (s *Server) RequestCache(c *Client) {
+	// The router reloads the whole data anyway
+	s.takeReset(c)
 	if s.simpleHandler != nil {
 		s.simpleHandler.RequestCache(c)
 	}
 }
 
 func (s *Server) RequestNewVersion(c *Client, sessionId uint16, serial uint32) {
+	if s.takeReset(c) {
+		if s.log != nil {
+			s.log.Infof("%v: answering the Serial Query with a Cache Reset", c.String())
+		}
+		c.SendCacheReset()
+		return
+	}
 	if s.simpleHandler != nil {
 		s.simpleHandler.RequestNewVersion(c, sessionId, serial)
 	}
 }
 
+// Transport selects how the connections accepted on a listener are handled.
+type Transport int
+
+const (
+	// TransportTCP serves RTR directly on the connections (TCP or Unix sockets).
+	TransportTCP Transport = iota
+	// TransportTLS serves RTR on connections from a TLS listener (see tls.NewListener).
+	TransportTLS
+	// TransportSSH serves RTR over the rpki-rtr SSH subsystem, see SetSSHConfig.
+	TransportSSH
+)
+
+func (t Transport) String() string {
+	switch t {
+	case TransportTCP:
+		return "tcp"
+	case TransportTLS:
+		return "tls"
+	case TransportSSH:
+		return "ssh"
+	default:
+		return fmt.Sprintf("transport(%d)", int(t))
+	}
+}
+
+// Serve accepts connections on the listener until it fails or the server is
+// shut down, in which case ErrServerClosed is returned. The listener is
+// closed when Serve returns.
+func (s *Server) Serve(l net.Listener, transport Transport) error {
+	switch transport {
+	case TransportTCP, TransportTLS:
+		return s.loopTCP(l, transport, s.acceptClientTCP)
+	case TransportSSH:
+		if s.sshconfig == nil {
+			l.Close()
+			return errors.New("no SSH configuration set")
+		}
+		return s.loopTCP(l, transport, s.acceptClientSSH)
+	default:
+		l.Close()
+		return fmt.Errorf("unknown transport %v", transport)
+	}
+}
+
+// SetACL sets the ACL filtering the connections accepted by the listeners
+// serving the transport (nil to accept all of them). It can be changed while
+// serving: the clients already connected are kept.
+func (s *Server) SetACL(transport Transport, acl *ACL) {
+	s.acls[transport].Store(acl)
+}
+
+// SetProxyProtocol enables the PROXY protocol on the listeners serving the
+// transport (nil to disable it). The listeners serving TransportTLS must not
+// yield TLS connections, see SetTLSConfig.
+func (s *Server) SetProxyProtocol(transport Transport, proxy *ProxyProtocol) {
+	s.proxies[transport].Store(proxy)
+}
+
+// SetSSHConfig sets the configuration used by the listeners serving TransportSSH.
+// It must be called before they are started.
+func (s *Server) SetSSHConfig(config *ssh.ServerConfig) {
+	s.sshconfig = config
+}
+
+// SetTLSConfig sets the configuration used by the listeners serving TransportTLS
+// that do not yield TLS connections. It must be called before they are started.
+func (s *Server) SetTLSConfig(config *tls.Config) {
+	s.tlsconfig = config
+}
+
 func (s *Server) Start(bind string) error {
-	tcplist, err := net.Listen("tcp", bind)
+	lc := net.ListenConfig{}
+	if len(s.tcpSignatures) > 0 {
+		lc.Control = s.tcpSignatures.Control
+		lc.SetMultipathTCP(false)
+	}
+	tcplist, err := lc.Listen(context.Background(), "tcp", bind)
 	if err != nil {
 		return err
 	}
-	return s.loopTCP(tcplist, "tcp", s.acceptClientTCP)
+	return s.Serve(tcplist, TransportTCP)
 }
 
 func (s *Server) acceptClientTCP(tcpconn net.Conn) error {
+	// The client certificate is needed to identify the client
+	if tc, ok := tcpconn.(*tls.Conn); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+		err := tc.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
 	if !s.enableNODELAY {
-		tc, ok := tcpconn.(*net.TCPConn)
+		tc, ok := netConn(tcpconn).(*net.TCPConn)
 		if ok {
 			tc.SetNoDelay(false)
 		}
@@ -513,116 +1174,417 @@ func (s *Server) acceptClientTCP(tcpconn net.Conn) error {
 		client.SetVersion(s.baseVersion)
 	}
 	client.SetIntervals(s.pduRefreshInterval, s.pduRetryInterval, s.pduExpireInterval)
+	client.SetWriteTimeout(s.writeTimeout)
+	client.SetIdleTimeout(s.idleTimeout)
+	client.SetSendQueue(s.sendQueueSize, s.slowPolicy)
 	if s.disableBGPSec {
 		client.DisableBGPsec()
 	}
-	go client.Start()
+	s.selectView(client)
+	client.Start()
 	return nil
 }
 
 func (s *Server) acceptClientSSH(tcpconn net.Conn) error {
-	_, chans, reqs, err := ssh.NewServerConn(tcpconn, s.sshconfig)
+	sshconn, chans, reqs, err := ssh.NewServerConn(tcpconn, s.sshconfig)
 	if err != nil {
 		return err
 	}
 
-	go func() {
-		s.connected++
-		cont := true
-		for cont {
-			select {
-			case req := <-reqs:
-				if req != nil && req.WantReply {
-					req.Reply(false, nil)
-				} else if req == nil {
-					cont = false
-					break
-				}
-			case newChannel := <-chans:
-				if newChannel != nil && newChannel.ChannelType() != "session" {
-					newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
-					continue
-				} else if newChannel == nil {
-					cont = false
-					break
-				}
-				channel, requests, err := newChannel.Accept()
-				if err != nil {
-					if s.log != nil {
-						s.log.Errorf("Could not accept channel: %v", err)
-					}
-					cont = false
-					break
+	cont := true
+	for cont {
+		select {
+		case req := <-reqs:
+			if req != nil && req.WantReply {
+				req.Reply(false, nil)
+			} else if req == nil {
+				cont = false
+				break
+			}
+		case newChannel := <-chans:
+			if newChannel != nil && newChannel.ChannelType() != "session" {
+				newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+				continue
+			} else if newChannel == nil {
+				cont = false
+				break
+			}
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				if s.log != nil {
+					s.log.Errorf("Could not accept channel: %v", err)
 				}
-				for req := range requests {
-					if req != nil && req.Type == "subsystem" && bytes.Equal(req.Payload, []byte{0, 0, 0, 8, 114, 112, 107, 105, 45, 114, 116, 114}) {
-						err := req.Reply(true, nil)
-						if err != nil {
-							if s.log != nil {
-								s.log.Errorf("Could not accept channel: %v", err)
-							}
-							cont = false
-							break
-						}
-						client := ClientFromConnSSH(tcpconn, channel, s, s)
-						client.log = s.log
-						if s.enforceVersion {
-							client.SetVersion(s.baseVersion)
+				cont = false
+				break
+			}
+			for req := range requests {
+				if req != nil && req.Type == "subsystem" && bytes.Equal(req.Payload, []byte{0, 0, 0, 8, 114, 112, 107, 105, 45, 114, 116, 114}) {
+					err := req.Reply(true, nil)
+					if err != nil {
+						if s.log != nil {
+							s.log.Errorf("Could not accept channel: %v", err)
 						}
-						client.SetIntervals(s.pduRefreshInterval, s.pduRetryInterval, s.pduExpireInterval)
-						client.Start()
-					} else {
 						cont = false
 						break
 					}
-
+					client := ClientFromConnSSH(tcpconn, channel, s, s)
+					// Without authentication, anyone can claim the user
+					if sshconn.Permissions != nil {
+						client.sshUser = sshconn.User()
+					}
+					client.log = s.log
+					if s.enforceVersion {
+						client.SetVersion(s.baseVersion)
+					}
+					client.SetIntervals(s.pduRefreshInterval, s.pduRetryInterval, s.pduExpireInterval)
+					client.SetWriteTimeout(s.writeTimeout)
+					client.SetIdleTimeout(s.idleTimeout)
+					client.SetSendQueue(s.sendQueueSize, s.slowPolicy)
+					s.selectView(client)
+					client.Start()
+				} else {
+					cont = false
+					break
 				}
+
 			}
 		}
-		s.connected--
-		tcpconn.Close()
-	}()
+	}
+	tcpconn.Close()
 	return nil
 }
 
+// selectView sets the view served to a new client.
+func (s *Server) selectView(c *Client) {
+	if s.views == nil {
+		return
+	}
+	if v := s.views.SelectView(c); v != nil {
+		c.SetView(v)
+		if s.log != nil {
+			s.log.Debugf("%v: serving view %s", c, v.Name)
+		}
+	}
+}
+
 type ClientCallback func(net.Conn) error
 
-func (s *Server) loopTCP(tcplist net.Listener, logEnv string, clientCallback ClientCallback) error {
+// RejectReason tells why a connection was closed before creating a Client.
+type RejectReason string
+
+const (
+	RejectACL             RejectReason = "acl"
+	RejectMaxConn         RejectReason = "maxconn"
+	RejectListenerMaxConn RejectReason = "listener_maxconn"
+	RejectIPMaxConn       RejectReason = "ip_maxconn"
+	RejectProxyUntrusted  RejectReason = "proxy_untrusted"
+	RejectProxyHeader     RejectReason = "proxy_header"
+)
+
+// A RTRServerEventHandler can also implement this interface to be told about
+// the connections closed before creating a Client.
+type ConnectionRejectedHandler interface {
+	ConnectionRejected(conn net.Conn, transport Transport, reason RejectReason)
+}
+
+func (s *Server) rejectConn(conn net.Conn, transport Transport, reason RejectReason) {
+	if h, ok := s.handler.(ConnectionRejectedHandler); ok {
+		h.ConnectionRejected(conn, transport, reason)
+	}
+	conn.Close()
+}
+
+func (s *Server) loopTCP(tcplist net.Listener, transport Transport, clientCallback ClientCallback) error {
+	logEnv := transport.String()
+	if !s.trackListener(tcplist) {
+		tcplist.Close()
+		return ErrServerClosed
+	}
+	defer s.untrackListener(tcplist)
+
+	var delay time.Duration
 	for {
 		tcpconn, err := tcplist.Accept()
 		if err != nil {
+			select {
+			case <-s.done:
+				return ErrServerClosed
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			delay = min(max(2*delay, minAcceptDelay), maxAcceptDelay)
 			if s.log != nil {
-				s.log.Errorf("Failed to accept %s connection: %s", logEnv, err)
+				s.log.Errorf("Failed to accept %s connection: %s (retrying in %v)", logEnv, err, delay)
+			}
+			select {
+			case <-time.After(delay):
+			case <-s.done:
+				return ErrServerClosed
 			}
 			continue
 		}
+		delay = 0
 
-		if s.maxconn > 0 && s.connected >= s.maxconn {
+		proxy := s.proxies[transport].Load()
+		if proxy == nil {
+			s.acceptConn(tcpconn, tcplist, transport, clientCallback)
+		} else if !proxy.TrustedConn(tcpconn) {
 			if s.log != nil {
-				s.log.Warnf("Could not accept %s connection from %v (not enough slots available: %d)", logEnv, tcpconn.RemoteAddr(), s.maxconn)
+				s.log.Warnf("Rejected %s connection from %v (untrusted proxy)", logEnv, tcpconn.RemoteAddr())
 			}
-			tcpconn.Close()
+			s.rejectConn(tcpconn, transport, RejectProxyUntrusted)
+		} else if s.trackProxied(tcpconn) {
+			// The header is read without blocking the other connections
+			go s.acceptProxied(tcpconn, tcplist, transport, proxy, clientCallback)
 		} else {
-			if s.log != nil {
-				s.log.Infof("Accepted %s connection from %v (%d/%d)", logEnv, tcpconn.RemoteAddr(), s.connected+1, s.maxconn)
-			}
-			if clientCallback != nil {
-				err := clientCallback(tcpconn)
-				if err != nil && s.log != nil {
-					s.log.Errorf("Error with %s client %v: %v", logEnv, tcpconn.RemoteAddr(), err)
-				}
-			}
+			tcpconn.Close()
+		}
+	}
+}
+
+// acceptConn checks a new connection against the ACL and the connection
+// limits, and starts serving it.
+func (s *Server) acceptConn(tcpconn net.Conn, tcplist net.Listener, transport Transport, clientCallback ClientCallback) {
+	logEnv := transport.String()
+	if _, ok := tcpconn.(*tls.Conn); !ok && transport == TransportTLS && s.tlsconfig != nil {
+		tcpconn = tls.Server(tcpconn, s.tlsconfig)
+	}
+
+	if acl := s.acls[transport].Load(); acl != nil && !acl.AllowedConn(tcpconn) {
+		if s.log != nil {
+			s.log.Warnf("Rejected %s connection from %v (denied by ACL)", logEnv, tcpconn.RemoteAddr())
+		}
+		s.rejectConn(tcpconn, transport, RejectACL)
+	} else if connected, maxconn, reason := s.trackConn(tcpconn, tcplist); reason != "" {
+		if s.log != nil {
+			s.log.Warnf("Could not accept %s connection from %v (%s: %d connections)", logEnv, tcpconn.RemoteAddr(), rejectMessages[reason], maxconn)
+		}
+		s.rejectConn(tcpconn, transport, reason)
+	} else if connected == 0 {
+		tcpconn.Close()
+	} else {
+		if s.log != nil {
+			s.log.Infof("Accepted %s connection from %v (%d/%d)", logEnv, tcpconn.RemoteAddr(), connected, maxconn)
+		}
+		s.setKeepAlive(tcpconn)
+		go func() {
+			defer s.untrackConn(tcpconn)
+			if clientCallback != nil {
+				err := clientCallback(tcpconn)
+				if err != nil && s.log != nil {
+					s.log.Errorf("Error with %s client %v: %v", logEnv, tcpconn.RemoteAddr(), err)
+				}
+			}
+		}()
+	}
+}
+
+// acceptProxied reads the PROXY protocol header of a connection from a
+// trusted proxy, and accepts the connection with the address of the router.
+func (s *Server) acceptProxied(tcpconn net.Conn, tcplist net.Listener, transport Transport, proxy *ProxyProtocol, clientCallback ClientCallback) {
+	defer s.untrackProxied(tcpconn)
+	pconn, err := proxy.readHeader(tcpconn)
+	if err != nil {
+		select {
+		case <-s.done:
+			tcpconn.Close()
+			return
+		default:
+		}
+		if s.log != nil {
+			s.log.Warnf("Rejected %s connection from proxy %v (invalid PROXY protocol header: %v)", transport, tcpconn.RemoteAddr(), err)
+		}
+		s.rejectConn(tcpconn, transport, RejectProxyHeader)
+		return
+	}
+	if s.log != nil {
+		s.log.Debugf("PROXY protocol header from %v: %v to %v", tcpconn.RemoteAddr(), pconn.RemoteAddr(), pconn.LocalAddr())
+	}
+	s.acceptConn(pconn, tcplist, transport, clientCallback)
+}
+
+// setKeepAlive applies the keepalive configuration to a TCP connection,
+// possibly wrapped by TLS.
+func (s *Server) setKeepAlive(conn net.Conn) {
+	if s.keepAlive == (net.KeepAliveConfig{}) {
+		return
+	}
+	if tc, ok := netConn(conn).(*net.TCPConn); ok {
+		if err := tc.SetKeepAliveConfig(s.keepAlive); err != nil && s.log != nil {
+			s.log.Warnf("Could not set keepalive of %v: %v", conn.RemoteAddr(), err)
 		}
 	}
 }
 
+func (s *Server) trackListener(l net.Listener) bool {
+	s.lifecycleLock.Lock()
+	defer s.lifecycleLock.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listeners[l] = 0
+	s.loopsWg.Add(1)
+	return true
+}
+
+func (s *Server) untrackListener(l net.Listener) {
+	l.Close()
+	s.lifecycleLock.Lock()
+	delete(s.listeners, l)
+	s.lifecycleLock.Unlock()
+	s.loopsWg.Done()
+}
+
+type trackedConn struct {
+	listener net.Listener
+	addr     netip.Addr // invalid without an IP address (eg: Unix sockets)
+	used     bool       // true once a Client uses the connection
+}
+
+var rejectMessages = map[RejectReason]string{
+	RejectMaxConn:         "not enough slots available",
+	RejectListenerMaxConn: "not enough slots available on the listener",
+	RejectIPMaxConn:       "too many connections from the address",
+}
+
+// trackConn counts a connection accepted by the listener. It returns the
+// number of connections and the global limit, or the reason for rejecting
+// the connection with the limit reached. Without a reason, no connections
+// means that the server is shut down.
+func (s *Server) trackConn(conn net.Conn, l net.Listener) (int, int, RejectReason) {
+	s.lifecycleLock.Lock()
+	defer s.lifecycleLock.Unlock()
+	if s.closed {
+		return 0, s.maxconn, ""
+	}
+	tc := &trackedConn{listener: l}
+	if addr, ok := connAddr(conn.RemoteAddr()); ok {
+		tc.addr = addr.Unmap()
+	}
+	switch {
+	case s.maxconn > 0 && s.connected >= s.maxconn:
+		return 0, s.maxconn, RejectMaxConn
+	case s.maxconnListen > 0 && s.listeners[l] >= s.maxconnListen:
+		return 0, s.maxconnListen, RejectListenerMaxConn
+	case s.maxconnIP > 0 && tc.addr.IsValid() && s.ipConns[tc.addr] >= s.maxconnIP:
+		return 0, s.maxconnIP, RejectIPMaxConn
+	}
+
+	s.conns[conn] = tc
+	s.connected++
+	s.listeners[l]++
+	if tc.addr.IsValid() {
+		s.ipConns[tc.addr]++
+	}
+	s.connsWg.Add(1)
+	return s.connected, s.maxconn, ""
+}
+
+// trackProxied tracks a connection while its PROXY protocol header is read,
+// so that it is closed on shutdown. It returns false if the server is shut down.
+func (s *Server) trackProxied(conn net.Conn) bool {
+	s.lifecycleLock.Lock()
+	defer s.lifecycleLock.Unlock()
+	if s.closed {
+		return false
+	}
+	s.proxied[conn] = struct{}{}
+	s.connsWg.Add(1)
+	return true
+}
+
+func (s *Server) untrackProxied(conn net.Conn) {
+	s.lifecycleLock.Lock()
+	delete(s.proxied, conn)
+	s.lifecycleLock.Unlock()
+	s.connsWg.Done()
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	conn.Close()
+	s.lifecycleLock.Lock()
+	if tc, ok := s.conns[conn]; ok {
+		delete(s.conns, conn)
+		s.connected--
+		if _, ok := s.listeners[tc.listener]; ok {
+			s.listeners[tc.listener]--
+		}
+		if tc.addr.IsValid() {
+			if s.ipConns[tc.addr] <= 1 {
+				delete(s.ipConns, tc.addr)
+			} else {
+				s.ipConns[tc.addr]--
+			}
+		}
+	}
+	s.lifecycleLock.Unlock()
+	s.connsWg.Done()
+}
+
+// Shutdown stops the server: the listeners are closed, the connections not yet
+// used by a client are dropped and the clients are disconnected after sending
+// their pending PDUs (and an Error Report when NotifyShutdown is set).
+// It waits for the connections to be closed or the context to be done,
+// in which case the remaining connections are closed and the context error returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lifecycleLock.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn, tc := range s.conns {
+		if !tc.used {
+			conn.Close()
+		}
+	}
+	for conn := range s.proxied {
+		conn.Close()
+	}
+	s.lifecycleLock.Unlock()
+
+	for _, c := range s.GetClientList() {
+		if s.notifyShutdown {
+			c.trySendPDU(&PDUErrorReport{
+				ErrorCode: PDU_ERROR_INTERNALERR,
+				ErrorMsg:  "Server is shutting down",
+			})
+		}
+		c.Disconnect()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		s.loopsWg.Wait()
+		s.connsWg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		s.lifecycleLock.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.lifecycleLock.Unlock()
+		return ctx.Err()
+	}
+}
+
 func (s *Server) StartSSH(bind string, config *ssh.ServerConfig) error {
 	tcplist, err := net.Listen("tcp", bind)
 	if err != nil {
 		return err
 	}
-	s.sshconfig = config
-	return s.loopTCP(tcplist, "ssh", s.acceptClientSSH)
+	s.SetSSHConfig(config)
+	return s.Serve(tcplist, TransportSSH)
 }
 
 func (s *Server) StartTLS(bind string, config *tls.Config) error {
@@ -630,7 +1592,19 @@ func (s *Server) StartTLS(bind string, config *tls.Config) error {
 	if err != nil {
 		return err
 	}
-	return s.loopTCP(tcplist, "tls", s.acceptClientTCP)
+	return s.Serve(tcplist, TransportTLS)
+}
+
+// GetClient returns the connected client with the ID, nil if there is none.
+func (s *Server) GetClient(id uint64) *Client {
+	s.clientlock.RLock()
+	defer s.clientlock.RUnlock()
+	for _, c := range s.clients {
+		if c.GetID() == id {
+			return c
+		}
+	}
+	return nil
 }
 
 func (s *Server) GetClientList() []*Client {
@@ -642,43 +1616,96 @@ func (s *Server) GetClientList() []*Client {
 }
 
 func (s *Server) NotifyClientsLatest() {
-	serial, _ := s.GetCurrentSerial()
 	clients := s.GetClientList()
 	for _, c := range clients {
-		c.Notify(s.GetSessionId(c.GetVersion()), serial)
+		s.NotifyClient(c)
+	}
+}
+
+// NotifyClient sends a Serial Notify with the current serial of the data
+// served to the client.
+func (s *Server) NotifyClient(c *Client) {
+	var sdManager SendableDataManager = s
+	if v := c.GetView(); v != nil {
+		sdManager = v.Data
 	}
+	serial, _ := sdManager.GetCurrentSerial()
+	c.Notify(sdManager.GetSessionId(c.GetVersion()), serial)
 }
 
+// ResetClient answers the next Serial Query of the client with a Cache Reset,
+// and sends it a Serial Notify so that it queries right away.
+func (s *Server) ResetClient(c *Client) {
+	c.resetPending.Store(true)
+	s.NotifyClient(c)
+}
+
+// Last ID given to a client
+var lastClientID atomic.Uint64
+
 func ClientFromConn(tcpconn net.Conn, handler RTRServerEventHandler, simpleHandler RTREventHandler) *Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	transport := TransportTCP
+	if _, ok := tcpconn.(*tls.Conn); ok {
+		transport = TransportTLS
+	}
 	return &Client{
+		id:            lastClientID.Add(1),
+		transport:     transport,
 		tcpconn:       tcpconn,
 		rd:            tcpconn,
 		wr:            tcpconn,
 		handler:       handler,
 		simpleHandler: simpleHandler,
-		transmits:     make(chan PDU, 256),
+		queue:         newSendQueue(defaultSendQueueSize),
+		connected:     time.Now(),
+		ctx:           ctx,
+		cancel:        cancel,
+		disconnect:    &sync.Once{},
 	}
 }
 
 func ClientFromConnSSH(tcpconn net.Conn, channel ssh.Channel, handler RTRServerEventHandler, simpleHandler RTREventHandler) *Client {
 	client := ClientFromConn(tcpconn, handler, simpleHandler)
+	client.transport = TransportSSH
 	client.rd = channel
 	client.wr = channel
 	return client
 }
 
 type Client struct {
-	version       uint8
+	id        uint64
+	transport Transport
+
+	// Set by the read loop and read when sending to the client
+	version       atomic.Uint32
 	versionset    bool
 	tcpconn       net.Conn
 	rd            io.Reader
 	wr            io.Writer
 	handler       RTRServerEventHandler
 	simpleHandler RTREventHandler
-	curserial     uint32
+	curserial     atomic.Uint32
+	serialQueried atomic.Bool
+	// The next Serial Query is answered with a Cache Reset
+	resetPending atomic.Bool
 
-	transmits chan PDU
-	cancel    context.CancelFunc
+	// Written to the connection
+	pdusSent  atomic.Uint64
+	bytesSent atomic.Uint64
+
+	queue        *sendQueue
+	writeTimeout time.Duration
+	slowPolicy   SlowClientPolicy
+
+	connected   time.Time
+	lastQuery   atomic.Int64 // UnixNano, 0 before the first query
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+
+	ctx        context.Context
+	cancel     context.CancelFunc
+	disconnect *sync.Once
 
 	enforceVersion      bool
 	disableVersionCheck bool
@@ -689,11 +1716,29 @@ type Client struct {
 
 	dontSendBGPsecKeys bool
 
+	// Set before starting the client
+	sshUser string
+	view    *View
+
 	log Logger
 }
 
 func (c *Client) String() string {
-	return fmt.Sprintf("%v (v%v) / Serial: %v", c.tcpconn.RemoteAddr(), c.version, c.curserial)
+	if id := c.GetIdentity(); id != "" {
+		return fmt.Sprintf("%v [%s] (v%v) / Serial: %v", c.tcpconn.RemoteAddr(), id, c.GetVersion(), c.curserial.Load())
+	}
+	return fmt.Sprintf("%v (v%v) / Serial: %v", c.tcpconn.RemoteAddr(), c.GetVersion(), c.curserial.Load())
+}
+
+// GetID returns the identifier of the client, unique in the process.
+func (c *Client) GetID() uint64 {
+	return c.id
+}
+
+// GetTransport returns the transport of the client: TransportTLS for a TLS
+// connection, TransportSSH for an SSH channel and TransportTCP otherwise.
+func (c *Client) GetTransport() Transport {
+	return c.transport
 }
 
 func (c *Client) GetRemoteAddress() net.Addr {
@@ -704,8 +1749,47 @@ func (c *Client) GetLocalAddress() net.Addr {
 	return c.tcpconn.LocalAddr()
 }
 
+// GetSSHUser returns the user name of a client authenticated over SSH.
+func (c *Client) GetSSHUser() string {
+	return c.sshUser
+}
+
+// GetTLSSubject returns the subject of the certificate of a client
+// connected over TLS, if it sent one and it was verified.
+func (c *Client) GetTLSSubject() string {
+	tc, ok := c.tcpconn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	chains := tc.ConnectionState().VerifiedChains
+	if len(chains) == 0 {
+		return ""
+	}
+	return chains[0][0].Subject.String()
+}
+
+// GetIdentity returns the authenticated identity of the client: the subject
+// of its TLS certificate or its SSH user, empty without authentication.
+func (c *Client) GetIdentity() string {
+	if c.sshUser != "" {
+		return c.sshUser
+	}
+	return c.GetTLSSubject()
+}
+
+// SetView sets the view served to the client. It must be called before
+// starting the client.
+func (c *Client) SetView(v *View) {
+	c.view = v
+}
+
+// GetView returns the view served to the client, nil for the data of the server.
+func (c *Client) GetView() *View {
+	return c.view
+}
+
 func (c *Client) GetVersion() uint8 {
-	return c.version
+	return uint8(c.version.Load())
 }
 
 func (c *Client) DisableBGPsec() {
@@ -718,25 +1802,82 @@ func (c *Client) SetIntervals(refreshInterval uint32, retryInterval uint32, expi
 	c.expireInterval = expireInterval
 }
 
+// SetWriteTimeout sets the time allowed for a write before disconnecting the
+// client (0 for no limit).
+func (c *Client) SetWriteTimeout(timeout time.Duration) {
+	c.writeTimeout = timeout
+}
+
+// SetIdleTimeout sets the time without a query after which the client is
+// disconnected (0 for no limit). It must be called before Start.
+func (c *Client) SetIdleTimeout(timeout time.Duration) {
+	c.idleTimeout = timeout
+}
+
+// GetConnectionTime returns when the client connected.
+func (c *Client) GetConnectionTime() time.Time {
+	return c.connected
+}
+
+// GetLastQueryTime returns when the client last sent a Serial or Reset Query,
+// or the zero time if it did not.
+func (c *Client) GetLastQueryTime() time.Time {
+	last := c.lastQuery.Load()
+	if last == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, last)
+}
+
+// GetSerial returns the serial of the last Serial Query of the client, false
+// before the first one.
+func (c *Client) GetSerial() (uint32, bool) {
+	return c.curserial.Load(), c.serialQueried.Load()
+}
+
+// GetPDUsSent returns the number of PDUs written to the client.
+func (c *Client) GetPDUsSent() uint64 {
+	return c.pdusSent.Load()
+}
+
+// GetBytesSent returns the number of bytes written to the client.
+func (c *Client) GetBytesSent() uint64 {
+	return c.bytesSent.Load()
+}
+
+// SetSendQueue sets the size in bytes of the PDUs queued for the client and
+// what happens to a Serial Notify when it is full. It must be called before
+// Start.
+func (c *Client) SetSendQueue(size int, policy SlowClientPolicy) {
+	c.queue = newSendQueue(size)
+	c.slowPolicy = policy
+}
+
+// QueuedBytes returns the size of the PDUs waiting to be written to the client.
+func (c *Client) QueuedBytes() int {
+	_, size := c.queue.queued()
+	return size
+}
+
 func (c *Client) SetVersion(newversion uint8) {
 	c.versionset = true
-	c.version = newversion
+	c.version.Store(uint32(newversion))
 }
 
 func (c *Client) SetDisableVersionCheck(disableCheck bool) {
 	c.disableVersionCheck = disableCheck
 }
 
-func (c *Client) checkVersion(newversion uint8) error {
-	if (!c.versionset || newversion == c.version) && (newversion == PROTOCOL_VERSION_1 || newversion == PROTOCOL_VERSION_0) {
+func (c *Client) checkVersion(newversion uint8, pduCopy []byte) error {
+	if (!c.versionset || newversion == c.GetVersion()) && newversion <= PROTOCOL_VERSION_2 {
 		c.SetVersion(newversion)
 	} else {
 		if c.log != nil {
-			c.log.Debugf("%v: has bad version (received: v%v, current: v%v) error", c.String(), newversion, c.version)
+			c.log.Debugf("%v: has bad version (received: v%v, current: v%v) error", c.String(), newversion, c.GetVersion())
 		}
-		c.SendWrongVersionError()
+		c.SendWrongVersionError(pduCopy)
 		c.Disconnect()
-		return fmt.Errorf("%v: has bad version (received: v%v, current: v%v)", c.String(), newversion, c.version)
+		return fmt.Errorf("%v: has bad version (received: v%v, current: v%v)", c.String(), newversion, c.GetVersion())
 	}
 	return nil
 }
@@ -754,44 +1895,181 @@ func (c *Client) passSimpleHandler(pdu PDU) {
 	}
 }
 
+// isCoalescedPDU returns whether a PDU is part of a response that is
+// written in one go when its End of Data is sent.
+func isCoalescedPDU(pdu PDU) bool {
+	switch pdu.(type) {
+	case *PDUCacheResponse, *PDUIPv4Prefix, *PDUIPv6Prefix, *PDURouterKey, *PDUASPA:
+		return true
+	default:
+		return false
+	}
+}
+
 func (c *Client) sendLoop(ctx context.Context) error {
+	buf := getSendBuffer()
+	defer putSendBuffer(buf)
+
+	// Number of PDUs in buf
+	var pending int
 	for {
 		select {
-		case pdu := <-c.transmits:
-			c.wr.Write(pdu.Bytes())
+		case <-c.queue.ready:
+			for {
+				pdu, ok := c.queue.pop()
+				if !ok {
+					break
+				}
+				var bufs net.Buffers
+				if enc, ok := pdu.(*encodedPDUs); ok {
+					// Written along with the pending data, without copying it
+					bufs = net.Buffers{enc.data}
+					if len(*buf) > 0 {
+						bufs = net.Buffers{*buf, enc.data}
+					}
+					pending += countPDUs(enc.data)
+				} else {
+					*buf = pdu.AppendBinary(*buf)
+					pending++
+					if isCoalescedPDU(pdu) && len(*buf) < sendBufferSize {
+						continue
+					}
+					bufs = net.Buffers{*buf}
+				}
+				if err := c.write(bufs); err != nil {
+					return err
+				}
+				c.pdusSent.Add(uint64(pending))
+				*buf = (*buf)[:0]
+				pending = 0
+			}
 		case <-ctx.Done():
+			c.flushTransmits(*buf, pending)
 			return ctx.Err()
 		}
 	}
 }
 
+// countPDUs returns the number of PDUs in encoded data.
+func countPDUs(data []byte) int {
+	var n int
+	for len(data) >= 8 {
+		length := int(binary.BigEndian.Uint32(data[4:8]))
+		if length < 8 || length > len(data) {
+			break
+		}
+		data = data[length:]
+		n++
+	}
+	return n
+}
+
+// write writes to the client, which is disconnected if it fails or takes
+// longer than the write timeout.
+func (c *Client) write(bufs net.Buffers) error {
+	start := time.Now()
+	if c.writeTimeout > 0 {
+		c.tcpconn.SetWriteDeadline(start.Add(c.writeTimeout))
+		if c.wr != io.Writer(c.tcpconn) {
+			// Writes to an SSH channel wait for its window, regardless of the deadline
+			timer := time.AfterFunc(c.writeTimeout, func() { c.tcpconn.Close() })
+			defer timer.Stop()
+		}
+	}
+	n, err := bufs.WriteTo(c.wr)
+	c.bytesSent.Add(uint64(n))
+	if err == nil {
+		return nil
+	}
+
+	if c.writeTimeout > 0 && time.Since(start) >= c.writeTimeout {
+		if c.log != nil {
+			c.log.Warnf("%v: write timed out after %v, disconnecting", c, c.writeTimeout)
+		}
+		c.slow(true)
+	} else if c.log != nil {
+		c.log.Debugf("%v: write error: %v", c, err)
+	}
+	c.Disconnect()
+	return err
+}
+
+// slow tells the handler that the client cannot keep up.
+func (c *Client) slow(disconnected bool) {
+	if h, ok := c.handler.(SlowClientHandler); ok {
+		h.ClientSlow(c, disconnected)
+	}
+}
+
+// flushTransmits writes the pending data and the PDUs queued before a disconnect
+// (eg: an Error Report explaining it), without blocking on a stalled peer.
+func (c *Client) flushTransmits(buf []byte, pending int) {
+	// Empty writes are not sent: some connections deliver them as empty reads
+	var bufs net.Buffers
+	if len(buf) > 0 {
+		bufs = append(bufs, buf)
+	}
+	for {
+		pdu, ok := c.queue.pop()
+		if !ok {
+			break
+		}
+		if enc, ok := pdu.(*encodedPDUs); ok {
+			bufs = append(bufs, enc.data)
+			pending += countPDUs(enc.data)
+		} else {
+			bufs = append(bufs, pdu.Bytes())
+			pending++
+		}
+	}
+	if len(bufs) == 0 {
+		return
+	}
+	c.tcpconn.SetWriteDeadline(time.Now().Add(flushTimeout))
+	n, err := bufs.WriteTo(c.wr)
+	c.bytesSent.Add(uint64(n))
+	if err == nil {
+		c.pdusSent.Add(uint64(pending))
+	}
+}
+
 func (c *Client) readLoop(ctx context.Context) error {
-	buf := make([]byte, 8000)
+	rd := NewPDUReader(c.rd)
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
-			length, err := c.rd.Read(buf)
-			if err != nil || length == 0 {
-				if c.log != nil {
+			pkt, err := rd.NextFrame()
+			if err != nil {
+				var decodeErr *DecodeError
+				if errors.As(err, &decodeErr) {
+					if c.log != nil {
+						c.log.Errorf("Error %v", err)
+					}
+					c.SendDecodeError(decodeErr)
+				} else if c.log != nil {
 					c.log.Debugf("Error %v", err)
 				}
 				c.Disconnect()
 				return err
 			}
 
-			pkt := buf[0:length]
-			dec, err := DecodeBytes(pkt)
+			// PDUs sent by routers are strictly validated and reported when non-conformant
+			dec, err := DecodeOptions{Strict: true}.DecodeBytes(pkt)
 			if err != nil || dec == nil {
 				if c.log != nil {
 					c.log.Errorf("Error %v", err)
 				}
+				var decodeErr *DecodeError
+				if errors.As(err, &decodeErr) {
+					c.SendDecodeError(decodeErr)
+				}
 				c.Disconnect()
 				return err
 			}
 			if !c.disableVersionCheck {
-				if err := c.checkVersion(dec.GetVersion()); err != nil {
+				if err := c.checkVersion(dec.GetVersion(), slices.Clone(pkt)); err != nil {
 					// checkVersion returns an error if it issued a disconnect
 					return err
 				}
@@ -801,19 +2079,36 @@ func (c *Client) readLoop(ctx context.Context) error {
 			}
 
 			if c.enforceVersion {
-				if !IsCorrectPDUVersion(dec, c.version) {
+				if !IsCorrectPDUVersion(dec, c.GetVersion()) {
 					if c.log != nil {
 						c.log.Debugf("Bad version error")
 					}
-					c.SendWrongVersionError()
+					c.SendWrongVersionError(slices.Clone(pkt))
 					c.Disconnect()
 					return fmt.Errorf("%s: bad version error", c.String())
 				}
 			}
 
+			switch dec.(type) {
+			case *PDUSerialQuery, *PDUResetQuery, *PDUErrorReport:
+			default:
+				// Only caches send the other PDU types
+				decodeErr := newDecodeError(PDU_ERROR_INVALIDREQUEST, slices.Clone(pkt), "unexpected %s PDU from router", TypeToString(dec.GetType()))
+				if c.log != nil {
+					c.log.Errorf("%v: %v", c.String(), decodeErr)
+				}
+				c.SendDecodeError(decodeErr)
+				c.Disconnect()
+				return decodeErr
+			}
+
 			switch pduconv := dec.(type) {
 			case *PDUSerialQuery:
-				c.curserial = pduconv.SerialNumber
+				c.curserial.Store(pduconv.SerialNumber)
+				c.serialQueried.Store(true)
+				c.queried()
+			case *PDUResetQuery:
+				c.queried()
 			}
 
 			if c.handler != nil {
@@ -825,19 +2120,39 @@ func (c *Client) readLoop(ctx context.Context) error {
 	}
 }
 
+// queried records a query and restarts the idle timeout.
+func (c *Client) queried() {
+	c.lastQuery.Store(time.Now().UnixNano())
+	if c.idleTimer != nil {
+		c.idleTimer.Reset(c.idleTimeout)
+	}
+}
+
+// Start runs the client until it is disconnected.
 func (c *Client) Start() {
 	defer c.tcpconn.Close()
 
+	if c.idleTimeout > 0 {
+		c.idleTimer = time.AfterFunc(c.idleTimeout, func() {
+			if c.log != nil {
+				c.log.Infof("%v: no query for %v, disconnecting", c, c.idleTimeout)
+			}
+			c.Disconnect()
+		})
+		defer c.idleTimer.Stop()
+	}
+
 	if c.handler != nil {
 		c.handler.ClientConnected(c)
 	}
 
-	ctx, cancel := context.WithCancel(context.TODO())
-	c.cancel = cancel
-	eg, ctx := errgroup.WithContext(ctx)
+	eg, ctx := errgroup.WithContext(c.ctx)
 
 	eg.Go(func() error {
-		return c.sendLoop(ctx)
+		err := c.sendLoop(ctx)
+		// Unblocks readLoop once the pending PDUs are written
+		c.tcpconn.Close()
+		return err
 	})
 
 	eg.Go(func() error {
@@ -845,14 +2160,39 @@ func (c *Client) Start() {
 	})
 
 	eg.Wait()
+	c.Disconnect()
+
+	if c.handler != nil {
+		c.handler.ClientDisconnected(c)
+	}
 }
 
+// Notify sends a Serial Notify without waiting for room in the queue of the
+// client: when it is full, the slow client policy applies.
 func (c *Client) Notify(sessionId uint16, serialNumber uint32) {
 	pdu := &PDUSerialNotify{
+		Version:      c.GetVersion(),
 		SessionId:    sessionId,
 		SerialNumber: serialNumber,
 	}
-	c.SendPDU(pdu)
+	if c.enqueue(pdu, false) {
+		return
+	}
+	switch c.slowPolicy {
+	case SlowClientDropNotify:
+		if c.log != nil {
+			c.log.Debugf("%v: queue full, dropping Serial Notify", c)
+		}
+		c.slow(false)
+	default:
+		if c.log != nil {
+			c.log.Warnf("%v: queue full, disconnecting", c)
+		}
+		c.slow(true)
+		c.Disconnect()
+		// The queued PDUs would not be read either
+		c.tcpconn.Close()
+	}
 }
 
 type VRP struct {
@@ -948,6 +2288,55 @@ func (brk *BgpsecKey) GetFlag() uint8 {
 	return brk.Flags
 }
 
+// VAP is a Validated ASPA Payload: the set of provider ASNs authorized by a customer ASN.
+// Providers should be sorted in ascending order.
+type VAP struct {
+	Flags       uint8
+	CustomerASN uint32
+	Providers   []uint32
+}
+
+func (vap *VAP) Type() string {
+	return "VAP"
+}
+
+func (vap *VAP) String() string {
+	return fmt.Sprintf("VAP AS%v -> %v, Flags: %v", vap.CustomerASN, vap.Providers, vap.Flags)
+}
+
+// A VAP is keyed by its customer ASN only: an announcement for an existing
+// customer replaces the previous provider set.
+func (vap *VAP) HashKey() string {
+	return fmt.Sprintf("%v", vap.CustomerASN)
+}
+
+func (r1 *VAP) Equals(r2 SendableData) bool {
+	if r1.Type() != r2.Type() {
+		return false
+	}
+
+	r2True := r2.(*VAP)
+	return r1.CustomerASN == r2True.CustomerASN && slices.Equal(r1.Providers, r2True.Providers)
+}
+
+func (vap *VAP) Copy() SendableData {
+	cop := VAP{
+		Flags:       vap.Flags,
+		CustomerASN: vap.CustomerASN,
+		Providers:   make([]uint32, len(vap.Providers)),
+	}
+	copy(cop.Providers, vap.Providers)
+	return &cop
+}
+
+func (vap *VAP) SetFlag(f uint8) {
+	vap.Flags = f
+}
+
+func (vap *VAP) GetFlag() uint8 {
+	return vap.Flags
+}
+
 func (c *Client) SendSDs(sessionId uint16, serialNumber uint32, data []SendableData) {
 	pduBegin := &PDUCacheResponse{
 		SessionId: sessionId,
@@ -988,75 +2377,202 @@ func (c *Client) SendNoDataError() {
 	c.SendPDU(pdu)
 }
 
-func (c *Client) SendCorruptData() {
+func (c *Client) SendCorruptData(pduCopy []byte) {
 	pdu := &PDUErrorReport{
 		ErrorCode: PDU_ERROR_CORRUPTDATA,
+		PDUCopy:   pduCopy,
 		ErrorMsg:  "Session ID mismatch: client is desynchronized",
 	}
 	c.SendPDU(pdu)
 }
 
-func (c *Client) SendWrongVersionError() {
+func (c *Client) SendWrongVersionError(pduCopy []byte) {
 	pdu := &PDUErrorReport{
 		ErrorCode: PDU_ERROR_BADPROTOVERSION,
+		PDUCopy:   pduCopy,
 		ErrorMsg:  "Bad protocol version",
 	}
 	c.SendPDU(pdu)
 }
 
+// Reports a PDU received from the client that could not be handled.
+// As per RFC 8210, no Error Report is sent in response to an erroneous Error Report.
+func (c *Client) SendDecodeError(err *DecodeError) {
+	if len(err.PDU) > 1 && err.PDU[1] == PDU_ID_ERROR_REPORT {
+		return
+	}
+	c.SendPDU(err.ErrorReport())
+}
+
 // Converts a SendableData to a PDU and sends it to the client
 func (c *Client) SendData(sd SendableData) {
+	if pdu := sdToPDU(sd, c.GetVersion(), !c.dontSendBGPsecKeys); pdu != nil {
+		c.SendPDU(pdu)
+	}
+}
+
+// sdToPDU converts a SendableData to a PDU of the given version.
+// It returns nil if the data cannot be sent with this version.
+func sdToPDU(sd SendableData, version uint8, bgpsec bool) PDU {
 	switch t := sd.(type) {
 	case *VRP:
-
 		if t.Prefix.Addr().Is6() {
-			pdu := &PDUIPv6Prefix{
-				Flags:  t.Flags,
-				MaxLen: t.MaxLen,
-				ASN:    t.ASN,
-				Prefix: t.Prefix,
+			return &PDUIPv6Prefix{
+				Version: version,
+				Flags:   t.Flags,
+				MaxLen:  t.MaxLen,
+				ASN:     t.ASN,
+				Prefix:  t.Prefix,
 			}
-			c.SendPDU(pdu)
 		} else if t.Prefix.Addr().Is4() {
-			pdu := &PDUIPv4Prefix{
-				Flags:  t.Flags,
-				MaxLen: t.MaxLen,
-				ASN:    t.ASN,
-				Prefix: t.Prefix,
+			return &PDUIPv4Prefix{
+				Version: version,
+				Flags:   t.Flags,
+				MaxLen:  t.MaxLen,
+				ASN:     t.ASN,
+				Prefix:  t.Prefix,
 			}
-			c.SendPDU(pdu)
 		}
 	case *BgpsecKey:
-		if c.version == 0 || c.dontSendBGPsecKeys {
-			return
+		if version == 0 || !bgpsec {
+			return nil
 		}
 
-		pdu := &PDURouterKey{
-			Version:              c.version,
+		return &PDURouterKey{
+			Version:              version,
 			Flags:                t.Flags,
 			SubjectKeyIdentifier: t.Ski,
 			ASN:                  t.ASN,
 			SubjectPublicKeyInfo: t.Pubkey,
 		}
-		c.SendPDU(pdu)
+	case *VAP:
+		if version < PROTOCOL_VERSION_2 {
+			return nil
+		}
+
+		pdu := &PDUASPA{
+			Version:          version,
+			Flags:            t.Flags,
+			CustomerASNumber: t.CustomerASN,
+		}
+		// Withdrawals only carry the customer ASN
+		if t.Flags == FLAG_ADDED {
+			pdu.ProviderASNumbers = t.Providers
+		}
+		return pdu
+	}
+	return nil
+}
+
+// AppendSDs appends the encoding of the data PDUs of a given version to b.
+func AppendSDs(b []byte, version uint8, bgpsec bool, data []SendableData) []byte {
+	for _, sd := range data {
+		if pdu := sdToPDU(sd, version, bgpsec); pdu != nil {
+			b = pdu.AppendBinary(b)
+		}
 	}
+	return b
 }
 
+// encodedPDUs carries data PDUs encoded once and shared between the clients
+// through the transmit queue. It is written as is and never decoded.
+type encodedPDUs struct {
+	version uint8
+	data    []byte
+}
+
+func (pdu *encodedPDUs) String() string {
+	return fmt.Sprintf("Encoded PDUs v%d (%d bytes)", pdu.version, len(pdu.data))
+}
+
+func (pdu *encodedPDUs) Bytes() []byte {
+	return pdu.data
+}
+
+func (pdu *encodedPDUs) AppendBinary(b []byte) []byte {
+	return append(b, pdu.data...)
+}
+
+func (pdu *encodedPDUs) Write(wr io.Writer) {
+	wr.Write(pdu.data)
+}
+
+// The version is the one the data was encoded with and cannot be changed
+func (pdu *encodedPDUs) SetVersion(version uint8) {}
+
+func (pdu *encodedPDUs) GetVersion() uint8 {
+	return pdu.version
+}
+
+// Not an actual PDU type
+func (pdu *encodedPDUs) GetType() uint8 {
+	return 255
+}
+
+// SendEncodedSDs sends a response made of data PDUs encoded for the version of the client
+// (see SendableDataEncoder).
+func (c *Client) SendEncodedSDs(sessionId uint16, serialNumber uint32, data []byte) {
+	pduBegin := &PDUCacheResponse{
+		SessionId: sessionId,
+	}
+	c.SendPDU(pduBegin)
+	if len(data) > 0 {
+		c.SendRawPDU(&encodedPDUs{version: c.GetVersion(), data: data})
+	}
+	pduEnd := &PDUEndOfData{
+		SessionId:    sessionId,
+		SerialNumber: serialNumber,
+
+		RefreshInterval: c.refreshInterval,
+		RetryInterval:   c.retryInterval,
+		ExpireInterval:  c.expireInterval,
+	}
+	c.SendPDU(pduEnd)
+}
+
+// SendRawPDU queues the PDU, waiting for room in the queue of the client
+// unless it is disconnected.
 func (c *Client) SendRawPDU(pdu PDU) {
-	c.transmits <- pdu
+	c.enqueue(pdu, true)
 }
 
 func (c *Client) SendPDU(pdu PDU) {
-	pdu.SetVersion(c.version)
+	pdu.SetVersion(c.GetVersion())
 	c.SendRawPDU(pdu)
 }
 
-func (c *Client) Disconnect() {
-	if c.log != nil {
-		c.log.Infof("Disconnecting client %v", c.String())
-	}
-	if c.handler != nil {
-		c.handler.ClientDisconnected(c)
+// trySendPDU queues a PDU unless the queue is full (eg: a stalled client)
+func (c *Client) trySendPDU(pdu PDU) {
+	pdu.SetVersion(c.GetVersion())
+	c.enqueue(pdu, false)
+}
+
+// enqueue queues the PDU, possibly waiting for room until the client is
+// disconnected. It returns false if the PDU was not queued.
+func (c *Client) enqueue(pdu PDU, wait bool) bool {
+	for {
+		ok, room := c.queue.push(pdu)
+		if ok {
+			return true
+		}
+		if !wait {
+			return false
+		}
+		select {
+		case <-room:
+		case <-c.ctx.Done():
+			return false
+		}
 	}
-	c.cancel()
+}
+
+// Disconnect stops the client after writing the PDUs already queued.
+// The handler is told once the client is stopped.
+func (c *Client) Disconnect() {
+	c.disconnect.Do(func() {
+		if c.log != nil {
+			c.log.Infof("Disconnecting client %v", c.String())
+		}
+		c.cancel()
+	})
 }
@@ -1,14 +1,34 @@
 package rtrlib
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net"
+	"net/http/httptest"
 	"net/netip"
+	"os"
+	"path/filepath"
 	"runtime"
+	"sync"
 	"testing"
+	"time"
 	"unsafe"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
 )
 
 func GenerateVrps(size uint32, offset uint32) []SendableData {
@@ -44,6 +64,117 @@ func BenchmarkComputeDiff100000x1(b *testing.B) {
 	BaseBench(100000, 1)
 }
 
+func benchmarkPDUs() []PDU {
+	return []PDU{
+		&PDUCacheResponse{Version: PROTOCOL_VERSION_2, SessionId: 1},
+		&PDUIPv4Prefix{
+			Version: PROTOCOL_VERSION_2,
+			Prefix:  netip.MustParsePrefix("192.0.2.0/24"),
+			MaxLen:  24,
+			ASN:     64496,
+			Flags:   FLAG_ADDED,
+		},
+		&PDUIPv6Prefix{
+			Version: PROTOCOL_VERSION_2,
+			Prefix:  netip.MustParsePrefix("2001:db8::/32"),
+			MaxLen:  48,
+			ASN:     64496,
+			Flags:   FLAG_ADDED,
+		},
+		&PDUASPA{
+			Version:           PROTOCOL_VERSION_2,
+			Flags:             FLAG_ADDED,
+			CustomerASNumber:  64496,
+			ProviderASNumbers: []uint32{64497, 64498, 64499},
+		},
+		&PDUEndOfData{Version: PROTOCOL_VERSION_2, SessionId: 1, SerialNumber: 2, RefreshInterval: 3600, RetryInterval: 600, ExpireInterval: 7200},
+	}
+}
+
+func BenchmarkPDUBytes(b *testing.B) {
+	pdus := benchmarkPDUs()
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		for _, pdu := range pdus {
+			pdu.Bytes()
+		}
+	}
+}
+
+func BenchmarkPDUAppendBinary(b *testing.B) {
+	pdus := benchmarkPDUs()
+	buf := make([]byte, 0, sendBufferSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		buf = buf[:0]
+		for _, pdu := range pdus {
+			buf = pdu.AppendBinary(buf)
+		}
+	}
+}
+
+// benchmarkSend measures sending a response to a router,
+// reporting the number of writes done on the connection for each response.
+func benchmarkSend(b *testing.B, send func(client *Client)) {
+	srv, cli := net.Pipe()
+
+	reads := 0
+	drained := make(chan struct{})
+	go func() {
+		// Large enough for a read to return a whole write
+		buf := make([]byte, 8<<20)
+		for {
+			if _, err := cli.Read(buf); err != nil {
+				break
+			}
+			reads++
+		}
+		close(drained)
+	}()
+
+	client := ClientFromConn(srv, nil, nil)
+	client.SetVersion(PROTOCOL_VERSION_1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		client.sendLoop(ctx)
+		close(done)
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		send(client)
+	}
+	for n, _ := client.queue.queued(); n > 0; n, _ = client.queue.queued() {
+		runtime.Gosched()
+	}
+	cancel()
+	<-done
+	b.StopTimer()
+
+	srv.Close()
+	<-drained
+	b.ReportMetric(float64(reads)/float64(b.N), "writes/op")
+}
+
+func BenchmarkSendSDs100000(b *testing.B) {
+	vrps := GenerateVrps(100000, 0)
+	benchmarkSend(b, func(client *Client) {
+		client.SendSDs(1, 1, vrps)
+	})
+}
+
+func BenchmarkSendEncodedSDs100000(b *testing.B) {
+	s := NewServer(ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_1}, nil, nil)
+	s.AddData(GenerateVrps(100000, 0))
+	benchmarkSend(b, func(client *Client) {
+		data, serial, _ := s.GetCurrentEncodedSDs(PROTOCOL_VERSION_1, true)
+		client.SendEncodedSDs(1, serial, data)
+	})
+}
+
 func TestComputeDiff(t *testing.T) {
 	newVrps := []VRP{
 		{
@@ -220,6 +351,1515 @@ func TestComputeDiffBGPSEC(t *testing.T) {
 	assert.Equal(t, unchanged[0].(*BgpsecKey).ASN, uint32(65002))
 }
 
+func TestComputeDiffASPA(t *testing.T) {
+	newVaps := []VAP{
+		{
+			CustomerASN: 65001,
+			Providers:   []uint32{65010, 65011},
+		},
+		{
+			CustomerASN: 65002,
+			Providers:   []uint32{65020},
+		},
+		{
+			CustomerASN: 65004,
+			Providers:   []uint32{65040},
+		},
+	}
+	prevVaps := []VAP{
+		{
+			CustomerASN: 65001,
+			Providers:   []uint32{65010},
+		},
+		{
+			CustomerASN: 65002,
+			Providers:   []uint32{65020},
+		},
+		{
+			CustomerASN: 65003,
+			Providers:   []uint32{65030},
+		},
+	}
+
+	newVapsSD, prevVapsAsSD := make([]SendableData, 0), make([]SendableData, 0)
+	for _, v := range newVaps {
+		newVapsSD = append(newVapsSD, v.Copy())
+	}
+	for _, v := range prevVaps {
+		prevVapsAsSD = append(prevVapsAsSD, v.Copy())
+	}
+
+	added, removed, unchanged := ComputeDiff(newVapsSD, prevVapsAsSD, true)
+	// A changed provider set for an existing customer is a replacement, not a withdrawal
+	assert.Len(t, added, 2)
+	assert.Len(t, removed, 1)
+	assert.Len(t, unchanged, 1)
+	assert.Equal(t, added[0].(*VAP).CustomerASN, uint32(65001))
+	assert.Equal(t, added[0].(*VAP).Providers, []uint32{65010, 65011})
+	assert.Equal(t, added[1].(*VAP).CustomerASN, uint32(65004))
+	assert.Equal(t, removed[0].(*VAP).CustomerASN, uint32(65003))
+	assert.Equal(t, unchanged[0].(*VAP).CustomerASN, uint32(65002))
+
+	vaps := ApplyDiff(append(added, removed...), prevVapsAsSD)
+	assert.Len(t, vaps, 4)
+	assert.Equal(t, vaps[0].(*VAP).CustomerASN, uint32(65002))
+	assert.Equal(t, vaps[1].(*VAP).CustomerASN, uint32(65001))
+	assert.Equal(t, vaps[1].(*VAP).Providers, []uint32{65010, 65011})
+	assert.Equal(t, vaps[2].(*VAP).CustomerASN, uint32(65004))
+	assert.Equal(t, vaps[3].(*VAP).CustomerASN, uint32(65003))
+	assert.Equal(t, vaps[3].(*VAP).GetFlag(), uint8(FLAG_REMOVED))
+}
+
+func decodeAllPDUs(t *testing.T, data []byte) []PDU {
+	t.Helper()
+	return readAllPDUs(t, NewPDUReader(bytes.NewReader(data)))
+}
+
+func TestEncodedSDs(t *testing.T) {
+	vrp := &VRP{Prefix: netip.MustParsePrefix("192.0.2.0/24"), MaxLen: 24, ASN: 64496}
+	key := &BgpsecKey{ASN: 64497, Ski: bytes.Repeat([]byte{0x01}, 20), Pubkey: []byte("This is not a real key")}
+	vap := &VAP{CustomerASN: 64498, Providers: []uint32{64499}}
+
+	s := NewServer(ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_2}, nil, nil)
+	s.AddData([]SendableData{vrp, key, vap})
+
+	tests := []struct {
+		desc    string
+		version uint8
+		bgpsec  bool
+		want    []uint8
+	}{{
+		desc:    "Version 0",
+		version: PROTOCOL_VERSION_0,
+		bgpsec:  true,
+		want:    []uint8{PDU_ID_IPV4_PREFIX},
+	}, {
+		desc:    "Version 1",
+		version: PROTOCOL_VERSION_1,
+		bgpsec:  true,
+		want:    []uint8{PDU_ID_IPV4_PREFIX, PDU_ID_ROUTER_KEY},
+	}, {
+		desc:    "Version 1 without BGPsec",
+		version: PROTOCOL_VERSION_1,
+		want:    []uint8{PDU_ID_IPV4_PREFIX},
+	}, {
+		desc:    "Version 2",
+		version: PROTOCOL_VERSION_2,
+		bgpsec:  true,
+		want:    []uint8{PDU_ID_IPV4_PREFIX, PDU_ID_ROUTER_KEY, PDU_ID_ASPA},
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			data, serial, ok := s.GetCurrentEncodedSDs(tc.version, tc.bgpsec)
+			if !ok || serial != 0 {
+				t.Fatalf("Unexpected serial %d (%v)", serial, ok)
+			}
+			got := make([]uint8, 0)
+			for _, pdu := range decodeAllPDUs(t, data) {
+				if pdu.GetVersion() != tc.version {
+					t.Errorf("Wanted version %d, but got %d", tc.version, pdu.GetVersion())
+				}
+				got = append(got, pdu.GetType())
+			}
+			if !cmp.Equal(got, tc.want) {
+				t.Errorf("Wanted PDU types %v, but got %v", tc.want, got)
+			}
+
+			// The encoding is only built once for the serial
+			again, _, _ := s.GetCurrentEncodedSDs(tc.version, tc.bgpsec)
+			if unsafe.SliceData(again) != unsafe.SliceData(data) {
+				t.Errorf("Encoding was built again")
+			}
+		})
+	}
+
+	prev, _, _ := s.GetCurrentEncodedSDs(PROTOCOL_VERSION_1, true)
+	s.AddData([]SendableData{vrp, key})
+
+	diff, serial, ok := s.GetEncodedSDsSerialDiff(0, PROTOCOL_VERSION_2, true)
+	if !ok || serial != 1 {
+		t.Fatalf("Unexpected serial %d (%v)", serial, ok)
+	}
+	want := []PDU{&PDUASPA{Version: PROTOCOL_VERSION_2, Flags: FLAG_REMOVED, CustomerASNumber: 64498, ProviderASNumbers: []uint32{}}}
+	if got := decodeAllPDUs(t, diff); !cmp.Equal(got, want) {
+		t.Errorf("Wanted diff (%v), but got (%v)", want, got)
+	}
+
+	// A new serial invalidates the encodings
+	current, _, _ := s.GetCurrentEncodedSDs(PROTOCOL_VERSION_1, true)
+	if unsafe.SliceData(current) == unsafe.SliceData(prev) {
+		t.Errorf("Encoding was not rebuilt for the new serial")
+	}
+
+	if _, _, ok := s.GetEncodedSDsSerialDiff(5, PROTOCOL_VERSION_1, true); ok {
+		t.Errorf("Wanted no diff for an unknown serial")
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	const (
+		updaters = 8
+		updates  = 50
+	)
+	s := NewServer(ServerConfiguration{KeepDifference: 5}, nil, nil)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	readerErr := make(chan error, 1)
+	go func() {
+		defer close(readerErr)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// Each update adds one VRP: the data must match its serial
+			data, serial, _ := s.GetCurrentEncodedSDs(PROTOCOL_VERSION_1, true)
+			if len(data) == 0 {
+				continue
+			}
+			if n := len(data) / 32; n != int(serial)+1 {
+				readerErr <- fmt.Errorf("serial %d has %d VRPs", serial, n)
+				return
+			}
+			// The diff may be from a later update, but always with its serial
+			if diff, to, ok := s.GetEncodedSDsSerialDiff(serial-1, PROTOCOL_VERSION_1, true); serial > 0 && ok {
+				if n := len(diff) / 32; n != int(to-serial)+1 {
+					readerErr <- fmt.Errorf("diff from serial %d to %d has %d VRPs", serial-1, to, n)
+					return
+				}
+			}
+		}
+	}()
+
+	for i := 0; i < updaters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < updates; j++ {
+				vrp := GenerateVrps(1, uint32(i*updates+j))[0]
+				vrp.SetFlag(FLAG_ADDED)
+				s.AddSDsDiff([]SendableData{vrp})
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	if err := <-readerErr; err != nil {
+		t.Error(err)
+	}
+
+	// No update is lost
+	if n := s.CountSDs(); n != updaters*updates {
+		t.Errorf("Wanted %d VRPs, but got %d", updaters*updates, n)
+	}
+	serial, _ := s.GetCurrentSerial()
+	if serial != updaters*updates-1 {
+		t.Errorf("Wanted serial %d, but got %d", updaters*updates-1, serial)
+	}
+	diff, ok := s.GetSDsSerialDiff(serial - 5)
+	if !ok || len(diff) != 5 {
+		t.Errorf("Wanted a diff of 5 VRPs, but got %d (%v)", len(diff), ok)
+	}
+}
+
+func TestSerialDiffHistory(t *testing.T) {
+	a := &VRP{Prefix: netip.MustParsePrefix("192.0.2.0/24"), MaxLen: 24, ASN: 64496}
+	b := &VRP{Prefix: netip.MustParsePrefix("198.51.100.0/24"), MaxLen: 24, ASN: 64496}
+	c := &VRP{Prefix: netip.MustParsePrefix("203.0.113.0/24"), MaxLen: 24, ASN: 64496}
+	vap1 := &VAP{CustomerASN: 64500, Providers: []uint32{64501}}
+	vap2 := &VAP{CustomerASN: 64500, Providers: []uint32{64502}}
+
+	s := NewServer(ServerConfiguration{}, nil, nil)
+	updates := [][]SendableData{
+		{a, b, vap1}, // serial 0
+		{a, c, vap2}, // serial 1
+		{a, vap2},    // serial 2
+		{a, b, vap1}, // serial 3
+		{a, b},       // serial 4
+	}
+	for _, data := range updates {
+		s.AddData(data)
+	}
+
+	withFlag := func(sd SendableData, flag uint8) SendableData {
+		sd = sd.Copy()
+		sd.SetFlag(flag)
+		return sd
+	}
+	tests := []struct {
+		desc   string
+		serial uint32
+		want   []SendableData
+	}{{
+		desc:   "Up to date",
+		serial: 4,
+		want:   []SendableData{},
+	}, {
+		desc:   "ASPA withdrawn",
+		serial: 3,
+		want:   []SendableData{withFlag(vap1, FLAG_REMOVED)},
+	}, {
+		desc:   "Removed object added back",
+		serial: 2,
+		want:   []SendableData{withFlag(b, FLAG_ADDED), withFlag(vap1, FLAG_REMOVED)},
+	}, {
+		desc:   "Added object removed again",
+		serial: 1,
+		want:   []SendableData{withFlag(c, FLAG_REMOVED), withFlag(b, FLAG_ADDED), withFlag(vap2, FLAG_REMOVED)},
+	}, {
+		desc:   "Changes cancelling out",
+		serial: 0,
+		want:   []SendableData{withFlag(vap1, FLAG_REMOVED)},
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, ok := s.GetSDsSerialDiff(tc.serial)
+			if !ok {
+				t.Fatalf("No diff from serial %d", tc.serial)
+			}
+			if !cmp.Equal(ConvertSDListToMap(got), ConvertSDListToMap(tc.want)) {
+				t.Errorf("Wanted %v, but got %v", tc.want, got)
+			}
+		})
+	}
+
+	if _, ok := s.GetSDsSerialDiff(5); ok {
+		t.Error("Wanted no diff from a future serial")
+	}
+}
+
+func BenchmarkAddDataHistory(b *testing.B) {
+	s := NewServer(ServerConfiguration{KeepDifference: 256}, nil, nil)
+	for i := 0; i < 256; i++ {
+		s.AddData(GenerateVrps(10000, uint32(i*100)))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.AddData(GenerateVrps(10000, uint32((256+i)*100)))
+	}
+}
+
+func TestSerialDiffRetention(t *testing.T) {
+	tests := []struct {
+		desc    string
+		config  ServerConfiguration
+		oldest  uint32
+		between time.Duration
+	}{{
+		desc:   "Unlimited",
+		oldest: 0,
+	}, {
+		desc:   "By count",
+		config: ServerConfiguration{KeepDifference: 3},
+		oldest: 7,
+	}, {
+		desc:    "By age",
+		config:  ServerConfiguration{KeepDifferenceAge: time.Hour},
+		oldest:  0,
+		between: time.Millisecond,
+	}, {
+		desc:    "By short age",
+		config:  ServerConfiguration{KeepDifferenceAge: time.Microsecond},
+		oldest:  10,
+		between: time.Millisecond,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			s := NewServer(tc.config, nil, nil)
+			for i := uint32(0); i <= 10; i++ {
+				s.AddData(GenerateVrps(10, i))
+				time.Sleep(tc.between)
+			}
+			serial, _ := s.GetCurrentSerial()
+			if serial != 10 {
+				t.Fatalf("Wanted serial 10, but got %d", serial)
+			}
+			if _, ok := s.GetSDsSerialDiff(tc.oldest); !ok {
+				t.Errorf("Wanted a diff from serial %d", tc.oldest)
+			}
+			if tc.oldest > 0 {
+				if _, ok := s.GetSDsSerialDiff(tc.oldest - 1); ok {
+					t.Errorf("Wanted no diff from serial %d", tc.oldest-1)
+				}
+			}
+			diff, _ := s.GetSDsSerialDiff(tc.oldest)
+			if want := 2 * int(serial-tc.oldest); len(diff) != want {
+				t.Errorf("Wanted %d changes, but got %d", want, len(diff))
+			}
+		})
+	}
+}
+
+func TestSerialDiffAgeWithoutUpdate(t *testing.T) {
+	s := NewServer(ServerConfiguration{KeepDifferenceAge: 50 * time.Millisecond}, nil, nil)
+	for i := uint32(0); i <= 2; i++ {
+		s.AddData(GenerateVrps(10, i))
+	}
+	if _, ok := s.GetSDsSerialDiff(0); !ok {
+		t.Fatal("Wanted a diff from serial 0")
+	}
+
+	// The diff expires even if no update drops it
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := s.GetSDsSerialDiff(0); ok {
+		t.Error("Wanted no diff from serial 0 after the age limit")
+	}
+	if _, _, ok := s.GetEncodedSDsSerialDiff(0, PROTOCOL_VERSION_1, false); ok {
+		t.Error("Wanted no encoded diff from serial 0 after the age limit")
+	}
+	if _, ok := s.GetSDsSerialDiff(2); !ok {
+		t.Error("Wanted the current serial to stay up to date")
+	}
+}
+
+func TestClientRequestCacheEncoded(t *testing.T) {
+	s := NewServer(ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_1}, nil, nil)
+	s.AddData(GenerateVrps(10, 0))
+	h := &DefaultRTREventHandler{}
+	h.SetSDManager(s)
+
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	client := ClientFromConn(srv, nil, h)
+	go client.Start()
+
+	if _, err := cli.Write((&PDUResetQuery{Version: PROTOCOL_VERSION_1}).Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rd := NewPDUReader(cli)
+	types := make([]uint8, 0)
+	for {
+		pdu, err := rd.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, pdu.GetType())
+		if pdu.GetType() == PDU_ID_END_OF_DATA {
+			break
+		}
+	}
+	if len(types) != 12 || types[0] != PDU_ID_CACHE_RESPONSE || types[1] != PDU_ID_IPV6_PREFIX {
+		t.Errorf("Unexpected response %v", types)
+	}
+}
+
+func TestSerialWrap(t *testing.T) {
+	s := NewServer(ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_1}, nil, nil)
+	s.AddData(GenerateVrps(10, 0))
+	// Start right before the serial wraps around
+	snap := s.sdSnapshot.Load()
+	s.sdSnapshot.Store(&sdSnapshot{
+		sessionIds: snap.sessionIds,
+		serial:     math.MaxUint32 - 1,
+		current:    snap.current,
+		encoded:    make(map[encodingKey]*encodedSDs),
+	})
+	for i := uint32(1); i <= 3; i++ {
+		s.AddData(GenerateVrps(10, i))
+	}
+
+	serial, _ := s.GetCurrentSerial()
+	if serial != 1 {
+		t.Fatalf("Wanted serial 1, but got %d", serial)
+	}
+
+	tests := []struct {
+		desc    string
+		serial  uint32
+		changes int
+		ok      bool
+	}{
+		{"Before wrap", math.MaxUint32 - 1, 6, true},
+		{"Last before wrap", math.MaxUint32, 4, true},
+		{"After wrap", 0, 2, true},
+		{"Current", 1, 0, true},
+		{"Future", 2, 0, false},
+		{"Too old", math.MaxUint32 - 2, 0, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			diff, ok := s.GetSDsSerialDiff(tc.serial)
+			if ok != tc.ok || len(diff) != tc.changes {
+				t.Errorf("Wanted %d changes (%v), but got %d (%v)", tc.changes, tc.ok, len(diff), ok)
+			}
+		})
+	}
+
+	// A router querying from before the wrap gets the diff
+	h := &DefaultRTREventHandler{}
+	h.SetSDManager(s)
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	client := ClientFromConn(srv, nil, h)
+	go client.Start()
+
+	query := &PDUSerialQuery{
+		Version:      PROTOCOL_VERSION_1,
+		SessionId:    s.GetSessionId(PROTOCOL_VERSION_1),
+		SerialNumber: math.MaxUint32,
+	}
+	if _, err := cli.Write(query.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rd := NewPDUReader(cli)
+	var prefixes int
+	for {
+		pdu, err := rd.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pdu.GetType() == PDU_ID_IPV6_PREFIX {
+			prefixes++
+		}
+		if eod, ok := pdu.(*PDUEndOfData); ok {
+			if eod.SerialNumber != 1 {
+				t.Errorf("Wanted serial 1, but got %d", eod.SerialNumber)
+			}
+			break
+		}
+	}
+	if prefixes != 4 {
+		t.Errorf("Wanted 4 prefixes, but got %d", prefixes)
+	}
+}
+
+func TestAddDataSerial(t *testing.T) {
+	s := NewServer(ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_1}, nil, nil)
+	if updated, err := s.AddDataSerial(nil, 1000); updated || err != nil {
+		t.Errorf("Wanted no update without data, but got %v (%v)", updated, err)
+	}
+
+	steps := []struct {
+		desc    string
+		data    []SendableData
+		serial  uint32
+		updated bool
+		err     error
+		want    uint32
+	}{
+		{"Initial", GenerateVrps(10, 0), 1000, true, nil, 1000},
+		{"Changed", GenerateVrps(10, 1), 2000, true, nil, 2000},
+		{"Unchanged with a new serial", GenerateVrps(10, 1), 3000, true, nil, 3000},
+		{"Unchanged with the same serial", GenerateVrps(10, 1), 3000, false, nil, 3000},
+		{"Changed with the same serial", GenerateVrps(10, 2), 3000, false, ErrSerialNotAfter, 3000},
+		{"Changed with an older serial", GenerateVrps(10, 2), 2500, false, ErrSerialNotAfter, 3000},
+		{"Unchanged with an older serial", GenerateVrps(10, 1), 2500, false, nil, 3000},
+		{"Changed with a new serial", GenerateVrps(10, 2), 4000, true, nil, 4000},
+	}
+	for _, step := range steps {
+		updated, err := s.AddDataSerial(step.data, step.serial)
+		if updated != step.updated || !errors.Is(err, step.err) {
+			t.Errorf("%s: wanted updated %v (%v), but got %v (%v)", step.desc, step.updated, step.err, updated, err)
+		}
+		if serial, _ := s.GetCurrentSerial(); serial != step.want {
+			t.Errorf("%s: wanted serial %d, but got %d", step.desc, step.want, serial)
+		}
+	}
+
+	tests := []struct {
+		desc    string
+		serial  uint32
+		changes int
+		ok      bool
+	}{
+		{"From first", 1000, 4, true},
+		{"From unchanged", 2000, 2, true},
+		{"From new serial", 3000, 2, true},
+		{"Current", 4000, 0, true},
+		{"Unknown", 1500, 0, false},
+		{"Future", 5000, 0, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			diff, ok := s.GetSDsSerialDiff(tc.serial)
+			if ok != tc.ok || len(diff) != tc.changes {
+				t.Errorf("Wanted %d changes (%v), but got %d (%v)", tc.changes, tc.ok, len(diff), ok)
+			}
+		})
+	}
+}
+
+func TestConfiguredSessionIds(t *testing.T) {
+	tests := []struct {
+		desc   string
+		config ServerConfiguration
+		want   []uint16
+	}{
+		{"All versions", ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_2, SessId: 1234}, []uint16{1234, 1234, 1234}},
+		{"Zero", ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_1, SessId: 0}, []uint16{0, 0}},
+		{"Explicit", ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_1, SessId: 1234, SessIds: []uint16{7, 8}}, []uint16{7, 8}},
+		{"Partial", ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_2, SessId: 1234, SessIds: []uint16{7}}, []uint16{7, 1234, 1234}},
+		{"Only explicit", ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_1, SessId: -1, SessIds: []uint16{0, 8}}, []uint16{0, 8}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			s := NewServer(tc.config, nil, nil)
+			for version, want := range tc.want {
+				if got := s.GetSessionId(uint8(version)); got != want {
+					t.Errorf("Wanted session ID %d for version %d, but got %d", want, version, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRotateSession(t *testing.T) {
+	s := NewServer(ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_1, SessId: 1234}, nil, nil)
+	s.AddData(GenerateVrps(10, 0))
+	s.AddData(GenerateVrps(10, 1))
+	s.RotateSession()
+
+	if got := s.GetSessionId(PROTOCOL_VERSION_1); got != 1235 {
+		t.Errorf("Wanted session ID 1235, but got %d", got)
+	}
+	if !s.IsPreviousSessionId(PROTOCOL_VERSION_1, 1234) || s.IsPreviousSessionId(PROTOCOL_VERSION_1, 1235) {
+		t.Error("Wanted only session ID 1234 to be a previous one")
+	}
+	if serial, valid := s.GetCurrentSerial(); serial != 1 || !valid || s.CountSDs() != 10 {
+		t.Errorf("Wanted serial 1 with 10 objects, but got serial %d (%v) with %d", serial, valid, s.CountSDs())
+	}
+	if _, ok := s.GetSDsSerialDiff(0); ok {
+		t.Error("Wanted the diff history to be dropped")
+	}
+	s.AddData(GenerateVrps(10, 2))
+	if _, ok := s.GetSDsSerialDiff(1); !ok {
+		t.Error("Wanted a diff from the serial of the rotation")
+	}
+
+	tests := []struct {
+		desc      string
+		sessionId uint16
+		want      uint8
+	}{
+		{"Previous session", 1234, PDU_ID_CACHE_RESET},
+		{"Current session", 1235, PDU_ID_CACHE_RESPONSE},
+		{"Unknown session", 1236, PDU_ID_ERROR_REPORT},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			h := &DefaultRTREventHandler{}
+			h.SetSDManager(s)
+			srv, cli := net.Pipe()
+			defer cli.Close()
+			client := ClientFromConn(srv, nil, h)
+			go client.Start()
+
+			query := &PDUSerialQuery{
+				Version:      PROTOCOL_VERSION_1,
+				SessionId:    tc.sessionId,
+				SerialNumber: 1,
+			}
+			if _, err := cli.Write(query.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+			pdu, err := NewPDUReader(cli).Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pdu.GetType() != tc.want {
+				t.Errorf("Wanted PDU type %d, but got %v", tc.want, pdu)
+			}
+		})
+	}
+}
+
+type countingEventHandler struct {
+	resets chan struct{}
+}
+
+func (h *countingEventHandler) RequestCache(c *Client) {
+	h.resets <- struct{}{}
+}
+
+func (h *countingEventHandler) RequestNewVersion(c *Client, sessionId uint16, serial uint32) {}
+
+func TestClientCoalescedPDUs(t *testing.T) {
+	srv, cli := net.Pipe()
+	defer cli.Close()
+
+	h := &countingEventHandler{resets: make(chan struct{}, 3)}
+	client := ClientFromConn(srv, nil, h)
+	go client.Start()
+
+	// Three Reset Queries in a single write, the last one being split in two
+	data := concatPDUs([]PDU{
+		&PDUResetQuery{Version: PROTOCOL_VERSION_1},
+		&PDUResetQuery{Version: PROTOCOL_VERSION_1},
+		&PDUResetQuery{Version: PROTOCOL_VERSION_1},
+	})
+	if _, err := cli.Write(data[:20]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Write(data[20:]); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-h.resets:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only received %d Reset Queries", i)
+		}
+	}
+}
+
+func TestClientCoalescesResponse(t *testing.T) {
+	srv, cli := net.Pipe()
+	defer cli.Close()
+
+	client := ClientFromConn(srv, nil, nil)
+	client.SetVersion(PROTOCOL_VERSION_1)
+	go client.Start()
+	defer client.Disconnect()
+
+	vrps := GenerateVrps(10, 0)
+	client.SendSDs(1, 2, vrps)
+
+	// The whole response is written at once when End of Data is sent
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, sendBufferSize)
+	n, err := cli.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pdus := readAllPDUs(t, NewPDUReader(bytes.NewReader(buf[:n])))
+	if len(pdus) != len(vrps)+2 {
+		t.Fatalf("Wanted %d PDUs in a single write, but got %d", len(vrps)+2, len(pdus))
+	}
+	if _, ok := pdus[len(pdus)-1].(*PDUEndOfData); !ok {
+		t.Errorf("Wanted End of Data last, but got (%v)", pdus[len(pdus)-1])
+	}
+}
+
+type slowEventHandler struct {
+	slow chan bool
+}
+
+func (h *slowEventHandler) ClientConnected(c *Client)               {}
+func (h *slowEventHandler) ClientDisconnected(c *Client)            {}
+func (h *slowEventHandler) HandlePDU(c *Client, pdu PDU)            {}
+func (h *slowEventHandler) ClientSlow(c *Client, disconnected bool) { h.slow <- disconnected }
+
+func TestClientWriteTimeout(t *testing.T) {
+	srv, cli := net.Pipe()
+	defer cli.Close()
+
+	h := &slowEventHandler{slow: make(chan bool, 1)}
+	client := ClientFromConn(srv, h, nil)
+	client.SetVersion(PROTOCOL_VERSION_1)
+	client.SetWriteTimeout(50 * time.Millisecond)
+	stopped := make(chan struct{})
+	go func() {
+		client.Start()
+		close(stopped)
+	}()
+
+	// The router does not read the response
+	client.SendSDs(1, 1, GenerateVrps(10, 0))
+	select {
+	case disconnected := <-h.slow:
+		if !disconnected {
+			t.Error("Wanted the client to be disconnected")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write did not time out")
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client not stopped")
+	}
+}
+
+func TestClientSlowPolicy(t *testing.T) {
+	tests := []struct {
+		policy       SlowClientPolicy
+		disconnected bool
+	}{
+		{SlowClientDisconnect, true},
+		{SlowClientDropNotify, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			srv, cli := net.Pipe()
+			defer cli.Close()
+
+			h := &slowEventHandler{slow: make(chan bool, 1)}
+			client := ClientFromConn(srv, h, nil)
+			client.SetVersion(PROTOCOL_VERSION_1)
+			// Room for a single Serial Notify
+			client.SetSendQueue(12, tc.policy)
+			go client.Start()
+			defer client.Disconnect()
+
+			// The first one is being written, the second one is queued
+			for i := uint32(0); i < 3; i++ {
+				client.Notify(1, i)
+				if i == 0 {
+					for n, _ := client.queue.queued(); n > 0; n, _ = client.queue.queued() {
+						runtime.Gosched()
+					}
+				}
+			}
+			select {
+			case disconnected := <-h.slow:
+				if disconnected != tc.disconnected {
+					t.Errorf("Wanted disconnected %v, but got %v", tc.disconnected, disconnected)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Slow client not reported")
+			}
+
+			cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+			rd := NewPDUReader(cli)
+			if tc.disconnected {
+				// The connection is closed, possibly while writing the first one
+				for {
+					pdu, err := rd.Next()
+					if errors.Is(err, os.ErrDeadlineExceeded) {
+						t.Fatal("Wanted the client to be disconnected")
+					} else if err != nil {
+						break
+					}
+					if pdu.(*PDUSerialNotify).SerialNumber != 0 {
+						t.Errorf("Wanted only the first Serial Notify, but got %v", pdu)
+					}
+				}
+				return
+			}
+			for i := uint32(0); i < 2; i++ {
+				pdu, err := rd.Next()
+				if err != nil || pdu.(*PDUSerialNotify).SerialNumber != i {
+					t.Errorf("Wanted Serial Notify %d, but got %v (%v)", i, pdu, err)
+				}
+			}
+		})
+	}
+}
+
+func TestIdleTimeoutConfiguration(t *testing.T) {
+	tests := []struct {
+		desc   string
+		config ServerConfiguration
+		want   time.Duration
+	}{
+		{"Expire interval", ServerConfiguration{}, 7200 * time.Second},
+		{"Configured expire interval", ServerConfiguration{ExpireInterval: 600}, 600 * time.Second},
+		{"Configured", ServerConfiguration{IdleTimeout: time.Hour}, time.Hour},
+		{"Disabled", ServerConfiguration{IdleTimeout: -1}, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := NewServer(tc.config, nil, nil).idleTimeout; got != tc.want {
+				t.Errorf("Wanted %v, but got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestClientIdleTimeout(t *testing.T) {
+	srv, cli := net.Pipe()
+	defer cli.Close()
+
+	h := &countingEventHandler{resets: make(chan struct{}, 1)}
+	client := ClientFromConn(srv, nil, h)
+	client.SetIdleTimeout(200 * time.Millisecond)
+	stopped := make(chan struct{})
+	go func() {
+		client.Start()
+		close(stopped)
+	}()
+
+	if !client.GetLastQueryTime().IsZero() {
+		t.Error("Wanted no query time before the first query")
+	}
+	query := &PDUResetQuery{Version: PROTOCOL_VERSION_1}
+	if _, err := cli.Write(query.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	<-h.resets
+	queried := client.GetLastQueryTime()
+	if queried.IsZero() {
+		t.Fatal("Wanted the time of the query")
+	}
+
+	select {
+	case <-stopped:
+		if idle := time.Since(queried); idle < 200*time.Millisecond {
+			t.Errorf("Wanted the client to be disconnected after 200ms, but it was after %v", idle)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Idle client not disconnected")
+	}
+}
+
+func TestGetClientsInfo(t *testing.T) {
+	s := NewServer(ServerConfiguration{}, nil, nil)
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	client := ClientFromConn(srv, nil, nil)
+	s.ClientConnected(client)
+	client.lastQuery.Store(time.Now().Add(-time.Minute).UnixNano())
+
+	rec := httptest.NewRecorder()
+	s.GetClientsInfo(rec, httptest.NewRequest("GET", "/clients", nil))
+	var info []ClientInfo
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if len(info) != 1 || info[0].RemoteAddr != "pipe" || info[0].LastQuery == nil {
+		t.Fatalf("Unexpected clients %+v", info)
+	}
+	if info[0].Idle < 60 || info[0].Idle > 120 {
+		t.Errorf("Wanted about 60s since the last query, but got %v", info[0].Idle)
+	}
+	if info[0].ID != client.GetID() || info[0].Transport != "tcp" || info[0].Serial != nil {
+		t.Errorf("Unexpected client %+v", info[0])
+	}
+	if s.GetClient(client.GetID()) != client || s.GetClient(0) != nil {
+		t.Error("Wanted the client to be found by its ID")
+	}
+}
+
+func TestClientSentCounters(t *testing.T) {
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	client := ClientFromConn(srv, nil, nil)
+	client.SetVersion(PROTOCOL_VERSION_1)
+	go client.Start()
+	defer client.Disconnect()
+
+	encoded := concatPDUs([]PDU{
+		&PDUIPv4Prefix{Version: PROTOCOL_VERSION_1, Prefix: netip.MustParsePrefix("192.0.2.0/24"), MaxLen: 24, ASN: 64496},
+		&PDUIPv6Prefix{Version: PROTOCOL_VERSION_1, Prefix: netip.MustParsePrefix("2001:db8::/32"), MaxLen: 48, ASN: 64496},
+	})
+	client.SendCacheReset()
+	client.SendEncodedSDs(1, 42, encoded)
+	want := uint64(8 + 8 + len(encoded) + 24)
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(cli, make([]byte, want)); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); client.GetBytesSent() < want && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pdus, bytes := client.GetPDUsSent(), client.GetBytesSent(); pdus != 5 || bytes != want {
+		t.Errorf("Wanted 5 PDUs and %d bytes sent, but got %d PDUs and %d bytes", want, pdus, bytes)
+	}
+}
+
+func TestClientSendsDecodeError(t *testing.T) {
+	tests := []struct {
+		desc string
+		pdu  []byte
+		code uint16
+	}{{
+		desc: "Unknown PDU type",
+		pdu:  []byte{1, 42, 0, 0, 0, 0, 0, 8},
+		code: PDU_ERROR_BADPDUTYPE,
+	}, {
+		desc: "Cache Response from router",
+		pdu:  (&PDUCacheResponse{Version: PROTOCOL_VERSION_1, SessionId: 1}).Bytes(),
+		code: PDU_ERROR_INVALIDREQUEST,
+	}, {
+		desc: "Oversized PDU",
+		pdu:  []byte{1, PDU_ID_RESET_QUERY, 0, 0, 0xff, 0xff, 0xff, 0xff},
+		code: PDU_ERROR_CORRUPTDATA,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			srv, cli := net.Pipe()
+			defer cli.Close()
+
+			client := ClientFromConn(srv, nil, nil)
+			go client.Start()
+
+			if _, err := cli.Write(tc.pdu); err != nil {
+				t.Fatal(err)
+			}
+
+			cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+			pdu, err := Decode(cli)
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, ok := pdu.(*PDUErrorReport)
+			if !ok {
+				t.Fatalf("Wanted an Error Report, but got (%v)", pdu)
+			}
+			if report.ErrorCode != tc.code {
+				t.Errorf("Wanted code %d, but got %d", tc.code, report.ErrorCode)
+			}
+			if !bytes.Equal(report.PDUCopy, tc.pdu) {
+				t.Errorf("Wanted PDU copy %x, but got %x", tc.pdu, report.PDUCopy)
+			}
+
+			// The server disconnects after the report
+			if _, err := Decode(cli); err == nil {
+				t.Errorf("Wanted the connection to be closed")
+			}
+		})
+	}
+}
+
+// waitGoroutines waits for the number of goroutines to go back to n.
+func waitGoroutines(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines left running, wanted %d:\n%s", runtime.NumGoroutine(), n, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+
+	// Servers can be started and stopped repeatedly
+	for i := 0; i < 3; i++ {
+		s := NewServer(ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_1, NotifyShutdown: true}, nil, nil)
+		s.AddData(GenerateVrps(10, 0))
+		h := &DefaultRTREventHandler{}
+		h.SetSDManager(s)
+		s.simpleHandler = h
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		served := make(chan error)
+		go func() {
+			served <- s.loopTCP(l, TransportTCP, s.acceptClientTCP)
+		}()
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write((&PDUResetQuery{Version: PROTOCOL_VERSION_1}).Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		rd := NewPDUReader(conn)
+		for {
+			pdu, err := rd.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pdu.GetType() == PDU_ID_END_OF_DATA {
+				break
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := s.Shutdown(ctx); err != nil {
+			t.Fatalf("Shutdown failed: %v", err)
+		}
+		cancel()
+		if err := <-served; err != ErrServerClosed {
+			t.Errorf("Wanted ErrServerClosed, but got (%v)", err)
+		}
+
+		// The client is told before being disconnected
+		pdu, err := rd.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report, ok := pdu.(*PDUErrorReport); !ok || report.ErrorCode != PDU_ERROR_INTERNALERR {
+			t.Errorf("Wanted an Error Report, but got (%v)", pdu)
+		}
+		if _, err := rd.Next(); err != io.EOF {
+			t.Errorf("Wanted the connection to be closed, but got (%v)", err)
+		}
+		conn.Close()
+
+		if len(s.GetClientList()) != 0 {
+			t.Errorf("Clients left after shutdown: %v", s.GetClientList())
+		}
+		if err := s.Start("127.0.0.1:0"); err != ErrServerClosed {
+			t.Errorf("Wanted ErrServerClosed when starting again, but got (%v)", err)
+		}
+	}
+
+	waitGoroutines(t, goroutines)
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+
+	s := NewServer(ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_1}, nil, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- s.loopTCP(l, TransportTCP, func(conn net.Conn) error {
+			// A connection handler that does not stop by itself
+			io.Copy(io.Discard, conn)
+			return nil
+		})
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Wait for the connection to be accepted and mark it as used by a
+	// client, so that only the timeout closes it.
+	for accepted := false; !accepted; time.Sleep(10 * time.Millisecond) {
+		s.lifecycleLock.Lock()
+		for _, tc := range s.conns {
+			tc.used = true
+			accepted = true
+		}
+		s.lifecycleLock.Unlock()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wanted DeadlineExceeded, but got (%v)", err)
+	}
+	<-served
+
+	waitGoroutines(t, goroutines)
+}
+
+func TestServeUnix(t *testing.T) {
+	s := NewServer(ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_1}, nil, nil)
+	s.AddData(GenerateVrps(10, 0))
+	h := &DefaultRTREventHandler{}
+	h.SetSDManager(s)
+	s.simpleHandler = h
+
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "rtr.sock"))
+	if err != nil {
+		t.Skipf("unix sockets not supported: %v", err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- s.Serve(l, TransportTCP)
+	}()
+
+	conn, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write((&PDUResetQuery{Version: PROTOCOL_VERSION_1}).Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	rd := NewPDUReader(conn)
+	var prefixes int
+	for {
+		pdu, err := rd.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pdu.GetType() == PDU_ID_IPV4_PREFIX || pdu.GetType() == PDU_ID_IPV6_PREFIX {
+			prefixes++
+		}
+		if pdu.GetType() == PDU_ID_END_OF_DATA {
+			break
+		}
+	}
+	if prefixes != 10 {
+		t.Errorf("Wanted 10 prefixes, but got %d", prefixes)
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Wanted ErrServerClosed, but got (%v)", err)
+	}
+}
+
+type rejectingEventHandler struct {
+	slowEventHandler
+	rejected chan RejectReason
+}
+
+func (h *rejectingEventHandler) ConnectionRejected(conn net.Conn, transport Transport, reason RejectReason) {
+	h.rejected <- reason
+}
+
+func TestServeACL(t *testing.T) {
+	h := &rejectingEventHandler{rejected: make(chan RejectReason, 1)}
+	s := NewServer(ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_1}, h, nil)
+	s.SetACL(TransportTCP, &ACL{Rules: []ACLRule{{Allow: true, Prefix: netip.MustParsePrefix("192.0.2.0/24")}}})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- s.Serve(l, TransportTCP)
+	}()
+	defer func() {
+		s.Shutdown(context.Background())
+		<-served
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case reason := <-h.rejected:
+		if reason != RejectACL {
+			t.Errorf("Wanted the connection to be rejected by the ACL, but got %v", reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection not rejected")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Wanted the connection to be closed")
+	}
+
+	// The ACL is replaced while serving
+	s.SetACL(TransportTCP, &ACL{Rules: []ACLRule{{Allow: true, Prefix: netip.MustParsePrefix("127.0.0.0/8")}}})
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write((&PDUResetQuery{Version: PROTOCOL_VERSION_1}).Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	// Without a handler for the query, the client stays connected
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Wanted the connection to stay open, but got (%v)", err)
+	}
+	select {
+	case reason := <-h.rejected:
+		t.Errorf("Wanted the connection to be accepted, but it was rejected (%v)", reason)
+	default:
+	}
+}
+
+// addrConn overrides the remote address of a connection
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestConnectionLimits(t *testing.T) {
+	s := NewServer(ServerConfiguration{MaxConn: 4, MaxConnPerListener: 2, MaxConnPerIP: 1}, nil, nil)
+	l1, l2 := &net.TCPListener{}, &net.TCPListener{}
+	s.trackListener(l1)
+	s.trackListener(l2)
+
+	newConn := func(addr net.Addr) net.Conn {
+		c1, c2 := net.Pipe()
+		t.Cleanup(func() { c2.Close() })
+		return &addrConn{Conn: c1, addr: addr}
+	}
+	tcpAddr := func(addr string) net.Addr {
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(netip.MustParseAddr(addr), 323))
+	}
+
+	var first net.Conn
+	tests := []struct {
+		desc     string
+		listener net.Listener
+		addr     net.Addr
+		want     RejectReason
+	}{
+		{"First", l1, tcpAddr("192.0.2.1"), ""},
+		{"Same address", l1, tcpAddr("192.0.2.1"), RejectIPMaxConn},
+		{"Other address", l1, tcpAddr("192.0.2.2"), ""},
+		{"Listener full", l1, tcpAddr("192.0.2.3"), RejectListenerMaxConn},
+		{"Other listener", l2, tcpAddr("192.0.2.3"), ""},
+		{"Mapped address", l2, tcpAddr("::ffff:192.0.2.1"), RejectIPMaxConn},
+		{"Unix socket", l2, &net.UnixAddr{Name: "@", Net: "unix"}, ""},
+		{"Server full", l2, tcpAddr("192.0.2.4"), RejectMaxConn},
+	}
+	for _, tc := range tests {
+		conn := newConn(tc.addr)
+		connected, _, reason := s.trackConn(conn, tc.listener)
+		if reason != tc.want {
+			t.Errorf("%s: wanted %q, but got %q", tc.desc, tc.want, reason)
+		}
+		if reason == "" && connected != s.GetConnectionCount() {
+			t.Errorf("%s: wanted %d connections, but got %d", tc.desc, s.GetConnectionCount(), connected)
+		}
+		if first == nil {
+			first = conn
+		}
+	}
+	if got := s.GetConnectionCount(); got != 4 {
+		t.Errorf("Wanted 4 connections, but got %d", got)
+	}
+
+	// Closing a connection frees its slots
+	s.untrackConn(first)
+	if _, _, reason := s.trackConn(newConn(tcpAddr("192.0.2.1")), l1); reason != "" {
+		t.Errorf("Wanted the connection to be accepted after closing the first one, but got %q", reason)
+	}
+}
+
+func TestServeMaxConnPerIP(t *testing.T) {
+	h := &rejectingEventHandler{rejected: make(chan RejectReason, 1)}
+	s := NewServer(ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_1, MaxConnPerIP: 1}, h, nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- s.Serve(l, TransportTCP)
+	}()
+	defer func() {
+		s.Shutdown(context.Background())
+		<-served
+	}()
+
+	first, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case reason := <-h.rejected:
+		if reason != RejectIPMaxConn {
+			t.Errorf("Wanted the connection to be rejected by the limit per IP, but got %v", reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection not rejected")
+	}
+
+	// The slot of the address is released once the first connection is closed
+	first.Close()
+	for s.GetConnectionCount() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Wanted the connection to stay open, but got (%v)", err)
+	}
+	select {
+	case reason := <-h.rejected:
+		t.Errorf("Wanted the connection to be accepted, but it was rejected (%v)", reason)
+	default:
+	}
+}
+
+// newTestCertificate returns a certificate for 127.0.0.1 signed by parent,
+// or self-signed without a parent.
+func newTestCertificate(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, key.Public(), signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestServeTLSClientCertificate(t *testing.T) {
+	ca := newTestCertificate(t, "Test CA", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	view := &View{Name: "router1", Data: NewServer(ServerConfiguration{}, nil, nil), TLSSubjects: []string{"CN=router1"}}
+	s := NewServer(ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_1, Views: Views{view}}, nil, nil)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{newTestCertificate(t, "server", &ca)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- s.Serve(l, TransportTLS)
+	}()
+	defer func() {
+		s.Shutdown(context.Background())
+		<-served
+	}()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		Certificates: []tls.Certificate{newTestCertificate(t, "router1", &ca)},
+		RootCAs:      pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var clients []*Client
+	for deadline := time.Now().Add(5 * time.Second); len(clients) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		clients = s.GetClientList()
+	}
+	if len(clients) != 1 {
+		t.Fatalf("Wanted 1 client, but got %d", len(clients))
+	}
+	if id := clients[0].GetIdentity(); id != "CN=router1" {
+		t.Errorf("Wanted identity CN=router1, but got %q", id)
+	}
+	if clients[0].GetView() != view {
+		t.Errorf("Wanted the view of the certificate, but got %v", clients[0].GetView())
+	}
+
+	// A router without a certificate is not served
+	conn, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: pool})
+	if err == nil {
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+	}
+	if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Wanted the handshake to fail, but got (%v)", err)
+	}
+	if clients := s.GetClientList(); len(clients) != 1 {
+		t.Errorf("Wanted 1 client, but got %d", len(clients))
+	}
+}
+
+func TestServeSSHUser(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "secret" {
+				return nil, errors.New("wrong password")
+			}
+			return &ssh.Permissions{}, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	s := NewServer(ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_1}, nil, nil)
+	s.SetSSHConfig(config)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- s.Serve(l, TransportSSH)
+	}()
+	defer func() {
+		s.Shutdown(context.Background())
+		<-served
+	}()
+
+	conn, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User:            "router1",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if err := session.RequestSubsystem("rpki-rtr"); err != nil {
+		t.Fatal(err)
+	}
+
+	var clients []*Client
+	for deadline := time.Now().Add(5 * time.Second); len(clients) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		clients = s.GetClientList()
+	}
+	if len(clients) != 1 {
+		t.Fatalf("Wanted 1 client, but got %d", len(clients))
+	}
+	if user := clients[0].GetSSHUser(); user != "router1" {
+		t.Errorf("Wanted SSH user router1, but got %q", user)
+	}
+	if id := clients[0].GetIdentity(); id != "router1" {
+		t.Errorf("Wanted identity router1, but got %q", id)
+	}
+}
+
+func TestServeSSHWithoutConfig(t *testing.T) {
+	s := NewServer(ServerConfiguration{}, nil, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(l, TransportSSH); err == nil {
+		t.Error("Wanted an error when serving SSH without configuration")
+	}
+	// The listener is closed
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Wanted the listener to be closed, but got (%v)", err)
+	}
+}
+
 func TestVRPStructSize(t *testing.T) {
 	if a := runtime.GOARCH; a != "amd64" {
 		t.Skipf("skipping, running on %s but this test is hard-coded for amd64 architecture", a)
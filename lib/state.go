@@ -0,0 +1,233 @@
+package rtrlib
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const stateFormatVersion = 1
+
+var ErrStateVersion = errors.New("unsupported state format version")
+
+// ServerState is a copy of the session IDs, serial, data and diff history
+// of a Server. It can be saved and restored by a later instance so that the
+// routers resume their sessions with Serial Queries.
+type ServerState struct {
+	// Time at which the state was taken
+	Saved time.Time
+	// Opaque data stored along with the state by the caller
+	Metadata []byte
+
+	snapshot *sdSnapshot
+}
+
+// State returns the current state of the server.
+func (s *Server) State() *ServerState {
+	return &ServerState{
+		Saved:    time.Now(),
+		snapshot: s.sdSnapshot.Load(),
+	}
+}
+
+// RestoreState replaces the session IDs and the data of the server by the
+// ones of the state. It must be called before serving clients.
+func (s *Server) RestoreState(state *ServerState) {
+	s.sdUpdateLock.Lock()
+	defer s.sdUpdateLock.Unlock()
+
+	// A state saved with a lower protocol version keeps the new session IDs
+	sessionIds := slices.Clone(s.sdSnapshot.Load().sessionIds)
+	copy(sessionIds, state.snapshot.sessionIds)
+	s.sdSnapshot.Store(&sdSnapshot{
+		sessionIds:     sessionIds,
+		prevSessionIds: state.snapshot.prevSessionIds,
+		serial:         state.snapshot.serial,
+		current:        state.snapshot.current,
+		deltas:         state.snapshot.deltas,
+		encoded:        make(map[encodingKey]*encodedSDs),
+	})
+}
+
+// Serial returns the serial of the data in the state.
+func (st *ServerState) Serial() uint32 {
+	return st.snapshot.serial
+}
+
+// Count returns the number of objects in the state.
+func (st *ServerState) Count() int {
+	return len(st.snapshot.current)
+}
+
+// Serialized form of the state
+type stateFile struct {
+	Version        int
+	Saved          time.Time
+	Metadata       []byte
+	SessionIds     []uint16
+	PrevSessionIds [][]uint16
+	Serial         uint32
+	Current        []stateSD
+	Deltas         []stateDelta
+}
+
+type stateDelta struct {
+	Serial  uint32
+	Time    time.Time
+	Changes []stateChange
+}
+
+type stateChange struct {
+	SD   stateSD
+	Prev stateSD
+}
+
+// stateSD holds one of the SendableData types, or none
+type stateSD struct {
+	VRP *VRP
+	Key *BgpsecKey
+	VAP *VAP
+}
+
+func newStateSD(sd SendableData) stateSD {
+	switch sd := sd.(type) {
+	case *VRP:
+		return stateSD{VRP: sd}
+	case *BgpsecKey:
+		return stateSD{Key: sd}
+	case *VAP:
+		return stateSD{VAP: sd}
+	}
+	return stateSD{}
+}
+
+func (ssd stateSD) sendableData() SendableData {
+	switch {
+	case ssd.VRP != nil:
+		return ssd.VRP
+	case ssd.Key != nil:
+		return ssd.Key
+	case ssd.VAP != nil:
+		return ssd.VAP
+	}
+	return nil
+}
+
+// Write writes the state to w.
+func (st *ServerState) Write(w io.Writer) error {
+	snap := st.snapshot
+	sf := stateFile{
+		Version:        stateFormatVersion,
+		Saved:          st.Saved,
+		Metadata:       st.Metadata,
+		SessionIds:     snap.sessionIds,
+		PrevSessionIds: snap.prevSessionIds,
+		Serial:         snap.serial,
+		Current:        make([]stateSD, 0, len(snap.current)),
+		Deltas:         make([]stateDelta, len(snap.deltas)),
+	}
+	for _, sd := range snap.current {
+		if ssd := newStateSD(sd); ssd.sendableData() != nil {
+			sf.Current = append(sf.Current, ssd)
+		}
+	}
+	for i, delta := range snap.deltas {
+		sf.Deltas[i] = stateDelta{
+			Serial:  delta.serial,
+			Time:    delta.time,
+			Changes: make([]stateChange, len(delta.changes)),
+		}
+		for j, c := range delta.changes {
+			sf.Deltas[i].Changes[j] = stateChange{SD: newStateSD(c.sd), Prev: newStateSD(c.prev)}
+		}
+	}
+	return gob.NewEncoder(w).Encode(&sf)
+}
+
+// ReadState reads a state written by ServerState.Write.
+func ReadState(r io.Reader) (*ServerState, error) {
+	var sf stateFile
+	if err := gob.NewDecoder(r).Decode(&sf); err != nil {
+		return nil, err
+	}
+	if sf.Version != stateFormatVersion {
+		return nil, fmt.Errorf("%w: %d", ErrStateVersion, sf.Version)
+	}
+
+	snap := &sdSnapshot{
+		sessionIds:     sf.SessionIds,
+		prevSessionIds: sf.PrevSessionIds,
+		serial:         sf.Serial,
+		current:        make([]SendableData, 0, len(sf.Current)),
+		deltas:         make([]*sdDelta, len(sf.Deltas)),
+	}
+	for _, ssd := range sf.Current {
+		if sd := ssd.sendableData(); sd != nil {
+			snap.current = append(snap.current, sd)
+		}
+	}
+	for i, d := range sf.Deltas {
+		delta := &sdDelta{
+			serial:  d.Serial,
+			time:    d.Time,
+			changes: make([]sdChange, 0, len(d.Changes)),
+		}
+		for _, c := range d.Changes {
+			sd := c.SD.sendableData()
+			if sd == nil {
+				return nil, errors.New("state contains an empty change")
+			}
+			delta.changes = append(delta.changes, sdChange{sd: sd, prev: c.Prev.sendableData()})
+		}
+		snap.deltas[i] = delta
+	}
+
+	return &ServerState{
+		Saved:    sf.Saved,
+		Metadata: sf.Metadata,
+		snapshot: snap,
+	}, nil
+}
+
+// WriteFile atomically replaces the file at path with the state.
+func (st *ServerState) WriteFile(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	wr := bufio.NewWriter(f)
+	if err := st.Write(wr); err != nil {
+		f.Close()
+		return err
+	}
+	if err := wr.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// ReadStateFile reads a state written by ServerState.WriteFile.
+func ReadStateFile(path string) (*ServerState, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadState(bufio.NewReader(f))
+}
@@ -0,0 +1,94 @@
+package rtrlib
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStateRestore(t *testing.T) {
+	vrp := &VRP{Prefix: netip.MustParsePrefix("192.0.2.0/24"), MaxLen: 24, ASN: 64496}
+	key := &BgpsecKey{ASN: 64497, Ski: bytes.Repeat([]byte{0x01}, 20), Pubkey: []byte("This is not a real key")}
+	vap1 := &VAP{CustomerASN: 64498, Providers: []uint32{64499}}
+	vap2 := &VAP{CustomerASN: 64498, Providers: []uint32{64499, 64500}}
+
+	s := NewServer(ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_2}, nil, nil)
+	s.AddData([]SendableData{vrp, vap1})
+	s.AddData([]SendableData{vrp, key, vap2})
+	s.AddData([]SendableData{key, vap2})
+
+	state := s.State()
+	state.Metadata = []byte("metadata")
+	path := filepath.Join(t.TempDir(), "stayrtr.state")
+	if err := state.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := ReadStateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(loaded.Metadata) != "metadata" || !loaded.Saved.Equal(state.Saved) {
+		t.Errorf("Unexpected metadata %q saved at %v", loaded.Metadata, loaded.Saved)
+	}
+	if loaded.Serial() != 2 || loaded.Count() != 2 {
+		t.Errorf("Wanted serial 2 with 2 objects, but got serial %d with %d objects", loaded.Serial(), loaded.Count())
+	}
+
+	restored := NewServer(ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_2}, nil, nil)
+	restored.RestoreState(loaded)
+
+	for _, version := range []uint8{PROTOCOL_VERSION_0, PROTOCOL_VERSION_1, PROTOCOL_VERSION_2} {
+		if got, want := restored.GetSessionId(version), s.GetSessionId(version); got != want {
+			t.Errorf("Wanted session ID %d for version %d, but got %d", want, version, got)
+		}
+	}
+	serial, valid := restored.GetCurrentSerial()
+	if serial != 2 || !valid {
+		t.Errorf("Wanted serial 2, but got %d (%v)", serial, valid)
+	}
+	for from := uint32(0); from <= 2; from++ {
+		want, _, _ := s.GetEncodedSDsSerialDiff(from, PROTOCOL_VERSION_2, true)
+		got, _, ok := restored.GetEncodedSDsSerialDiff(from, PROTOCOL_VERSION_2, true)
+		if !ok || !bytes.Equal(got, want) {
+			t.Errorf("Diff from serial %d differs after restoring: %x, want %x", from, got, want)
+		}
+	}
+	want, _, _ := s.GetCurrentEncodedSDs(PROTOCOL_VERSION_2, true)
+	got, _, _ := restored.GetCurrentEncodedSDs(PROTOCOL_VERSION_2, true)
+	if !bytes.Equal(got, want) {
+		t.Errorf("Data differs after restoring: %x, want %x", got, want)
+	}
+
+	// Updates continue from the restored data
+	restored.AddData([]SendableData{key})
+	diff, ok := restored.GetSDsSerialDiff(1)
+	if !ok || !cmp.Equal(ConvertSDListToMap(diff), map[string]uint8{vrp.HashKey(): FLAG_REMOVED, vap2.HashKey(): FLAG_REMOVED}) {
+		t.Errorf("Unexpected diff after restoring: %v", diff)
+	}
+
+	// The file is replaced atomically
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Wanted only the state file, but got %v", entries)
+	}
+}
+
+func TestStateVersion(t *testing.T) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&stateFile{Version: stateFormatVersion + 1, Saved: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadState(&buf); !errors.Is(err, ErrStateVersion) {
+		t.Errorf("Wanted ErrStateVersion, but got (%v)", err)
+	}
+}
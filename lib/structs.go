@@ -2,12 +2,14 @@ package rtrlib
 
 import (
 	"bytes"
+	"crypto/x509"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net/netip"
+	"unicode/utf8"
 )
 
 type Logger interface {
@@ -30,6 +32,7 @@ const (
 
 	PROTOCOL_VERSION_0 = 0
 	PROTOCOL_VERSION_1 = 1
+	PROTOCOL_VERSION_2 = 2
 
 	PDU_ID_SERIAL_NOTIFY  = 0
 	PDU_ID_SERIAL_QUERY   = 1
@@ -41,6 +44,7 @@ const (
 	PDU_ID_CACHE_RESET    = 8
 	PDU_ID_ROUTER_KEY     = 9
 	PDU_ID_ERROR_REPORT   = 10
+	PDU_ID_ASPA           = 11
 
 	FLAG_ADDED   = 1
 	FLAG_REMOVED = 0
@@ -53,6 +57,7 @@ const (
 	PDU_ERROR_BADPDUTYPE      = 5
 	PDU_ERROR_WITHDRAWUNKNOWN = 6
 	PDU_ERROR_DUPANNOUNCE     = 7
+	PDU_ERROR_UNEXPECTEDPROTO = 8
 
 	AFI_IPv4 = uint8(0)
 	AFI_IPv6 = uint8(1)
@@ -65,6 +70,8 @@ const (
 
 type PDU interface {
 	Bytes() []byte
+	// AppendBinary appends the wire encoding of the PDU to the slice and returns it
+	AppendBinary([]byte) []byte
 	Write(io.Writer)
 	String() string
 	SetVersion(uint8)
@@ -72,6 +79,12 @@ type PDU interface {
 	GetType() uint8
 }
 
+func appendHeader(b []byte, version uint8, pduType uint8, sessionId uint16, length uint32) []byte {
+	b = append(b, version, pduType)
+	b = binary.BigEndian.AppendUint16(b, sessionId)
+	return binary.BigEndian.AppendUint32(b, length)
+}
+
 func TypeToString(t uint8) string {
 	switch t {
 	case PDU_ID_SERIAL_NOTIFY:
@@ -94,18 +107,49 @@ func TypeToString(t uint8) string {
 		return "Router Key"
 	case PDU_ID_ERROR_REPORT:
 		return "Error Report"
+	case PDU_ID_ASPA:
+		return "ASPA"
 	default:
 		return fmt.Sprintf("Unknown type %d", t)
 	}
 }
 
+func ErrorCodeToString(code uint16) string {
+	switch code {
+	case PDU_ERROR_CORRUPTDATA:
+		return "Corrupt Data"
+	case PDU_ERROR_INTERNALERR:
+		return "Internal Error"
+	case PDU_ERROR_NODATA:
+		return "No Data Available"
+	case PDU_ERROR_INVALIDREQUEST:
+		return "Invalid Request"
+	case PDU_ERROR_BADPROTOVERSION:
+		return "Unsupported Protocol Version"
+	case PDU_ERROR_BADPDUTYPE:
+		return "Unsupported PDU Type"
+	case PDU_ERROR_WITHDRAWUNKNOWN:
+		return "Withdrawal of Unknown Record"
+	case PDU_ERROR_DUPANNOUNCE:
+		return "Duplicate Announcement Received"
+	case PDU_ERROR_UNEXPECTEDPROTO:
+		return "Unexpected Protocol Version"
+	default:
+		return fmt.Sprintf("Unknown error %d", code)
+	}
+}
+
 func IsCorrectPDUVersion(pdu PDU, version uint8) bool {
-	if version > 1 {
+	if version > PROTOCOL_VERSION_2 {
 		return false
 	}
 	switch pdu.(type) {
 	case *PDURouterKey:
-		if version == 0 {
+		if version == PROTOCOL_VERSION_0 {
+			return false
+		}
+	case *PDUASPA:
+		if version < PROTOCOL_VERSION_2 {
 			return false
 		}
 	}
@@ -123,9 +167,7 @@ func (pdu *PDUSerialNotify) String() string {
 }
 
 func (pdu *PDUSerialNotify) Bytes() []byte {
-	b := bytes.NewBuffer([]byte{})
-	pdu.Write(b)
-	return b.Bytes()
+	return pdu.AppendBinary(make([]byte, 0, 12))
 }
 
 func (pdu *PDUSerialNotify) SetVersion(version uint8) {
@@ -140,12 +182,13 @@ func (pdu *PDUSerialNotify) GetType() uint8 {
 	return PDU_ID_SERIAL_NOTIFY
 }
 
+func (pdu *PDUSerialNotify) AppendBinary(b []byte) []byte {
+	b = appendHeader(b, pdu.Version, PDU_ID_SERIAL_NOTIFY, pdu.SessionId, 12)
+	return binary.BigEndian.AppendUint32(b, pdu.SerialNumber)
+}
+
 func (pdu *PDUSerialNotify) Write(wr io.Writer) {
-	binary.Write(wr, binary.BigEndian, uint8(pdu.Version))
-	binary.Write(wr, binary.BigEndian, uint8(PDU_ID_SERIAL_NOTIFY))
-	binary.Write(wr, binary.BigEndian, pdu.SessionId)
-	binary.Write(wr, binary.BigEndian, uint32(12))
-	binary.Write(wr, binary.BigEndian, uint32(pdu.SerialNumber))
+	wr.Write(pdu.Bytes())
 }
 
 type PDUSerialQuery struct {
@@ -159,9 +202,7 @@ func (pdu *PDUSerialQuery) String() string {
 }
 
 func (pdu *PDUSerialQuery) Bytes() []byte {
-	b := bytes.NewBuffer([]byte{})
-	pdu.Write(b)
-	return b.Bytes()
+	return pdu.AppendBinary(make([]byte, 0, 12))
 }
 
 func (pdu *PDUSerialQuery) SetVersion(version uint8) {
@@ -176,12 +217,13 @@ func (pdu *PDUSerialQuery) GetType() uint8 {
 	return PDU_ID_SERIAL_QUERY
 }
 
+func (pdu *PDUSerialQuery) AppendBinary(b []byte) []byte {
+	b = appendHeader(b, pdu.Version, PDU_ID_SERIAL_QUERY, pdu.SessionId, 12)
+	return binary.BigEndian.AppendUint32(b, pdu.SerialNumber)
+}
+
 func (pdu *PDUSerialQuery) Write(wr io.Writer) {
-	binary.Write(wr, binary.BigEndian, uint8(pdu.Version))
-	binary.Write(wr, binary.BigEndian, uint8(PDU_ID_SERIAL_QUERY))
-	binary.Write(wr, binary.BigEndian, pdu.SessionId)
-	binary.Write(wr, binary.BigEndian, uint32(12))
-	binary.Write(wr, binary.BigEndian, uint32(pdu.SerialNumber))
+	wr.Write(pdu.Bytes())
 }
 
 type PDUResetQuery struct {
@@ -193,9 +235,7 @@ func (pdu *PDUResetQuery) String() string {
 }
 
 func (pdu *PDUResetQuery) Bytes() []byte {
-	b := bytes.NewBuffer([]byte{})
-	pdu.Write(b)
-	return b.Bytes()
+	return pdu.AppendBinary(make([]byte, 0, 8))
 }
 
 func (pdu *PDUResetQuery) SetVersion(version uint8) {
@@ -210,11 +250,12 @@ func (pdu *PDUResetQuery) GetType() uint8 {
 	return PDU_ID_RESET_QUERY
 }
 
+func (pdu *PDUResetQuery) AppendBinary(b []byte) []byte {
+	return appendHeader(b, pdu.Version, PDU_ID_RESET_QUERY, 0, 8)
+}
+
 func (pdu *PDUResetQuery) Write(wr io.Writer) {
-	binary.Write(wr, binary.BigEndian, uint8(pdu.Version))
-	binary.Write(wr, binary.BigEndian, uint8(PDU_ID_RESET_QUERY))
-	binary.Write(wr, binary.BigEndian, uint16(0))
-	binary.Write(wr, binary.BigEndian, uint32(8))
+	wr.Write(pdu.Bytes())
 }
 
 type PDUCacheResponse struct {
@@ -227,9 +268,7 @@ func (pdu *PDUCacheResponse) String() string {
 }
 
 func (pdu *PDUCacheResponse) Bytes() []byte {
-	b := bytes.NewBuffer([]byte{})
-	pdu.Write(b)
-	return b.Bytes()
+	return pdu.AppendBinary(make([]byte, 0, 8))
 }
 
 func (pdu *PDUCacheResponse) SetVersion(version uint8) {
@@ -244,11 +283,12 @@ func (pdu *PDUCacheResponse) GetType() uint8 {
 	return PDU_ID_CACHE_RESPONSE
 }
 
+func (pdu *PDUCacheResponse) AppendBinary(b []byte) []byte {
+	return appendHeader(b, pdu.Version, PDU_ID_CACHE_RESPONSE, pdu.SessionId, 8)
+}
+
 func (pdu *PDUCacheResponse) Write(wr io.Writer) {
-	binary.Write(wr, binary.BigEndian, uint8(pdu.Version))
-	binary.Write(wr, binary.BigEndian, uint8(PDU_ID_CACHE_RESPONSE))
-	binary.Write(wr, binary.BigEndian, pdu.SessionId)
-	binary.Write(wr, binary.BigEndian, uint32(8))
+	wr.Write(pdu.Bytes())
 }
 
 type PDUIPv4Prefix struct {
@@ -264,9 +304,7 @@ func (pdu *PDUIPv4Prefix) String() string {
 }
 
 func (pdu *PDUIPv4Prefix) Bytes() []byte {
-	b := bytes.NewBuffer([]byte{})
-	pdu.Write(b)
-	return b.Bytes()
+	return pdu.AppendBinary(make([]byte, 0, 20))
 }
 
 func (pdu *PDUIPv4Prefix) SetVersion(version uint8) {
@@ -281,17 +319,16 @@ func (pdu *PDUIPv4Prefix) GetType() uint8 {
 	return PDU_ID_IPV4_PREFIX
 }
 
+func (pdu *PDUIPv4Prefix) AppendBinary(b []byte) []byte {
+	b = appendHeader(b, pdu.Version, PDU_ID_IPV4_PREFIX, 0, 20)
+	b = append(b, pdu.Flags, uint8(pdu.Prefix.Bits()), pdu.MaxLen, 0)
+	addr := pdu.Prefix.Addr().As4()
+	b = append(b, addr[:]...)
+	return binary.BigEndian.AppendUint32(b, pdu.ASN)
+}
+
 func (pdu *PDUIPv4Prefix) Write(wr io.Writer) {
-	binary.Write(wr, binary.BigEndian, uint8(pdu.Version))
-	binary.Write(wr, binary.BigEndian, uint8(PDU_ID_IPV4_PREFIX))
-	binary.Write(wr, binary.BigEndian, uint16(0))
-	binary.Write(wr, binary.BigEndian, uint32(20))
-	binary.Write(wr, binary.BigEndian, pdu.Flags)
-	binary.Write(wr, binary.BigEndian, uint8(pdu.Prefix.Bits()))
-	binary.Write(wr, binary.BigEndian, pdu.MaxLen)
-	binary.Write(wr, binary.BigEndian, uint8(0))
-	binary.Write(wr, binary.BigEndian, pdu.Prefix.Addr().As4())
-	binary.Write(wr, binary.BigEndian, pdu.ASN)
+	wr.Write(pdu.Bytes())
 }
 
 type PDUIPv6Prefix struct {
@@ -307,9 +344,7 @@ func (pdu *PDUIPv6Prefix) String() string {
 }
 
 func (pdu *PDUIPv6Prefix) Bytes() []byte {
-	b := bytes.NewBuffer([]byte{})
-	pdu.Write(b)
-	return b.Bytes()
+	return pdu.AppendBinary(make([]byte, 0, 32))
 }
 
 func (pdu *PDUIPv6Prefix) SetVersion(version uint8) {
@@ -324,17 +359,16 @@ func (pdu *PDUIPv6Prefix) GetType() uint8 {
 	return PDU_ID_IPV6_PREFIX
 }
 
+func (pdu *PDUIPv6Prefix) AppendBinary(b []byte) []byte {
+	b = appendHeader(b, pdu.Version, PDU_ID_IPV6_PREFIX, 0, 32)
+	b = append(b, pdu.Flags, uint8(pdu.Prefix.Bits()), pdu.MaxLen, 0)
+	addr := pdu.Prefix.Addr().As16()
+	b = append(b, addr[:]...)
+	return binary.BigEndian.AppendUint32(b, pdu.ASN)
+}
+
 func (pdu *PDUIPv6Prefix) Write(wr io.Writer) {
-	binary.Write(wr, binary.BigEndian, uint8(pdu.Version))
-	binary.Write(wr, binary.BigEndian, uint8(PDU_ID_IPV6_PREFIX))
-	binary.Write(wr, binary.BigEndian, uint16(0))
-	binary.Write(wr, binary.BigEndian, uint32(32))
-	binary.Write(wr, binary.BigEndian, pdu.Flags)
-	binary.Write(wr, binary.BigEndian, uint8(pdu.Prefix.Bits()))
-	binary.Write(wr, binary.BigEndian, pdu.MaxLen)
-	binary.Write(wr, binary.BigEndian, uint8(0))
-	binary.Write(wr, binary.BigEndian, pdu.Prefix.Addr().As16())
-	binary.Write(wr, binary.BigEndian, pdu.ASN)
+	wr.Write(pdu.Bytes())
 }
 
 type PDUEndOfData struct {
@@ -353,9 +387,7 @@ func (pdu *PDUEndOfData) String() string {
 }
 
 func (pdu *PDUEndOfData) Bytes() []byte {
-	b := bytes.NewBuffer([]byte{})
-	pdu.Write(b)
-	return b.Bytes()
+	return pdu.AppendBinary(make([]byte, 0, 24))
 }
 
 func (pdu *PDUEndOfData) SetVersion(version uint8) {
@@ -370,21 +402,20 @@ func (pdu *PDUEndOfData) GetType() uint8 {
 	return PDU_ID_END_OF_DATA
 }
 
-func (pdu *PDUEndOfData) Write(wr io.Writer) {
-	binary.Write(wr, binary.BigEndian, uint8(pdu.Version))
-	binary.Write(wr, binary.BigEndian, uint8(PDU_ID_END_OF_DATA))
-	binary.Write(wr, binary.BigEndian, pdu.SessionId)
-
+func (pdu *PDUEndOfData) AppendBinary(b []byte) []byte {
 	if pdu.Version == PROTOCOL_VERSION_0 {
-		binary.Write(wr, binary.BigEndian, uint32(12))
-		binary.Write(wr, binary.BigEndian, pdu.SerialNumber)
-	} else {
-		binary.Write(wr, binary.BigEndian, uint32(24))
-		binary.Write(wr, binary.BigEndian, pdu.SerialNumber)
-		binary.Write(wr, binary.BigEndian, pdu.RefreshInterval)
-		binary.Write(wr, binary.BigEndian, pdu.RetryInterval)
-		binary.Write(wr, binary.BigEndian, pdu.ExpireInterval)
+		b = appendHeader(b, pdu.Version, PDU_ID_END_OF_DATA, pdu.SessionId, 12)
+		return binary.BigEndian.AppendUint32(b, pdu.SerialNumber)
 	}
+	b = appendHeader(b, pdu.Version, PDU_ID_END_OF_DATA, pdu.SessionId, 24)
+	b = binary.BigEndian.AppendUint32(b, pdu.SerialNumber)
+	b = binary.BigEndian.AppendUint32(b, pdu.RefreshInterval)
+	b = binary.BigEndian.AppendUint32(b, pdu.RetryInterval)
+	return binary.BigEndian.AppendUint32(b, pdu.ExpireInterval)
+}
+
+func (pdu *PDUEndOfData) Write(wr io.Writer) {
+	wr.Write(pdu.Bytes())
 }
 
 type PDUCacheReset struct {
@@ -396,9 +427,7 @@ func (pdu *PDUCacheReset) String() string {
 }
 
 func (pdu *PDUCacheReset) Bytes() []byte {
-	b := bytes.NewBuffer([]byte{})
-	pdu.Write(b)
-	return b.Bytes()
+	return pdu.AppendBinary(make([]byte, 0, 8))
 }
 
 func (pdu *PDUCacheReset) SetVersion(version uint8) {
@@ -413,11 +442,12 @@ func (pdu *PDUCacheReset) GetType() uint8 {
 	return PDU_ID_CACHE_RESET
 }
 
+func (pdu *PDUCacheReset) AppendBinary(b []byte) []byte {
+	return appendHeader(b, pdu.Version, PDU_ID_CACHE_RESET, 0, 8)
+}
+
 func (pdu *PDUCacheReset) Write(wr io.Writer) {
-	binary.Write(wr, binary.BigEndian, uint8(pdu.Version))
-	binary.Write(wr, binary.BigEndian, uint8(PDU_ID_CACHE_RESET))
-	binary.Write(wr, binary.BigEndian, uint16(0))
-	binary.Write(wr, binary.BigEndian, uint32(8))
+	wr.Write(pdu.Bytes())
 }
 
 type PDURouterKey struct {
@@ -433,9 +463,7 @@ func (pdu *PDURouterKey) String() string {
 }
 
 func (pdu *PDURouterKey) Bytes() []byte {
-	b := bytes.NewBuffer([]byte{})
-	pdu.Write(b)
-	return b.Bytes()
+	return pdu.AppendBinary(make([]byte, 0, 32+len(pdu.SubjectPublicKeyInfo)))
 }
 
 func (pdu *PDURouterKey) SetVersion(version uint8) {
@@ -450,19 +478,20 @@ func (pdu *PDURouterKey) GetType() uint8 {
 	return PDU_ID_ROUTER_KEY
 }
 
-func (pdu *PDURouterKey) Write(wr io.Writer) {
+func (pdu *PDURouterKey) AppendBinary(b []byte) []byte {
 	if len(pdu.SubjectKeyIdentifier) != 20 {
-		return
+		return b
 	}
 
-	binary.Write(wr, binary.BigEndian, uint8(pdu.Version))
-	binary.Write(wr, binary.BigEndian, uint8(PDU_ID_ROUTER_KEY))
-	binary.Write(wr, binary.BigEndian, uint8(pdu.Flags))
-	binary.Write(wr, binary.BigEndian, uint8(0))
-	binary.Write(wr, binary.BigEndian, uint32(32+len(pdu.SubjectPublicKeyInfo)))
-	wr.Write(pdu.SubjectKeyIdentifier)
-	binary.Write(wr, binary.BigEndian, pdu.ASN)
-	wr.Write(pdu.SubjectPublicKeyInfo)
+	// Router Key uses the spot of the SessionID for its flags
+	b = appendHeader(b, pdu.Version, PDU_ID_ROUTER_KEY, uint16(pdu.Flags)<<8, uint32(32+len(pdu.SubjectPublicKeyInfo)))
+	b = append(b, pdu.SubjectKeyIdentifier...)
+	b = binary.BigEndian.AppendUint32(b, pdu.ASN)
+	return append(b, pdu.SubjectPublicKeyInfo...)
+}
+
+func (pdu *PDURouterKey) Write(wr io.Writer) {
+	wr.Write(pdu.Bytes())
 }
 
 type PDUErrorReport struct {
@@ -477,9 +506,7 @@ func (pdu *PDUErrorReport) String() string {
 }
 
 func (pdu *PDUErrorReport) Bytes() []byte {
-	b := bytes.NewBuffer([]byte{})
-	pdu.Write(b)
-	return b.Bytes()
+	return pdu.AppendBinary(make([]byte, 0, 17+len(pdu.PDUCopy)+len(pdu.ErrorMsg)))
 }
 
 func (pdu *PDUErrorReport) SetVersion(version uint8) {
@@ -494,73 +521,184 @@ func (pdu *PDUErrorReport) GetType() uint8 {
 	return PDU_ID_ERROR_REPORT
 }
 
-func (pdu *PDUErrorReport) Write(wr io.Writer) {
+func (pdu *PDUErrorReport) AppendBinary(b []byte) []byte {
 	nonnull := (pdu.ErrorMsg != "")
 	addlen := 0
 	if nonnull {
 		addlen = 1
 	}
 
-	binary.Write(wr, binary.BigEndian, uint8(pdu.Version))
-	binary.Write(wr, binary.BigEndian, uint8(PDU_ID_ERROR_REPORT))
-	binary.Write(wr, binary.BigEndian, pdu.ErrorCode)
-	binary.Write(wr, binary.BigEndian, uint32(12+len(pdu.PDUCopy)+4+len(pdu.ErrorMsg)+addlen))
-	binary.Write(wr, binary.BigEndian, uint32(len(pdu.PDUCopy)))
-	binary.Write(wr, binary.BigEndian, pdu.PDUCopy)
-	binary.Write(wr, binary.BigEndian, uint32(len(pdu.ErrorMsg)+addlen))
+	b = appendHeader(b, pdu.Version, PDU_ID_ERROR_REPORT, pdu.ErrorCode, uint32(12+len(pdu.PDUCopy)+4+len(pdu.ErrorMsg)+addlen))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(pdu.PDUCopy)))
+	b = append(b, pdu.PDUCopy...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(pdu.ErrorMsg)+addlen))
 	if nonnull {
-		binary.Write(wr, binary.BigEndian, []byte(pdu.ErrorMsg))
-		binary.Write(wr, binary.BigEndian, uint8(0))
+		b = append(b, pdu.ErrorMsg...)
 		// Some clients require null-terminated strings
+		b = append(b, 0)
+	}
+	return b
+}
+
+func (pdu *PDUErrorReport) Write(wr io.Writer) {
+	wr.Write(pdu.Bytes())
+}
+
+type PDUASPA struct {
+	Version           uint8
+	Flags             uint8
+	CustomerASNumber  uint32
+	ProviderASNumbers []uint32
+}
+
+func (pdu *PDUASPA) String() string {
+	return fmt.Sprintf("PDU ASPA v%d, customer: AS%d, providers: %v, flags: %d", pdu.Version, pdu.CustomerASNumber, pdu.ProviderASNumbers, pdu.Flags)
+}
+
+func (pdu *PDUASPA) Bytes() []byte {
+	return pdu.AppendBinary(make([]byte, 0, 12+4*len(pdu.ProviderASNumbers)))
+}
+
+func (pdu *PDUASPA) SetVersion(version uint8) {
+	pdu.Version = version
+}
+
+func (pdu *PDUASPA) GetVersion() uint8 {
+	return pdu.Version
+}
+
+func (pdu *PDUASPA) GetType() uint8 {
+	return PDU_ID_ASPA
+}
+
+func (pdu *PDUASPA) AppendBinary(b []byte) []byte {
+	// Like Router Key, the flags are carried in the spot of the SessionID
+	b = appendHeader(b, pdu.Version, PDU_ID_ASPA, uint16(pdu.Flags)<<8, uint32(12+4*len(pdu.ProviderASNumbers)))
+	b = binary.BigEndian.AppendUint32(b, pdu.CustomerASNumber)
+	for _, provider := range pdu.ProviderASNumbers {
+		b = binary.BigEndian.AppendUint32(b, provider)
 	}
+	return b
+}
+
+func (pdu *PDUASPA) Write(wr io.Writer) {
+	wr.Write(pdu.Bytes())
+}
+
+// DecodeError is returned when a PDU was read entirely but is not valid.
+// It carries the error code to send back in an Error Report along with a copy of the PDU.
+type DecodeError struct {
+	Code uint16
+	PDU  []byte
+	Err  error
+}
+
+func newDecodeError(code uint16, pdu []byte, format string, a ...interface{}) *DecodeError {
+	return &DecodeError{
+		Code: code,
+		PDU:  pdu,
+		Err:  fmt.Errorf(format, a...),
+	}
+}
+
+func (e *DecodeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorReport returns the Error Report PDU describing this error.
+func (e *DecodeError) ErrorReport() *PDUErrorReport {
+	return &PDUErrorReport{
+		ErrorCode: e.Code,
+		PDUCopy:   e.PDU,
+		ErrorMsg:  e.Err.Error(),
+	}
+}
+
+// ErrNonConformantPDU is wrapped by the errors returned when strict decoding
+// rejects a PDU that could otherwise be decoded.
+var ErrNonConformantPDU = errors.New("non-conformant PDU")
+
+// DecodeOptions controls how PDUs are decoded.
+type DecodeOptions struct {
+	// Strict rejects PDUs that are well-formed but violate the specification:
+	// impossible prefix or max lengths, host bits set, non-zero reserved fields, ...
+	Strict bool
 }
 
 func DecodeBytes(b []byte) (PDU, error) {
-	buf := bytes.NewBuffer(b)
-	return Decode(buf)
+	return DecodeOptions{}.DecodeBytes(b)
 }
 
 func Decode(rdr io.Reader) (PDU, error) {
+	return DecodeOptions{}.Decode(rdr)
+}
+
+func (o DecodeOptions) DecodeBytes(b []byte) (PDU, error) {
+	buf := bytes.NewBuffer(b)
+	return o.Decode(buf)
+}
+
+func (o DecodeOptions) Decode(rdr io.Reader) (PDU, error) {
 	if rdr == nil {
 		return nil, errors.New("reader for decoding is nil")
 	}
-	var pver uint8
-	var pduType uint8
-	var sessionId uint16
-	var length uint32
-	err := binary.Read(rdr, binary.BigEndian, &pver)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(rdr, binary.BigEndian, &pduType)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(rdr, binary.BigEndian, &sessionId)
-	if err != nil {
-		return nil, err
-	}
-	err = binary.Read(rdr, binary.BigEndian, &length)
+	header := make([]byte, 8)
+	_, err := io.ReadFull(rdr, header)
 	if err != nil {
 		return nil, err
 	}
+	length := binary.BigEndian.Uint32(header[4:8])
 
 	if length < 8 {
-		return nil, fmt.Errorf("wrong length: %d < 8", length)
+		return nil, newDecodeError(PDU_ERROR_CORRUPTDATA, header, "wrong length: %d < 8", length)
 	}
 	if length > messageMaxSize {
-		return nil, fmt.Errorf("wrong length: %d > %d", length, messageMaxSize)
+		return nil, newDecodeError(PDU_ERROR_CORRUPTDATA, header, "wrong length: %d > %d", length, messageMaxSize)
 	}
 	toread := make([]byte, length-8)
-	err = binary.Read(rdr, binary.BigEndian, toread)
+	_, err = io.ReadFull(rdr, toread)
 	if err != nil {
 		return nil, err
 	}
 
+	pdu, err := decodePDU(header, toread)
+	if err != nil || !o.Strict {
+		return pdu, err
+	}
+	if err := checkConformance(pdu, header, toread); err != nil {
+		return nil, &DecodeError{
+			Code: PDU_ERROR_CORRUPTDATA,
+			PDU:  append(header, toread...),
+			Err:  err,
+		}
+	}
+	return pdu, nil
+}
+
+func decodePDU(header, toread []byte) (PDU, error) {
+	pver := header[0]
+	pduType := header[1]
+	sessionId := binary.BigEndian.Uint16(header[2:4])
+
+	corrupt := func(format string, a ...interface{}) error {
+		return newDecodeError(PDU_ERROR_CORRUPTDATA, append(header, toread...), format, a...)
+	}
+
+	if pver > PROTOCOL_VERSION_2 {
+		return nil, newDecodeError(PDU_ERROR_BADPROTOVERSION, append(header, toread...), "unsupported protocol version %d", pver)
+	}
+	if (pduType == PDU_ID_ROUTER_KEY && pver < PROTOCOL_VERSION_1) || (pduType == PDU_ID_ASPA && pver < PROTOCOL_VERSION_2) {
+		return nil, newDecodeError(PDU_ERROR_BADPDUTYPE, append(header, toread...), "%s PDU is not supported in version %d", TypeToString(pduType), pver)
+	}
+
 	switch pduType {
 	case PDU_ID_SERIAL_NOTIFY:
 		if len(toread) != 4 {
-			return nil, fmt.Errorf("wrong length for Serial Notify PDU: %d != 4", len(toread))
+			return nil, corrupt("wrong length for Serial Notify PDU: %d != 4", len(toread))
 		}
 		serial := binary.BigEndian.Uint32(toread)
 		return &PDUSerialNotify{
@@ -570,7 +708,7 @@ func Decode(rdr io.Reader) (PDU, error) {
 		}, nil
 	case PDU_ID_SERIAL_QUERY:
 		if len(toread) != 4 {
-			return nil, fmt.Errorf("wrong length for Serial Query PDU: %d != 4", len(toread))
+			return nil, corrupt("wrong length for Serial Query PDU: %d != 4", len(toread))
 		}
 		serial := binary.BigEndian.Uint32(toread)
 		return &PDUSerialQuery{
@@ -580,14 +718,14 @@ func Decode(rdr io.Reader) (PDU, error) {
 		}, nil
 	case PDU_ID_RESET_QUERY:
 		if len(toread) != 0 {
-			return nil, fmt.Errorf("wrong length for Reset Query PDU: %d != 0", len(toread))
+			return nil, corrupt("wrong length for Reset Query PDU: %d != 0", len(toread))
 		}
 		return &PDUResetQuery{
 			Version: pver,
 		}, nil
 	case PDU_ID_CACHE_RESPONSE:
 		if len(toread) != 0 {
-			return nil, fmt.Errorf("wrong length for Cache Response PDU: %d != 0", len(toread))
+			return nil, corrupt("wrong length for Cache Response PDU: %d != 0", len(toread))
 		}
 		return &PDUCacheResponse{
 			Version:   pver,
@@ -595,13 +733,13 @@ func Decode(rdr io.Reader) (PDU, error) {
 		}, nil
 	case PDU_ID_IPV4_PREFIX:
 		if len(toread) != 12 {
-			return nil, fmt.Errorf("wrong length for IPv4 Prefix PDU: %d != 12", len(toread))
+			return nil, corrupt("wrong length for IPv4 Prefix PDU: %d != 12", len(toread))
 		}
 		prefixLen := int(toread[1])
 		ip := toread[4:8]
 		addr, ok := netip.AddrFromSlice(ip)
 		if !ok {
-			return nil, fmt.Errorf("ip slice length is not 4 or 16: %+v", addr)
+			return nil, corrupt("ip slice length is not 4 or 16: %+v", addr)
 		}
 		asn := binary.BigEndian.Uint32(toread[8:])
 		return &PDUIPv4Prefix{
@@ -613,13 +751,13 @@ func Decode(rdr io.Reader) (PDU, error) {
 		}, nil
 	case PDU_ID_IPV6_PREFIX:
 		if len(toread) != 24 {
-			return nil, fmt.Errorf("wrong length for IPv6 Prefix PDU: %d != 24", len(toread))
+			return nil, corrupt("wrong length for IPv6 Prefix PDU: %d != 24", len(toread))
 		}
 		prefixLen := int(toread[1])
 		ip := toread[4:20]
 		addr, ok := netip.AddrFromSlice(ip)
 		if !ok {
-			return nil, fmt.Errorf("ip slice length is not 4 or 16: %+v", addr)
+			return nil, corrupt("ip slice length is not 4 or 16: %+v", addr)
 		}
 		asn := binary.BigEndian.Uint32(toread[20:])
 		return &PDUIPv6Prefix{
@@ -631,7 +769,7 @@ func Decode(rdr io.Reader) (PDU, error) {
 		}, nil
 	case PDU_ID_END_OF_DATA:
 		if len(toread) != 4 && len(toread) != 16 {
-			return nil, fmt.Errorf("wrong length for End of Data PDU: %d != 4 or != 16", len(toread))
+			return nil, corrupt("wrong length for End of Data PDU: %d != 4 or != 16", len(toread))
 		}
 
 		var serial uint32
@@ -657,14 +795,14 @@ func Decode(rdr io.Reader) (PDU, error) {
 		}, nil
 	case PDU_ID_CACHE_RESET:
 		if len(toread) != 0 {
-			return nil, fmt.Errorf("wrong length for Cache Reset PDU: %d != 0", len(toread))
+			return nil, corrupt("wrong length for Cache Reset PDU: %d != 0", len(toread))
 		}
 		return &PDUCacheReset{
 			Version: pver,
 		}, nil
 	case PDU_ID_ROUTER_KEY:
 		if len(toread) < 28 {
-			return nil, fmt.Errorf("wrong length for Router Key PDU: %d < 28", len(toread))
+			return nil, corrupt("wrong length for Router Key PDU: %d < 28", len(toread))
 		}
 		asn := binary.BigEndian.Uint32(toread[20:24])
 		spki := toread[24:]
@@ -680,18 +818,18 @@ func Decode(rdr io.Reader) (PDU, error) {
 		}, nil
 	case PDU_ID_ERROR_REPORT:
 		if len(toread) < 8 {
-			return nil, fmt.Errorf("wrong length for Error Report PDU: %d < 8", len(toread))
+			return nil, corrupt("wrong length for Error Report PDU: %d < 8", len(toread))
 		}
 		lenPdu := binary.BigEndian.Uint32(toread[0:4])
 		if len(toread) < int(lenPdu)+8 {
-			return nil, fmt.Errorf("wrong length for Error Report PDU: %d < %d", len(toread), lenPdu+4)
+			return nil, corrupt("wrong length for Error Report PDU: %d < %d", len(toread), lenPdu+4)
 		}
 		errPdu := toread[4 : lenPdu+4]
 		lenErrText := binary.BigEndian.Uint32(toread[lenPdu+4 : lenPdu+8])
 		// int casting for each value is needed here to prevent an uint32 overflow that could result in
 		// upper bound being lower than lower bound causing a crash
 		if len(toread) < int(lenPdu)+8+int(lenErrText) {
-			return nil, fmt.Errorf("wrong length for Error Report PDU: %d < %d", len(toread), lenPdu+8+lenErrText)
+			return nil, corrupt("wrong length for Error Report PDU: %d < %d", len(toread), lenPdu+8+lenErrText)
 		}
 		errMsg := string(toread[lenPdu+8 : lenPdu+8+lenErrText])
 		return &PDUErrorReport{
@@ -700,7 +838,149 @@ func Decode(rdr io.Reader) (PDU, error) {
 			PDUCopy:   errPdu,
 			ErrorMsg:  errMsg,
 		}, nil
+	case PDU_ID_ASPA:
+		if len(toread) < 4 || len(toread)%4 != 0 {
+			return nil, corrupt("wrong length for ASPA PDU: %d", len(toread))
+		}
+		customer := binary.BigEndian.Uint32(toread[0:4])
+		providers := make([]uint32, 0, (len(toread)-4)/4)
+		for i := 4; i < len(toread); i += 4 {
+			providers = append(providers, binary.BigEndian.Uint32(toread[i:i+4]))
+		}
+		return &PDUASPA{
+			Version: pver,
+			// Like Router Key, the flags are carried in the first byte of the SessionID spot
+			Flags:             uint8(sessionId >> 8),
+			CustomerASNumber:  customer,
+			ProviderASNumbers: providers,
+		}, nil
 	default:
-		return nil, errors.New("could not decode packet")
+		return nil, newDecodeError(PDU_ERROR_BADPDUTYPE, append(header, toread...), "unsupported PDU type %d", pduType)
+	}
+}
+
+func nonConformant(format string, a ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrNonConformantPDU, fmt.Sprintf(format, a...))
+}
+
+// checkConformance validates the fields of a decoded PDU that Decode accepts
+// as they are but the specification constrains further.
+func checkConformance(pdu PDU, header, body []byte) error {
+	switch pdu := pdu.(type) {
+	case *PDUResetQuery, *PDUCacheReset:
+		if zero := binary.BigEndian.Uint16(header[2:4]); zero != 0 {
+			return nonConformant("%s PDU has non-zero reserved field %d", TypeToString(header[1]), zero)
+		}
+	case *PDUIPv4Prefix:
+		return checkPrefixConformance(header, body, pdu.Prefix, pdu.MaxLen)
+	case *PDUIPv6Prefix:
+		return checkPrefixConformance(header, body, pdu.Prefix, pdu.MaxLen)
+	case *PDUEndOfData:
+		return checkEndOfDataConformance(pdu, body)
+	case *PDURouterKey:
+		if err := checkFlagsConformance(header); err != nil {
+			return err
+		}
+		if _, err := x509.ParsePKIXPublicKey(pdu.SubjectPublicKeyInfo); err != nil {
+			return nonConformant("Router Key PDU has an invalid Subject Public Key Info: %v", err)
+		}
+	case *PDUErrorReport:
+		if expected := 8 + len(pdu.PDUCopy) + len(pdu.ErrorMsg); len(body) != expected {
+			return nonConformant("Error Report PDU has %d trailing bytes", len(body)-expected)
+		}
+		if !utf8.ValidString(pdu.ErrorMsg) {
+			return nonConformant("Error Report PDU text is not valid UTF-8")
+		}
+	case *PDUASPA:
+		if err := checkFlagsConformance(header); err != nil {
+			return err
+		}
+		if pdu.Flags&FLAG_ADDED == 0 && len(pdu.ProviderASNumbers) > 0 {
+			return nonConformant("ASPA PDU withdrawal has %d provider ASNs", len(pdu.ProviderASNumbers))
+		}
+		for i := 1; i < len(pdu.ProviderASNumbers); i++ {
+			if pdu.ProviderASNumbers[i-1] >= pdu.ProviderASNumbers[i] {
+				return nonConformant("ASPA PDU provider ASNs are not in strictly ascending order: %d before %d",
+					pdu.ProviderASNumbers[i-1], pdu.ProviderASNumbers[i])
+			}
+		}
+	}
+	return nil
+}
+
+// checkFlagsConformance validates the flags and zero bytes of the PDUs carrying
+// their flags in the header (Router Key and ASPA).
+func checkFlagsConformance(header []byte) error {
+	if flags := header[2]; flags&^FLAG_ADDED != 0 {
+		return nonConformant("%s PDU has unknown flags 0x%02x", TypeToString(header[1]), flags)
+	}
+	if zero := header[3]; zero != 0 {
+		return nonConformant("%s PDU has non-zero reserved field %d", TypeToString(header[1]), zero)
+	}
+	return nil
+}
+
+func checkPrefixConformance(header, body []byte, prefix netip.Prefix, maxLen uint8) error {
+	if zero := binary.BigEndian.Uint16(header[2:4]); zero != 0 {
+		return nonConformant("%s PDU has non-zero reserved field %d in header", TypeToString(header[1]), zero)
+	}
+	if flags := body[0]; flags&^FLAG_ADDED != 0 {
+		return nonConformant("%s PDU has unknown flags 0x%02x", TypeToString(header[1]), flags)
+	}
+	if zero := body[3]; zero != 0 {
+		return nonConformant("%s PDU has non-zero reserved field %d", TypeToString(header[1]), zero)
+	}
+
+	// The prefix length is read from the PDU since netip does not keep invalid lengths
+	prefixLen := int(body[1])
+	bits := prefix.Addr().BitLen()
+	if prefixLen > bits {
+		return nonConformant("%s PDU has prefix length %d > %d", TypeToString(header[1]), prefixLen, bits)
+	}
+	if int(maxLen) > bits {
+		return nonConformant("%s PDU has max length %d > %d", TypeToString(header[1]), maxLen, bits)
+	}
+	if int(maxLen) < prefixLen {
+		return nonConformant("%s PDU has max length %d < prefix length %d", TypeToString(header[1]), maxLen, prefixLen)
+	}
+	if masked := prefix.Masked(); masked != prefix {
+		return nonConformant("%s PDU has host bits set in %s (expected %s)", TypeToString(header[1]), prefix, masked)
+	}
+	return nil
+}
+
+// Ranges of the timing parameters from RFC 8210 section 6.
+const (
+	minRefreshInterval = 1
+	maxRefreshInterval = 86400
+	minRetryInterval   = 1
+	maxRetryInterval   = 7200
+	minExpireInterval  = 600
+	maxExpireInterval  = 172800
+)
+
+func checkEndOfDataConformance(pdu *PDUEndOfData, body []byte) error {
+	if pdu.Version == PROTOCOL_VERSION_0 {
+		if len(body) != 4 {
+			return nonConformant("End of Data PDU has length %d in version 0", len(body)+8)
+		}
+		return nil
+	}
+	if len(body) != 16 {
+		return nonConformant("End of Data PDU has length %d in version %d", len(body)+8, pdu.Version)
+	}
+	if pdu.RefreshInterval < minRefreshInterval || pdu.RefreshInterval > maxRefreshInterval {
+		return nonConformant("End of Data PDU has refresh interval %d outside of [%d, %d]", pdu.RefreshInterval, minRefreshInterval, maxRefreshInterval)
+	}
+	if pdu.RetryInterval < minRetryInterval || pdu.RetryInterval > maxRetryInterval {
+		return nonConformant("End of Data PDU has retry interval %d outside of [%d, %d]", pdu.RetryInterval, minRetryInterval, maxRetryInterval)
+	}
+	if pdu.ExpireInterval < minExpireInterval || pdu.ExpireInterval > maxExpireInterval {
+		return nonConformant("End of Data PDU has expire interval %d outside of [%d, %d]", pdu.ExpireInterval, minExpireInterval, maxExpireInterval)
+	}
+	if pdu.ExpireInterval <= pdu.RefreshInterval || pdu.ExpireInterval <= pdu.RetryInterval {
+		return nonConformant("End of Data PDU has expire interval %d not larger than refresh (%d) and retry (%d) intervals",
+			pdu.ExpireInterval, pdu.RefreshInterval, pdu.RetryInterval)
 	}
+	return nil
 }
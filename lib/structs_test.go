@@ -1,6 +1,12 @@
 package rtrlib
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
 	"runtime"
 	"testing"
 	"unsafe"
@@ -59,3 +65,185 @@ func TestPDUPrefixStructSize(t *testing.T) {
 		t.Fatalf("unexpected PDUIPv6Prefix struct size (-want +got):\n%s", diff)
 	}
 }
+
+func TestDecodeError(t *testing.T) {
+	tests := []struct {
+		desc string
+		pdu  []byte
+		code uint16
+		copy []byte
+	}{{
+		desc: "Length smaller than header",
+		pdu:  []byte{1, PDU_ID_RESET_QUERY, 0, 0, 0, 0, 0, 4},
+		code: PDU_ERROR_CORRUPTDATA,
+		copy: []byte{1, PDU_ID_RESET_QUERY, 0, 0, 0, 0, 0, 4},
+	}, {
+		desc: "Wrong length for PDU type",
+		pdu:  []byte{1, PDU_ID_SERIAL_QUERY, 0, 1, 0, 0, 0, 10, 0, 0},
+		code: PDU_ERROR_CORRUPTDATA,
+		copy: []byte{1, PDU_ID_SERIAL_QUERY, 0, 1, 0, 0, 0, 10, 0, 0},
+	}, {
+		desc: "Unknown PDU type",
+		pdu:  []byte{1, 42, 0, 0, 0, 0, 0, 8},
+		code: PDU_ERROR_BADPDUTYPE,
+		copy: []byte{1, 42, 0, 0, 0, 0, 0, 8},
+	}, {
+		desc: "ASPA in version 1",
+		pdu:  []byte{1, PDU_ID_ASPA, 1, 0, 0, 0, 0, 12, 0, 0, 0xfb, 0xf0},
+		code: PDU_ERROR_BADPDUTYPE,
+		copy: []byte{1, PDU_ID_ASPA, 1, 0, 0, 0, 0, 12, 0, 0, 0xfb, 0xf0},
+	}, {
+		desc: "Unsupported version",
+		pdu:  []byte{3, PDU_ID_RESET_QUERY, 0, 0, 0, 0, 0, 8},
+		code: PDU_ERROR_BADPROTOVERSION,
+		copy: []byte{3, PDU_ID_RESET_QUERY, 0, 0, 0, 0, 0, 8},
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := DecodeBytes(tc.pdu)
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) {
+				t.Fatalf("Wanted a DecodeError, but got (%v)", err)
+			}
+			if decodeErr.Code != tc.code {
+				t.Errorf("Wanted code %d, but got %d", tc.code, decodeErr.Code)
+			}
+			if !bytes.Equal(decodeErr.PDU, tc.copy) {
+				t.Errorf("Wanted PDU copy %x, but got %x", tc.copy, decodeErr.PDU)
+			}
+
+			report := decodeErr.ErrorReport()
+			if report.ErrorCode != tc.code || !bytes.Equal(report.PDUCopy, tc.copy) || report.ErrorMsg != err.Error() {
+				t.Errorf("Unexpected Error Report %v", report)
+			}
+		})
+	}
+}
+
+func TestDecodeStrict(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spki, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routerKey := func(header []byte, spki []byte) []byte {
+		pdu := append(header, bytes.Repeat([]byte{0x01}, 20)...)
+		pdu = append(pdu, 0, 0, 0xfb, 0xf0)
+		pdu = append(pdu, spki...)
+		pdu[7] = byte(len(pdu))
+		return pdu
+	}
+
+	tests := []struct {
+		desc       string
+		pdu        []byte
+		conformant bool
+	}{{
+		desc:       "Valid IPv4 Prefix",
+		pdu:        []byte{1, PDU_ID_IPV4_PREFIX, 0, 0, 0, 0, 0, 20, 1, 24, 32, 0, 192, 0, 2, 0, 0, 0, 0xfb, 0xf0},
+		conformant: true,
+	}, {
+		desc: "IPv4 prefix length larger than 32",
+		pdu:  []byte{1, PDU_ID_IPV4_PREFIX, 0, 0, 0, 0, 0, 20, 1, 33, 33, 0, 192, 0, 2, 0, 0, 0, 0xfb, 0xf0},
+	}, {
+		desc: "IPv4 max length larger than 32",
+		pdu:  []byte{1, PDU_ID_IPV4_PREFIX, 0, 0, 0, 0, 0, 20, 1, 24, 33, 0, 192, 0, 2, 0, 0, 0, 0xfb, 0xf0},
+	}, {
+		desc: "IPv4 max length smaller than prefix length",
+		pdu:  []byte{1, PDU_ID_IPV4_PREFIX, 0, 0, 0, 0, 0, 20, 1, 24, 16, 0, 192, 0, 2, 0, 0, 0, 0xfb, 0xf0},
+	}, {
+		desc: "IPv4 host bits set",
+		pdu:  []byte{1, PDU_ID_IPV4_PREFIX, 0, 0, 0, 0, 0, 20, 1, 24, 24, 0, 192, 0, 2, 1, 0, 0, 0xfb, 0xf0},
+	}, {
+		desc: "IPv4 unknown flags",
+		pdu:  []byte{1, PDU_ID_IPV4_PREFIX, 0, 0, 0, 0, 0, 20, 3, 24, 24, 0, 192, 0, 2, 0, 0, 0, 0xfb, 0xf0},
+	}, {
+		desc: "IPv4 non-zero reserved field",
+		pdu:  []byte{1, PDU_ID_IPV4_PREFIX, 0, 0, 0, 0, 0, 20, 1, 24, 24, 1, 192, 0, 2, 0, 0, 0, 0xfb, 0xf0},
+	}, {
+		desc: "IPv4 non-zero reserved field in header",
+		pdu:  []byte{1, PDU_ID_IPV4_PREFIX, 0, 1, 0, 0, 0, 20, 1, 24, 24, 0, 192, 0, 2, 0, 0, 0, 0xfb, 0xf0},
+	}, {
+		desc: "Valid IPv6 Prefix",
+		pdu: []byte{1, PDU_ID_IPV6_PREFIX, 0, 0, 0, 0, 0, 32, 1, 32, 48, 0,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xfb, 0xf0},
+		conformant: true,
+	}, {
+		desc: "IPv6 prefix length larger than 128",
+		pdu: []byte{1, PDU_ID_IPV6_PREFIX, 0, 0, 0, 0, 0, 32, 1, 129, 129, 0,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xfb, 0xf0},
+	}, {
+		desc: "IPv6 host bits set",
+		pdu: []byte{1, PDU_ID_IPV6_PREFIX, 0, 0, 0, 0, 0, 32, 1, 32, 48, 0,
+			0x20, 0x01, 0x0d, 0xb8, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xfb, 0xf0},
+	}, {
+		desc: "Reset Query with non-zero reserved field",
+		pdu:  []byte{1, PDU_ID_RESET_QUERY, 0, 1, 0, 0, 0, 8},
+	}, {
+		desc:       "Valid End of Data",
+		pdu:        []byte{1, PDU_ID_END_OF_DATA, 0, 1, 0, 0, 0, 24, 0, 0, 0, 1, 0, 0, 0x0e, 0x10, 0, 0, 0x02, 0x58, 0, 0, 0x1c, 0x20},
+		conformant: true,
+	}, {
+		desc: "End of Data with version 0 length in version 1",
+		pdu:  []byte{1, PDU_ID_END_OF_DATA, 0, 1, 0, 0, 0, 12, 0, 0, 0, 1},
+	}, {
+		desc: "End of Data with expire interval out of range",
+		pdu:  []byte{1, PDU_ID_END_OF_DATA, 0, 1, 0, 0, 0, 24, 0, 0, 0, 1, 0, 0, 0x0e, 0x10, 0, 0, 0x02, 0x58, 0, 0, 0, 10},
+	}, {
+		desc: "End of Data with expire interval smaller than refresh interval",
+		pdu:  []byte{1, PDU_ID_END_OF_DATA, 0, 1, 0, 0, 0, 24, 0, 0, 0, 1, 0, 0, 0x1c, 0x20, 0, 0, 0x02, 0x58, 0, 0, 0x0e, 0x10},
+	}, {
+		desc:       "Valid Router Key",
+		pdu:        routerKey([]byte{1, PDU_ID_ROUTER_KEY, 1, 0, 0, 0, 0, 0}, spki),
+		conformant: true,
+	}, {
+		desc: "Router Key with invalid Subject Public Key Info",
+		pdu:  routerKey([]byte{1, PDU_ID_ROUTER_KEY, 1, 0, 0, 0, 0, 0}, []byte("This is not a real key")),
+	}, {
+		desc: "Router Key with non-zero reserved field",
+		pdu:  routerKey([]byte{1, PDU_ID_ROUTER_KEY, 1, 1, 0, 0, 0, 0}, spki),
+	}, {
+		desc: "Error Report with trailing data",
+		pdu:  []byte{1, PDU_ID_ERROR_REPORT, 0, 0, 0, 0, 0, 20, 0, 0, 0, 0, 0, 0, 0, 1, 'a', 0, 0, 0},
+	}, {
+		desc:       "Valid ASPA",
+		pdu:        []byte{2, PDU_ID_ASPA, 1, 0, 0, 0, 0, 20, 0, 0, 0xfb, 0xf0, 0, 0, 0xfb, 0xf1, 0, 0, 0xfb, 0xf2},
+		conformant: true,
+	}, {
+		desc: "ASPA with unsorted providers",
+		pdu:  []byte{2, PDU_ID_ASPA, 1, 0, 0, 0, 0, 20, 0, 0, 0xfb, 0xf0, 0, 0, 0xfb, 0xf2, 0, 0, 0xfb, 0xf1},
+	}, {
+		desc: "ASPA with duplicate providers",
+		pdu:  []byte{2, PDU_ID_ASPA, 1, 0, 0, 0, 0, 20, 0, 0, 0xfb, 0xf0, 0, 0, 0xfb, 0xf1, 0, 0, 0xfb, 0xf1},
+	}, {
+		desc: "ASPA withdrawal with providers",
+		pdu:  []byte{2, PDU_ID_ASPA, 0, 0, 0, 0, 0, 16, 0, 0, 0xfb, 0xf0, 0, 0, 0xfb, 0xf1},
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			if _, err := DecodeBytes(tc.pdu); err != nil {
+				t.Fatalf("Lenient decoding failed: %v", err)
+			}
+
+			_, err := DecodeOptions{Strict: true}.DecodeBytes(tc.pdu)
+			if tc.conformant {
+				if err != nil {
+					t.Fatalf("Strict decoding failed: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrNonConformantPDU) {
+				t.Fatalf("Wanted a non-conformant PDU error, but got (%v)", err)
+			}
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) || decodeErr.Code != PDU_ERROR_CORRUPTDATA || !bytes.Equal(decodeErr.PDU, tc.pdu) {
+				t.Errorf("Unexpected DecodeError %+v", decodeErr)
+			}
+		})
+	}
+}
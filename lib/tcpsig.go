@@ -0,0 +1,184 @@
+package rtrlib
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Maximum length of a TCP-MD5 or TCP-AO key
+const TCPSignatureMaxKeyLen = 80
+
+// Default MAC algorithm of TCP-AO (HMAC-SHA-1-96, RFC 5926)
+const TCPAODefaultAlgorithm = "hmac(sha1)"
+
+var ErrTCPSignatureUnsupported = errors.New("TCP-MD5 and TCP-AO are not supported on this platform")
+
+// TCPSignature is a key authenticating the TCP segments exchanged with the
+// peers of a prefix, with TCP-MD5 (RFC 2385) or TCP-AO (RFC 5925).
+type TCPSignature struct {
+	// Peers using the key. When connecting, an invalid prefix applies the key
+	// to the address connected to.
+	Peer netip.Prefix
+	Key  []byte
+
+	// TCP-AO instead of TCP-MD5, with the identifiers of the key and the MAC
+	// algorithm (TCPAODefaultAlgorithm if empty)
+	AO        bool
+	SendID    uint8
+	RecvID    uint8
+	Algorithm string
+}
+
+func (sig TCPSignature) String() string {
+	if sig.AO {
+		return fmt.Sprintf("%v ao %d %d", sig.Peer, sig.SendID, sig.RecvID)
+	}
+	return fmt.Sprintf("%v md5", sig.Peer)
+}
+
+// TCPSignatures are the keys of the peers of a socket. They are only
+// supported on Linux; TCP-AO requires Linux 6.7.
+type TCPSignatures []TCPSignature
+
+// Control sets the keys on a socket before it listens or connects. It is
+// meant to be the Control function of a net.ListenConfig or net.Dialer, with
+// Multipath TCP disabled as it does not support the keys.
+func (sigs TCPSignatures) Control(network, address string, c syscall.RawConn) error {
+	ipv6 := network == "tcp6"
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		for _, sig := range sigs {
+			peer := sig.Peer
+			if !peer.IsValid() {
+				ap, perr := netip.ParseAddrPort(address)
+				if perr != nil {
+					err = fmt.Errorf("no peer for the key: %w", perr)
+					return
+				}
+				peer = netip.PrefixFrom(ap.Addr().Unmap(), ap.Addr().Unmap().BitLen())
+			}
+			// An IPv4 socket can not reach IPv6 peers
+			if !ipv6 && peer.Addr().Is6() {
+				continue
+			}
+			if err = setTCPSignature(fd, ipv6, peer, &sig); err != nil {
+				err = fmt.Errorf("key of %v: %w", peer, err)
+				return
+			}
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// SetListener sets the keys on a TCP listener that is already listening
+// (eg: a socket passed by the service manager). It fails on a Multipath TCP
+// listener, which net.Listen creates by default.
+func (sigs TCPSignatures) SetListener(l net.Listener) error {
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("TCP-MD5 and TCP-AO require a TCP listener, got %v", l.Addr())
+	}
+	rc, err := tl.SyscallConn()
+	if err != nil {
+		return err
+	}
+	network := "tcp4"
+	if addr, ok := l.Addr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		network = "tcp6"
+	}
+	return sigs.Control(network, l.Addr().String(), rc)
+}
+
+// ParseTCPSignatures reads the keys of the peers, one per line: a prefix or
+// an address followed by either "md5" and the key, or "ao", the send and
+// receive identifiers, the key and optionally the MAC algorithm. Empty lines
+// and comments starting with # are ignored.
+func ParseTCPSignatures(r io.Reader) (TCPSignatures, error) {
+	var sigs TCPSignatures
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		sig, err := parseTCPSignature(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, scanner.Err()
+}
+
+func parseTCPSignature(fields []string) (TCPSignature, error) {
+	var sig TCPSignature
+	if len(fields) < 3 {
+		return sig, errors.New("wanted a prefix, a type and a key")
+	}
+	if strings.Contains(fields[0], "/") {
+		prefix, err := netip.ParsePrefix(fields[0])
+		if err != nil {
+			return sig, err
+		}
+		sig.Peer = prefix.Masked()
+	} else {
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return sig, err
+		}
+		sig.Peer = netip.PrefixFrom(addr, addr.BitLen())
+	}
+
+	switch fields[1] {
+	case "md5":
+		if len(fields) != 3 {
+			return sig, errors.New("wanted a prefix, md5 and a key")
+		}
+		sig.Key = []byte(fields[2])
+	case "ao":
+		if len(fields) != 5 && len(fields) != 6 {
+			return sig, errors.New("wanted a prefix, ao, the send and receive identifiers, a key and an optional algorithm")
+		}
+		sig.AO = true
+		for i, id := range []*uint8{&sig.SendID, &sig.RecvID} {
+			v, err := strconv.ParseUint(fields[2+i], 10, 8)
+			if err != nil {
+				return sig, fmt.Errorf("invalid key identifier %q", fields[2+i])
+			}
+			*id = uint8(v)
+		}
+		sig.Key = []byte(fields[4])
+		if len(fields) == 6 {
+			sig.Algorithm = fields[5]
+		}
+	default:
+		return sig, fmt.Errorf("unknown type %q, wanted md5 or ao", fields[1])
+	}
+	if len(sig.Key) > TCPSignatureMaxKeyLen {
+		return sig, fmt.Errorf("key longer than %d bytes", TCPSignatureMaxKeyLen)
+	}
+	return sig, nil
+}
+
+// ReadTCPSignaturesFile reads the keys of the peers from a file, see
+// ParseTCPSignatures.
+func ReadTCPSignaturesFile(path string) (TCPSignatures, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseTCPSignatures(f)
+}
@@ -0,0 +1,79 @@
+package rtrlib
+
+import (
+	"net/netip"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// TCP_AO_ADD_KEY from linux/tcp.h, not defined by x/sys yet
+const tcpAOAddKey = 38
+
+// Length of the MAC of the algorithms of RFC 5926
+const tcpAOMACLen = 12
+
+// tcpAOAdd is struct tcp_ao_add from linux/tcp.h
+type tcpAOAdd struct {
+	Addr      unix.SockaddrStorage
+	AlgName   [64]byte
+	Ifindex   int32
+	Flags     uint32 // set_current, set_rnext
+	Reserved2 uint16
+	Prefix    uint8
+	SndID     uint8
+	RcvID     uint8
+	MACLen    uint8
+	KeyFlags  uint8
+	KeyLen    uint8
+	Key       [TCPSignatureMaxKeyLen]byte
+}
+
+// sockaddr returns the address of a peer in the family of the socket. The
+// kernel expects IPv4 peers of IPv6 sockets as mapped addresses with the
+// length of the IPv4 prefix.
+func sockaddr(ipv6 bool, addr netip.Addr) unix.SockaddrStorage {
+	var ss unix.SockaddrStorage
+	if ipv6 {
+		sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(&ss))
+		sa.Family = unix.AF_INET6
+		sa.Addr = addr.As16()
+	} else {
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(&ss))
+		sa.Family = unix.AF_INET
+		sa.Addr = addr.As4()
+	}
+	return ss
+}
+
+func setTCPSignature(fd uintptr, ipv6 bool, peer netip.Prefix, sig *TCPSignature) error {
+	if sig.AO {
+		algorithm := sig.Algorithm
+		if algorithm == "" {
+			algorithm = TCPAODefaultAlgorithm
+		}
+		// The first key added becomes the current one
+		ao := tcpAOAdd{
+			Addr:   sockaddr(ipv6, peer.Addr()),
+			Prefix: uint8(peer.Bits()),
+			SndID:  sig.SendID,
+			RcvID:  sig.RecvID,
+			MACLen: tcpAOMACLen,
+			KeyLen: uint8(len(sig.Key)),
+		}
+		copy(ao.AlgName[:len(ao.AlgName)-1], algorithm)
+		copy(ao.Key[:], sig.Key)
+		b := unsafe.Slice((*byte)(unsafe.Pointer(&ao)), unsafe.Sizeof(ao))
+		return os.NewSyscallError("setsockopt TCP_AO_ADD_KEY", unix.SetsockoptString(int(fd), unix.IPPROTO_TCP, tcpAOAddKey, string(b)))
+	}
+
+	md5 := unix.TCPMD5Sig{
+		Addr:      sockaddr(ipv6, peer.Addr()),
+		Flags:     unix.TCP_MD5SIG_FLAG_PREFIX,
+		Prefixlen: uint8(peer.Bits()),
+		Keylen:    uint16(len(sig.Key)),
+	}
+	copy(md5.Key[:], sig.Key)
+	return os.NewSyscallError("setsockopt TCP_MD5SIG_EXT", unix.SetsockoptTCPMD5Sig(int(fd), unix.IPPROTO_TCP, unix.TCP_MD5SIG_EXT, &md5))
+}
@@ -0,0 +1,98 @@
+package rtrlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestTCPAOAddSize(t *testing.T) {
+	// sizeof(struct tcp_ao_add)
+	if size := unsafe.Sizeof(tcpAOAdd{}); size != 288 {
+		t.Errorf("Wanted 288 bytes, but got %d", size)
+	}
+}
+
+func TestTCPSignatureLoopback(t *testing.T) {
+	loopback := netip.MustParsePrefix("127.0.0.1/32")
+	tests := []struct {
+		desc   string
+		bind   string
+		server TCPSignature
+		client TCPSignature
+		// Set on the listener after it listens
+		existing bool
+	}{
+		{"MD5", "127.0.0.1:0",
+			TCPSignature{Peer: loopback, Key: []byte("secret")},
+			TCPSignature{Key: []byte("secret")}, false},
+		{"MD5 dual-stack", "[::]:0",
+			TCPSignature{Peer: loopback, Key: []byte("secret")},
+			TCPSignature{Key: []byte("secret")}, false},
+		{"MD5 listening", "127.0.0.1:0",
+			TCPSignature{Peer: loopback, Key: []byte("secret")},
+			TCPSignature{Key: []byte("secret")}, true},
+		{"AO", "127.0.0.1:0",
+			TCPSignature{Peer: loopback, Key: []byte("secret"), AO: true, SendID: 100, RecvID: 101},
+			TCPSignature{Key: []byte("secret"), AO: true, SendID: 101, RecvID: 100}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			lc := net.ListenConfig{}
+			lc.SetMultipathTCP(false)
+			if !tc.existing {
+				lc.Control = TCPSignatures{tc.server}.Control
+			}
+			l, err := lc.Listen(context.Background(), "tcp", tc.bind)
+			if err == nil && tc.existing {
+				if err = (TCPSignatures{tc.server}).SetListener(l); err != nil {
+					l.Close()
+				}
+			}
+			if errors.Is(err, unix.ENOPROTOOPT) || errors.Is(err, unix.ENOENT) {
+				t.Skipf("%s is not supported by the kernel: %v", tc.desc, err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := NewServer(ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_1}, nil, nil)
+			served := make(chan error)
+			go func() {
+				served <- s.Serve(l, TransportTCP)
+			}()
+			defer func() {
+				s.Shutdown(context.Background())
+				<-served
+			}()
+
+			// A connection without the key is not established
+			addr := net.JoinHostPort("127.0.0.1", fmt.Sprint(l.Addr().(*net.TCPAddr).Port))
+			conn, err := net.DialTimeout("tcp", addr, 500*time.Millisecond)
+			if err == nil {
+				conn.Close()
+				t.Error("Wanted a connection without the key to fail")
+			}
+
+			dialer := net.Dialer{Timeout: 5 * time.Second, Control: TCPSignatures{tc.client}.Control}
+			conn, err = dialer.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			var clients []*Client
+			for deadline := time.Now().Add(5 * time.Second); len(clients) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				clients = s.GetClientList()
+			}
+			if len(clients) != 1 {
+				t.Fatalf("Wanted 1 client, but got %d", len(clients))
+			}
+		})
+	}
+}
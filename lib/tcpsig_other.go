@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package rtrlib
+
+import (
+	"net/netip"
+)
+
+func setTCPSignature(fd uintptr, ipv6 bool, peer netip.Prefix, sig *TCPSignature) error {
+	return ErrTCPSignatureUnsupported
+}
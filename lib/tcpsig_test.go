@@ -0,0 +1,45 @@
+package rtrlib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTCPSignatures(t *testing.T) {
+	sigs, err := ParseTCPSignatures(strings.NewReader(`
+# Routers
+192.0.2.0/24  md5 secret1
+2001:db8::1   ao  100 101 secret2    # default algorithm
+198.51.100.7  ao  1 2 secret3 cmac(aes128)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"192.0.2.0/24 md5", "2001:db8::1/128 ao 100 101", "198.51.100.7/32 ao 1 2"}
+	if len(sigs) != len(want) {
+		t.Fatalf("Wanted %v, but got %v", want, sigs)
+	}
+	for i := range want {
+		if got := sigs[i].String(); got != want[i] {
+			t.Errorf("Wanted key %q, but got %q", want[i], got)
+		}
+	}
+	if string(sigs[1].Key) != "secret2" || sigs[1].Algorithm != "" || sigs[2].Algorithm != "cmac(aes128)" {
+		t.Errorf("Unexpected keys %+v", sigs)
+	}
+
+	for _, invalid := range []string{
+		"192.0.2.0/24 md5",
+		"192.0.2.0/24 sha1 secret",
+		"192.0.2.0/33 md5 secret",
+		"router.example.net md5 secret",
+		"192.0.2.0/24 md5 secret extra",
+		"192.0.2.0/24 ao 256 1 secret",
+		"192.0.2.0/24 ao 1 secret",
+		"192.0.2.0/24 md5 " + strings.Repeat("k", TCPSignatureMaxKeyLen+1),
+	} {
+		if _, err := ParseTCPSignatures(strings.NewReader(invalid)); err == nil {
+			t.Errorf("Wanted an error for %q", invalid)
+		}
+	}
+}
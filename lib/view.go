@@ -0,0 +1,65 @@
+package rtrlib
+
+import (
+	"net/netip"
+)
+
+// A View is a set of data served to some clients instead of the data of the
+// server, for instance a subset of it. Each view has its own session IDs,
+// serials and diff history: a Server that does not serve connections can hold
+// the data of a view.
+type View struct {
+	Name string
+	Data SendableDataManager
+
+	// Clients matching any of these are served the view
+	Prefixes []netip.Prefix
+	// Subjects of TLS client certificates, as formatted by pkix.Name.String
+	TLSSubjects []string
+	SSHUsers    []string
+}
+
+// Match tells whether the view is served to the client.
+func (v *View) Match(c *Client) bool {
+	if addr, ok := connAddr(c.GetRemoteAddress()); ok {
+		addr = addr.Unmap()
+		for _, prefix := range v.Prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+	}
+	if subject := c.GetTLSSubject(); subject != "" {
+		for _, s := range v.TLSSubjects {
+			if s == subject {
+				return true
+			}
+		}
+	}
+	if user := c.GetSSHUser(); user != "" {
+		for _, u := range v.SSHUsers {
+			if u == user {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ViewSelector chooses the view served to a client when it connects, nil to
+// serve the data of the server.
+type ViewSelector interface {
+	SelectView(c *Client) *View
+}
+
+// Views selects the first view matching the client.
+type Views []*View
+
+func (vs Views) SelectView(c *Client) *View {
+	for _, v := range vs {
+		if v.Match(c) {
+			return v
+		}
+	}
+	return nil
+}
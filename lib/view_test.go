@@ -0,0 +1,129 @@
+package rtrlib
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestViewsSelect(t *testing.T) {
+	v4 := &View{Name: "v4", Prefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}}
+	edge := &View{Name: "edge", SSHUsers: []string{"edge"}, Prefixes: []netip.Prefix{netip.MustParsePrefix("2001:db8::/32")}}
+	views := Views{v4, edge}
+
+	tests := []struct {
+		desc    string
+		addr    string
+		sshUser string
+		want    *View
+	}{
+		{"Prefix", "192.0.2.1", "", v4},
+		{"Mapped address", "::ffff:192.0.2.1", "", v4},
+		{"IPv6 prefix", "2001:db8::1", "", edge},
+		{"SSH user", "198.51.100.1", "edge", edge},
+		{"First match", "192.0.2.1", "edge", v4},
+		{"No match", "198.51.100.1", "core", nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			srv, cli := net.Pipe()
+			defer cli.Close()
+			addr := net.TCPAddrFromAddrPort(netip.AddrPortFrom(netip.MustParseAddr(tc.addr), 323))
+			c := ClientFromConn(&addrConn{Conn: srv, addr: addr}, nil, nil)
+			c.sshUser = tc.sshUser
+			if got := views.SelectView(c); got != tc.want {
+				t.Errorf("Wanted view %v, but got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestServeView(t *testing.T) {
+	data := NewServer(ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_1, SessId: 2000}, nil, nil)
+	data.AddData(GenerateVrps(5, 0))
+	view := &View{Name: "local", Data: data, Prefixes: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+
+	h := &DefaultRTREventHandler{}
+	s := NewServer(ServerConfiguration{ProtocolVersion: PROTOCOL_VERSION_1, SessId: 1000, Views: Views{view}}, nil, h)
+	h.SetSDManager(s)
+	s.AddData(GenerateVrps(20, 0))
+	s.AddData(GenerateVrps(20, 1))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- s.Serve(l, TransportTCP)
+	}()
+	defer func() {
+		s.Shutdown(context.Background())
+		<-served
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rd := NewPDUReader(conn)
+
+	// readResponse returns the number of prefixes and the End of Data
+	readResponse := func() (int, *PDUEndOfData) {
+		var count int
+		for {
+			pdu, err := rd.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch pdu := pdu.(type) {
+			case *PDUIPv4Prefix, *PDUIPv6Prefix:
+				count++
+			case *PDUEndOfData:
+				return count, pdu
+			case *PDUCacheResponse:
+			default:
+				t.Fatalf("Unexpected PDU %v", pdu)
+			}
+		}
+	}
+
+	if _, err := conn.Write((&PDUResetQuery{Version: PROTOCOL_VERSION_1}).Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	count, eod := readResponse()
+	if count != 5 || eod.SessionId != 2000 || eod.SerialNumber != 0 {
+		t.Errorf("Wanted the 5 prefixes of the view with serial 0 of session 2000, but got %d prefixes with serial %d of session %d",
+			count, eod.SerialNumber, eod.SessionId)
+	}
+
+	// The clients are notified of the serial of their view
+	data.AddData(GenerateVrps(5, 1))
+	s.NotifyClientsLatest()
+	pdu, err := rd.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notify, ok := pdu.(*PDUSerialNotify); !ok || notify.SessionId != 2000 || notify.SerialNumber != 1 {
+		t.Fatalf("Wanted a Serial Notify for serial 1 of session 2000, but got %v", pdu)
+	}
+
+	// The diff is the one of the view
+	query := &PDUSerialQuery{Version: PROTOCOL_VERSION_1, SessionId: 2000, SerialNumber: 0}
+	if _, err := conn.Write(query.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := data.GetSDsSerialDiff(0)
+	count, eod = readResponse()
+	if count != len(want) || eod.SerialNumber != 1 {
+		t.Errorf("Wanted the %d changes of the view with serial 1, but got %d with serial %d", len(want), count, eod.SerialNumber)
+	}
+
+	if info := s.GetClientList(); len(info) != 1 || info[0].GetView() != view {
+		t.Errorf("Wanted the client to be served the view, but got %v", info)
+	}
+}
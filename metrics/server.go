@@ -9,15 +9,18 @@ import (
 )
 
 type ServerMetrics struct {
-	NumberOfVRPs      *prometheus.GaugeVec
-	NumberOfObjects   *prometheus.GaugeVec
-	LastRefresh       *prometheus.GaugeVec
-	LastChange        *prometheus.GaugeVec
-	RefreshStatusCode *prometheus.CounterVec
-	ClientsMetric     *prometheus.GaugeVec
-	PDUsRecv          *prometheus.CounterVec
-	CurrentSerial     prometheus.Gauge
-	info              prometheus.GaugeFunc
+	NumberOfVRPs        *prometheus.GaugeVec
+	NumberOfObjects     *prometheus.GaugeVec
+	LastRefresh         *prometheus.GaugeVec
+	LastChange          *prometheus.GaugeVec
+	RefreshStatusCode   *prometheus.CounterVec
+	ClientsMetric       *prometheus.GaugeVec
+	PDUsRecv            *prometheus.CounterVec
+	SlowClients         *prometheus.CounterVec
+	RejectedConnections *prometheus.CounterVec
+	ErrorReports        *prometheus.CounterVec
+	CurrentSerial       prometheus.Gauge
+	info                prometheus.GaugeFunc
 }
 
 func NewServerMetrics(app_version string) *ServerMetrics {
@@ -71,6 +74,27 @@ func NewServerMetrics(app_version string) *ServerMetrics {
 		},
 		[]string{"type"},
 	)
+	metrics.SlowClients = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rtr_slow_clients",
+			Help: "Clients that could not keep up, by action taken.",
+		},
+		[]string{"action"},
+	)
+	metrics.RejectedConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rtr_rejected_connections",
+			Help: "Connections closed before serving them, by transport and reason.",
+		},
+		[]string{"transport", "reason"},
+	)
+	metrics.ErrorReports = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rtr_error_reports",
+			Help: "Error Reports received from the routers, by error code.",
+		},
+		[]string{"code"},
+	)
 	metrics.CurrentSerial = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "rtr_serial",
@@ -104,9 +128,43 @@ func (m *ServerMetrics) initMetrics() {
 	prometheus.MustRegister(m.RefreshStatusCode)
 	prometheus.MustRegister(m.ClientsMetric)
 	prometheus.MustRegister(m.PDUsRecv)
+	prometheus.MustRegister(m.SlowClients)
+	prometheus.MustRegister(m.RejectedConnections)
+	prometheus.MustRegister(m.ErrorReports)
 	prometheus.MustRegister(m.CurrentSerial)
 }
 
+// RegisterSendQueues exports the total and largest size of the PDUs queued
+// for the clients, returned by queued.
+func (m *ServerMetrics) RegisterSendQueues(queued func() []int) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "rtr_send_queue_bytes",
+			Help: "Size of the PDUs queued for all the clients.",
+		},
+		func() float64 {
+			var total int
+			for _, size := range queued() {
+				total += size
+			}
+			return float64(total)
+		},
+	))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "rtr_send_queue_max_bytes",
+			Help: "Size of the PDUs queued for the client with the most.",
+		},
+		func() float64 {
+			var largest int
+			for _, size := range queued() {
+				largest = max(largest, size)
+			}
+			return float64(largest)
+		},
+	))
+}
+
 func getHostAndDomainName() (string, string) {
 	hostname, err := os.Hostname()
 	if err != nil {
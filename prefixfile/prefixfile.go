@@ -12,11 +12,13 @@ type RPKIList struct {
 	Metadata   MetaData        `json:"metadata,omitempty"`
 	ROA        []VRPJson       `json:"roas"` // for historical reasons this is called 'roas', but should've been called vrps
 	BgpSecKeys []BgpSecKeyJson `json:"bgpsec_keys,omitempty"`
+	ASPA       []VAPJson       `json:"aspas,omitempty"`
 }
 
 type MetaData struct {
 	Counts          int    `json:"vrps"`
 	CountBgpSecKeys int    `json:"bgpsec_pubkeys"`
+	CountASPAs      int    `json:"aspas,omitempty"`
 	Buildtime       string `json:"buildtime,omitempty"`
 	GeneratedUnix   *int64 `json:"generated,omitempty"`
 	SessionID       int    `json:"sessionid,omitempty"`
@@ -44,6 +46,14 @@ type BgpSecKeyJson struct {
 	Ski string `json:"ski"`
 }
 
+// Validated ASPA Payload, as exported by rpki-client
+type VAPJson struct {
+	CustomerAsid uint32   `json:"customer_asid"`
+	Expires      *int64   `json:"expires,omitempty"`
+	Providers    []uint32 `json:"providers"`
+	TA           string   `json:"ta,omitempty"`
+}
+
 func (md MetaData) GetBuildTime() time.Time {
 	bt, err := time.Parse(time.RFC3339, md.Buildtime)
 	if err != nil {